@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// clearCmd clears the alarm state of TinyG.
+const clearCmd = `{"clear":null}`
+
+// clearTimeout is the time to wait until TinyG acknowledges clearCmd.
+const clearTimeout = 5 * time.Second
+
+// Alarm tells that the machine has stopped because of an exception, such as a limit switch hit
+// or a shutdown. The alarm is latched: job lines are refused until it's explicitly cleared.
+type Alarm struct {
+	// Active is false, when the alarm is cleared.
+	Active bool `json:"active"`
+
+	// Status is the status code from the exception report.
+	Status tinyg.StatusCode `json:"status,omitempty"`
+
+	// Msg is a human-readable description of the alarm.
+	Msg string `json:"msg,omitempty"`
+}
+
+// alarmed returns the latched alarm, or nil, if there's none.
+func (m *machine) alarmed() *Alarm {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.alarm
+}
+
+// raise latches an alarm, stops the running job and notifies the listeners.
+func (m *machine) raise(e *tinyg.Exception) {
+	a := &Alarm{Active: true, Status: e.St, Msg: e.Msg}
+	if a.Msg == "" {
+		a.Msg = e.St.Message()
+	}
+	m.mu.Lock()
+	m.alarm = a
+	job := m.job
+	m.mu.Unlock()
+	log.Printf("Alarm: %v", e)
+	m.ps.Pub(&Message{Alarm: a})
+	if job != nil {
+		job.stop(JobFailed, &Error{Kind: AlarmError, Msg: a.Msg})
+	}
+}
+
+func (m *machine) ClearAlarm() error {
+	ctx, cancel := context.WithTimeout(context.Background(), clearTimeout)
+	defer cancel()
+	if _, err := m.Do(ctx, clearCmd); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	was := m.alarm != nil
+	m.alarm = nil
+	m.mu.Unlock()
+	if was {
+		log.Print("Alarm cleared")
+		m.ps.Pub(&Message{Alarm: &Alarm{Active: false}})
+	}
+	return nil
+}
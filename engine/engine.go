@@ -5,11 +5,15 @@ package engine
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/samofly/gentle/tinyg"
 )
@@ -18,14 +22,115 @@ import (
 type Machine interface {
 	// Send sends a command to the machine. Send returns early.
 	// It does not wait until the command is executed or even sent to the real machine.
+	// If the machine rejects the command, the error is published to the listeners.
 	Send(cmd string)
 
+	// Do sends a command to the machine and waits until the machine acknowledges it.
+	// It returns the response with the footer, or an error, if the command was rejected
+	// or dropped. In the text mode, there are no acknowledgements, and the response is nil.
+	// If ctx is done before the command is acknowledged, ctx.Err() is returned,
+	// but the command may still be executed by the machine.
+	Do(ctx context.Context, cmd string) (*tinyg.Response, error)
+
 	// Sub returns a channel to follow message from the machine.
 	// Messages will be sent to the channel and discarded, if sending to the channel would block.
 	// Thus, it's safe to not read from this channel.
 	Sub() <-chan *Message
+
+	// ConnState returns the current state of the connection to the machine.
+	ConnState() ConnState
+
+	// State returns the last state of the machine published to the listeners.
+	State() *State
+
+	// Job returns the running job, or nil, if there's none.
+	Job() *Job
+
+	// Hold pauses the motion (feedhold). Hold, Resume and Flush are sent to the machine
+	// immediately, bypassing the queue of commands.
+	Hold()
+
+	// Resume resumes the motion after a feedhold (cycle start).
+	Resume()
+
+	// Flush discards the moves queued in the machine planner. It only works during a feedhold.
+	Flush()
+
+	// Run starts streaming a g-code program through the machine.
+	// Only one job may be running at a time.
+	Run(name string, src io.Reader) (*Job, error)
+
+	// ClearAlarm clears the alarm state of the machine, so that jobs could run again.
+	// The alarm stays latched, unless the machine acknowledges the clear.
+	ClearAlarm() error
+
+	// SetEnvelope sets the working envelope of the machine. Moves which would leave it
+	// are refused with a LimitError. If env is nil, the moves are not checked.
+	SetEnvelope(env *Envelope)
+
+	// Home runs the homing cycle for the axes: "X", "Y", "Z", "XY" or "XYZ".
+	Home(axes string) error
+
+	// RequireHoming enables the homing interlock: motion commands are refused with
+	// a HomingError, until the axes they move are homed.
+	RequireHoming(on bool)
+
+	// OverrideHoming allows the motion without homing, even if the interlock is enabled.
+	// It's meant for the operator, who knows what they're doing, and it's logged.
+	OverrideHoming(on bool)
+
+	// Jog moves the axis ("X", "Y" or "Z") by the step, one of JogSteps, in mm, and waits until
+	// the machine accepts the move. The step is negative to move in the negative direction.
+	// If feed is not positive, DefaultJogFeed is used. The jog is refused while a job is running.
+	Jog(axis string, step, feed float64) error
+
+	// JogStart starts the continuous jog of the axis in the direction (1 or -1) towards the soft limit.
+	// The jog goes on, until it's stopped with JogStop or it's not renewed with the same JogStart
+	// within JogTimeout. A jog of another axis or in another direction stops the previous one.
+	JogStart(axis string, dir int, feed float64) error
+
+	// JogStop stops the continuous jog with a feedhold and a queue flush.
+	JogStop()
+
+	// SetOffset sets the work offset of the axes ("X", "Y", "Z", "XY" or "XYZ"), so that the current
+	// position becomes v in the work coordinates, in the current units: v is 0 to zero the axes.
+	// The offset is "G92", or one of the coordinate systems "G54" to "G59", which is set with G10 L20.
+	// It's refused while a job is running.
+	SetOffset(offset, axes string, v float64) error
+
+	// ResetOffset clears the offset of all the axes: "G92" or one of the coordinate systems "G54" to "G59".
+	// It's refused while a job is running.
+	ResetOffset(offset string) error
+
+	// SetSpindle starts the spindle at the speed, rpm, clockwise (M3) or counterclockwise (M4),
+	// or stops it (M5), and waits until the machine accepts the command. It's refused while a job is running.
+	SetSpindle(sp Spindle) error
+
+	// SetCoolant turns the mist (M7) and the flood (M8) coolant on or off (M9), and waits until the machine
+	// accepts the commands. It's refused while a job is running.
+	SetCoolant(c Coolant) error
+
+	// RequireSupportedFirmware makes the machine refuse g-code with a FirmwareError,
+	// if the firmware is not in the table of the supported ones. Otherwise, it's only a warning.
+	// The config and the queries are always allowed.
+	RequireSupportedFirmware(on bool)
 }
 
+// ConnState describes the health of the connection to the machine.
+type ConnState string
+
+const (
+	// Connected means that the machine talks to us and its responses make sense.
+	Connected ConnState = "connected"
+
+	// Degraded means that the connection is alive, but the machine has recently sent
+	// something we could not understand.
+	Degraded ConnState = "degraded"
+
+	// Disconnected means that the connection to the machine is lost.
+	Disconnected ConnState = "disconnected"
+)
+
 // Message is a message from the connected machine to the listeners.
 type Message struct {
 	// Raw is a raw output from the CNC machine. It's up to the listener to interpret this.
@@ -34,134 +139,609 @@ type Message struct {
 
 	// State is a CNC state, such the position of the control point.
 	State *State `json:"state,omitempty"`
+
+	// Conn is set, when the state of the connection to the machine changes.
+	Conn ConnState `json:"conn,omitempty"`
+
+	// Error is set, when something went wrong while talking to the machine.
+	Error *Error `json:"error,omitempty"`
+
+	// Job is the progress of the running job.
+	Job *Progress `json:"job,omitempty"`
+
+	// Alarm is set, when the machine raises or clears an alarm.
+	Alarm *Alarm `json:"alarm,omitempty"`
+
+	// Control is set, when the control lease changes hands or is requested.
+	Control *Control `json:"control,omitempty"`
+}
+
+// ErrorKind classifies errors reported by the engine.
+type ErrorKind string
+
+const (
+	// ParseError means that a line received from the machine could not be parsed.
+	ParseError ErrorKind = "parse"
+
+	// ReadError means that reading from the machine connection failed.
+	ReadError ErrorKind = "read"
+
+	// WriteError means that a command could not be written to the machine connection.
+	WriteError ErrorKind = "write"
+
+	// DialError means that the connection to the machine could not be opened.
+	DialError ErrorKind = "dial"
+
+	// DroppedError means that a command was dropped, because the machine is disconnected.
+	DroppedError ErrorKind = "dropped"
+
+	// StatusError means that the machine has rejected a command with a non-zero status code.
+	StatusError ErrorKind = "status"
+
+	// AlarmError means that a job line was refused, because the machine is in alarm state.
+	AlarmError ErrorKind = "alarm"
+
+	// RejectedError means that a command was rejected by the sender before reaching the machine,
+	// for example, because the g-code is not allowed by the policy.
+	RejectedError ErrorKind = "rejected"
+
+	// LimitError means that a move was refused, because it would leave the working envelope.
+	LimitError ErrorKind = "limit"
+
+	// HomingError means that a motion command was refused, because the machine is not homed.
+	HomingError ErrorKind = "homing"
+
+	// FirmwareError means that the firmware of the machine is not supported.
+	FirmwareError ErrorKind = "firmware"
+
+	// SpindleError means that a cutting move of a job was refused, because the spindle is off.
+	SpindleError ErrorKind = "spindle"
+
+	// ControlError means that a command was refused, because another client holds the control lease.
+	ControlError ErrorKind = "control"
+)
+
+// Error is an error which happened while talking to the machine.
+// Errors are published to the listeners instead of terminating the process,
+// so that the operator could see what's going on and decide what to do.
+type Error struct {
+	Kind ErrorKind `json:"kind"`
+
+	// Msg is a human-readable description of the error.
+	Msg string `json:"msg"`
+
+	// Line is the offending line (a command or a response), if any.
+	Line string `json:"line,omitempty"`
+
+	// Status is the status code reported by the machine, if any.
+	Status tinyg.StatusCode `json:"status,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Line == "" {
+		return fmt.Sprintf("%s error: %s", e.Kind, e.Msg)
+	}
+	return fmt.Sprintf("%s error: %s, line: %q", e.Kind, e.Msg, e.Line)
+}
+
+// Dialer opens a new connection to the machine.
+type Dialer func() (io.ReadWriter, error)
+
+// errNoRedial is returned by a Dialer, which can't open the connection once again.
+var errNoRedial = errors.New("the connection can't be reopened")
+
+const (
+	// minBackoff is the delay before the first reconnection attempt.
+	minBackoff = 100 * time.Millisecond
+
+	// maxBackoff is the maximum delay between reconnection attempts.
+	maxBackoff = 10 * time.Second
+)
+
+// srFields are the fields of the status reports, the state is built from.
+const srFields = `"mpox":t,"mpoy":t,"mpoz":t,"ofsx":t,"ofsy":t,"ofsz":t,"stat":t,"unit":t,"coor":t,"momo":t,"dist":t,"home":t,"homx":t,"homy":t,"homz":t,"vel":t,"feed":t,"line":t`
+
+// spindleSRCmd adds the spindle and the coolant to the status reports. The command replaces the fields,
+// so if the firmware does not know them and rejects it, srFields are still reported.
+const spindleSRCmd = `{"sr":{` + srFields + `,"spe":t,"spd":t,"sps":t,"com":t,"cof":t}}`
+
+// initCmds are sent to the machine every time the connection is established.
+var initCmds = []string{
+	// Only report changed values in status reports.
+	`{"sv":1}`,
+	// Status report interval, ms.
+	`{"si":250}`,
+	// Report the number of available planner buffers, when it changes.
+	`{"qv":1}`,
+	// Fields to include into status reports.
+	`{"sr":{` + srFields + `}}`,
+	spindleSRCmd,
+	// Origins of the coordinate systems and the G92 offset, to check the moves against the envelope.
+	`{"g54":n}`, `{"g55":n}`, `{"g56":n}`, `{"g57":n}`, `{"g58":n}`, `{"g59":n}`, `{"g92":n}`,
+	// Request the full status report.
+	`{"sr":""}`,
 }
 
 // New starts a new machine available over the provided connection.
 // Usually, it would be an opened serial connection.
+// If the connection is lost, the machine does not try to reconnect. Use Dial for that.
 func New(conn io.ReadWriter, jsonMode bool) Machine {
-	toCh := make(chan string)
-	m := &machine{conn: conn, jsonMode: jsonMode, ps: newPubSub(), toCh: toCh}
-	respCh := make(chan *tinyg.Response)
-	go m.scan(respCh)
+	once := false
+	return Dial(func() (io.ReadWriter, error) {
+		if once {
+			return nil, errNoRedial
+		}
+		once = true
+		return conn, nil
+	}, jsonMode)
+}
 
-	go m.send(toCh, respCh)
+// Dial starts a new machine, which connects with dial. If the connection is lost,
+// the machine reopens it with backoff and resumes the session. Since the position
+// is not reliable after that, the listeners are told to re-home the machine.
+func Dial(dial Dialer, jsonMode bool) Machine {
+	m := newMachine(dial, jsonMode, newPubSub())
+	go m.run()
+	return m
+}
 
+// newMachine returns a machine, which publishes the messages to ps. It's not started.
+func newMachine(dial Dialer, jsonMode bool, ps *pubsub) *machine {
+	m := &machine{
+		dial:     dial,
+		jsonMode: jsonMode,
+		ps:       ps,
+		toCh:     make(chan *request),
+		rtCh:     make(chan byte),
+		quit:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		state:    Disconnected,
+		st:       initialState(),
+	}
+	m.last = *m.st
 	return m
 }
 
+// initialState returns the state of a machine, which has not reported anything yet.
+func initialState() *State {
+	unknown := Coords{math.NaN(), math.NaN(), math.NaN()}
+	return &State{X: math.NaN(), Y: math.NaN(), Z: math.NaN(), Offset: unknown, Work: unknown, Units: tinyg.Millimeters, Coord: tinyg.G54}
+}
+
 // machine represents a connected CNC machine. It can receive commands and send messages.
 type machine struct {
-	conn     io.ReadWriter
+	dial     Dialer
 	jsonMode bool
 	ps       *pubsub
-	toCh     chan<- string
+	toCh     chan *request
+
+	// rtCh is the channel for real-time characters, which bypass toCh.
+	rtCh chan byte
+
+	// quit is closed, when the machine is closed, and stopped is closed,
+	// once the connection is closed after that.
+	quit      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+
+	mu    sync.Mutex
+	state ConnState
+	job   *Job
+	alarm *Alarm
+	env   *Envelope
+
+	// homing is true, if the homing interlock is enabled, and override is true, if it's overridden.
+	homing, override bool
+
+	// strictFirmware is true, if g-code is refused for the unsupported firmware.
+	strictFirmware bool
+
+	// st is the last known state of the machine. It's only accessed by the run goroutine.
+	st *State
+
+	// last is the last state published to the listeners.
+	last State
+
+	// jogging is the continuous jog in progress, if any.
+	jogging *jogging
+
+	// lim tracks the moves for the soft limits. It's only accessed by the run goroutine.
+	lim limits
+
+	// ident collects the identity of the machine, until it's checked. It's only accessed by the run goroutine.
+	ident *Identity
 }
 
 func (m *machine) Send(cmd string) {
-	m.toCh <- cmd
+	m.enqueue(&request{cmd: cmd})
+}
+
+// enqueue passes the request to the run goroutine. Once it has stopped, the request is dropped.
+func (m *machine) enqueue(req *request) {
+	select {
+	case m.toCh <- req:
+	case <-m.stopped:
+		m.drop(req)
+	}
+}
+
+// drop replies to the request, which is not sent, because the machine is disconnected.
+func (m *machine) drop(req *request) {
+	m.reply(req, nil, &Error{Kind: DroppedError, Msg: "machine is disconnected", Line: req.cmd})
+}
+
+// realtime passes a real-time character to the run goroutine. Once it has stopped, the character is dropped.
+func (m *machine) realtime(c byte) {
+	select {
+	case m.rtCh <- c:
+	case <-m.stopped:
+		m.fail(DroppedError, string(c), errors.New("machine is disconnected"))
+	}
+}
+
+func (m *machine) Do(ctx context.Context, cmd string) (*tinyg.Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	done := make(chan *result, 1)
+	select {
+	case m.toCh <- &request{cmd: cmd, done: done}:
+	case <-m.stopped:
+		return nil, &Error{Kind: DroppedError, Msg: "machine is disconnected", Line: cmd}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case res := <-done:
+		return res.resp, res.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (m *machine) State() *State {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	st := m.last
+	return &st
+}
+
+func (m *machine) Job() *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.job
+}
+
+// idle returns an error, if the machine is busy with a job, which the action would mess up.
+func (m *machine) idle(action string) error {
+	if job := m.Job(); job != nil {
+		if p := job.Progress(); p.State == JobRunning || p.State == JobPaused {
+			return fmt.Errorf("can't %s while the job %s is %s", action, p.Name, p.State)
+		}
+	}
+	return nil
 }
 
 func (m *machine) Sub() <-chan *Message {
 	return m.ps.Sub()
 }
 
-func (m *machine) scan(ch chan<- *tinyg.Response) {
-	scanner := bufio.NewScanner(m.conn)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if !m.jsonMode {
-			ch <- &tinyg.Response{Json: line}
-			continue
+func (m *machine) ConnState() ConnState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.state
+}
+
+// setConnState updates the connection state and notifies the listeners, if it has changed.
+func (m *machine) setConnState(st ConnState) {
+	m.mu.Lock()
+	changed := m.state != st
+	m.state = st
+	m.mu.Unlock()
+	if changed {
+		log.Printf("Machine connection state: %s", st)
+		m.ps.Pub(&Message{Conn: st})
+	}
+}
+
+// fail reports an error to the listeners.
+func (m *machine) fail(kind ErrorKind, line string, err error) {
+	e := &Error{Kind: kind, Msg: err.Error(), Line: line}
+	log.Print("Error: ", e)
+	m.ps.Pub(&Message{Error: e})
+}
+
+// close disconnects the machine for good and waits until the connection is closed.
+// The commands sent after that are dropped.
+func (m *machine) close() {
+	m.closeOnce.Do(func() { close(m.quit) })
+	<-m.stopped
+}
+
+// closed returns true, if the machine is closed.
+func (m *machine) closed() bool {
+	select {
+	case <-m.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// run (re)connects to the machine and serves the sessions until the dialer gives up or the machine is closed.
+// Once it stops, the commands are dropped by the senders.
+func (m *machine) run() {
+	defer close(m.stopped)
+	backoff := minBackoff
+	for sessions := 0; ; {
+		if m.closed() {
+			return
+		}
+		conn, err := m.dial()
+		if err == errNoRedial {
+			return
 		}
-		r, err := tinyg.ParseResponse(line)
 		if err != nil {
-			// TODO(krasin): handle invalid response without a crash.
-			// https://github.com/samofly/gentle/issues/1
-			log.Fatalf("Failed to parse TinyG response:\n%s\nerr: %v", line, err)
+			m.fail(DialError, "", err)
+			m.wait(backoff)
+			if backoff *= 2; backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+			continue
 		}
-		ch <- r
+		backoff = minBackoff
+		if sessions > 0 {
+			log.Print("Machine connection restored, the position must be re-homed")
+			m.st.Rehome = true
+		}
+		sessions++
+		m.session(conn)
+		m.setConnState(Disconnected)
+		m.wait(backoff)
 	}
-	if err := scanner.Err(); err != nil {
-		// TODO(krasin): handle connection lost case better.
-		// https://github.com/samofly/gentle/issues/1
-		log.Fatal("Failed to read from machine connection:", err)
+}
+
+// wait waits for d and drops all the commands sent in the meantime.
+// The wait ends early, if the machine is closed.
+func (m *machine) wait(d time.Duration) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	for {
+		select {
+		case req := <-m.toCh:
+			m.drop(req)
+		case c := <-m.rtCh:
+			m.fail(DroppedError, string(c), errors.New("machine is disconnected"))
+		case <-timer.C:
+			return
+		case <-m.quit:
+			return
+		}
 	}
-	close(ch)
-	log.Println("Machine connection closed")
 }
 
-func (m *machine) send(toCh <-chan string, respCh <-chan *tinyg.Response) {
-	st := &State{X: math.NaN(), Y: math.NaN(), Z: math.NaN()}
+// session talks to the machine over the established connection until it's lost.
+func (m *machine) session(conn io.ReadWriter) {
+	respCh := make(chan *tinyg.Response)
+	quit := make(chan struct{})
+	defer func() {
+		close(quit)
+		if c, ok := conn.(io.Closer); ok {
+			c.Close()
+		}
+		// Unblock the scanner, so that it could notice the end of the session.
+		go func() {
+			for range respCh {
+			}
+		}()
+	}()
+	go m.scan(conn, respCh, quit)
+	m.setConnState(Connected)
 
-	must := func(cmd string) {
+	write := func(cmd string) bool {
 		fmt.Println(cmd)
-		if _, err := fmt.Fprintln(m.conn, cmd); err != nil {
-			// TODO(krasin): don't crash if it's impossible to send a command to the machine
-			// https://github.com/samofly/gentle/issues/1
-			log.Fatal("Failed to write to the machine connection: ", err)
+		if _, err := fmt.Fprintln(conn, cmd); err != nil {
+			m.fail(WriteError, cmd, err)
+			return false
 		}
+		return true
 	}
 
-	proc := func(r *tinyg.Response) {
-		m.ps.Pub(&Message{Raw: fmt.Sprintf("%v", r)})
-		if r.Mpox != nil {
-			st.X = *r.Mpox
-		}
-		if r.Mpoy != nil {
-			st.Y = *r.Mpoy
-		}
-		if r.Mpoz != nil {
-			st.Z = *r.Mpoz
+	var pending []*request
+	// It may be another machine.
+	m.st.Identity, m.ident = nil, nil
+	if m.jsonMode {
+		for _, cmd := range append(identityCmds, initCmds...) {
+			pending = append(pending, &request{cmd: cmd, init: true})
 		}
-		tmp := *st
-		m.ps.Pub(&Message{State: &tmp})
 	}
-
+	fc := newFlow()
+	defer func() {
+		// The commands which are not acknowledged yet, are lost together with the connection.
+		for _, req := range append(fc.inFlight, pending...) {
+			if req.init {
+				// They are sent again, when the connection is restored.
+				continue
+			}
+			m.reply(req, nil, &Error{Kind: DroppedError, Msg: "connection lost", Line: req.cmd})
+		}
+	}()
+	rehome := m.st.Rehome
+	// The moves queued before the connection was lost are gone.
+	m.lim.reset()
+	// stalled is true, if the next command waits until the machine is idle, since its position is not known.
+	stalled := false
 	for {
-		select {
-		case cmd := <-toCh:
-			if cmd == "" {
+		if len(pending) > 0 && !stalled && (!m.jsonMode || fc.canSend(pending[0].cmd)) {
+			req := pending[0]
+			// The moves are checked right before they are sent, when the commands before them are tracked.
+			idle := len(fc.inFlight) == 0 && fc.planner == plannerSize && !moving(m.st.Status)
+			err := m.lim.check(m.envelope(), req.cmd, idle, m.st, req.job)
+			if err == errPositionUnknown && !idle {
+				// The position is taken from the status reports, once the machine stops.
+				stalled = true
+				continue
+			}
+			pending = pending[1:]
+			if err != nil {
+				kind := LimitError
+				if _, ok := err.(spindleOffError); ok {
+					kind = SpindleError
+				}
+				m.reply(req, nil, &Error{Kind: kind, Msg: err.Error(), Line: req.cmd})
 				continue
 			}
-			must(cmd)
+			if !write(req.cmd) {
+				pending = append(pending, req)
+				return
+			}
 			if !m.jsonMode {
+				// There are no acknowledgements in the text mode.
+				m.reply(req, nil, nil)
 				continue
 			}
-			// Waiting for TinyG to confirm it
-			for {
-				resp := <-respCh
-				if resp == nil {
-					// channel is closed
-					return
-				}
-				proc(resp)
-				if resp.Footer != nil {
-					break
-				}
+			fc.sent(req)
+			continue
+		}
+		if rehome && len(pending) == 0 {
+			// The session is initialized, let the listeners know that the position is lost.
+			rehome = false
+			m.pubState()
+		}
+		// Only accept new commands, when the previous one is sent.
+		var in <-chan *request
+		if len(pending) == 0 {
+			in = m.toCh
+		}
+		select {
+		case req := <-in:
+			if req.cmd == "" {
+				m.reply(req, nil, nil)
+				continue
+			}
+			if line, _ := gcodeLine(req.cmd); strings.ContainsAny(req.cmd+line, "\r\n") {
+				// The machine would run the next line, which is not checked against the limits and the interlock.
+				m.reply(req, nil, &Error{Kind: RejectedError, Msg: "the command must be a single line", Line: req.cmd})
+				continue
+			}
+			if a := m.alarmed(); a != nil && req.job {
+				m.reply(req, nil, &Error{Kind: AlarmError, Msg: a.Msg, Line: req.cmd})
+				continue
+			}
+			if err := m.unsupported(req.cmd); err != nil {
+				m.reply(req, nil, &Error{Kind: FirmwareError, Msg: err.Error(), Line: req.cmd})
+				continue
+			}
+			if err := m.interlock(req.cmd); err != nil {
+				m.reply(req, nil, &Error{Kind: HomingError, Msg: err.Error(), Line: req.cmd})
+				continue
+			}
+			pending = append(pending, req)
+		case <-m.quit:
+			return
+		case c := <-m.rtCh:
+			if c == queueFlush {
+				m.lim.reset()
+			}
+			if _, err := conn.Write([]byte{c}); err != nil {
+				m.fail(WriteError, string(c), err)
+				return
 			}
 		case resp := <-respCh:
 			if resp == nil {
 				// channel is closed
 				return
 			}
+			// The machine may be idle now.
+			stalled = false
 			if !m.jsonMode {
 				m.ps.Pub(&Message{Raw: fmt.Sprintf("%s", resp.Json)})
 				continue
 			}
-			proc(resp)
+			if err := resp.Verify(); err != nil {
+				m.fail(ParseError, resp.Json, err)
+				m.setConnState(Degraded)
+			} else {
+				m.proc(resp)
+			}
+			if req, ok := fc.update(resp); ok {
+				if req.init && req.cmd == spindleSRCmd && !resp.Footer.Status.OK() {
+					// The rest of the state is reported, the spindle and the coolant stay unknown.
+					log.Printf("The machine does not report the spindle and the coolant: %s", resp.Footer.Status.Message())
+					continue
+				}
+				if !resp.Footer.Status.OK() {
+					// The command was not executed, the tracked position can't be trusted.
+					m.lim.reset()
+				}
+				if req.init && req.cmd == idCmd {
+					m.identified()
+				}
+				m.ack(req, resp)
+			}
 		}
 	}
 }
 
-// State is the cnc machine state
-type State struct {
-	X float64 `json:"x"`
-	Y float64 `json:"y"`
-	Z float64 `json:"z"`
+// proc processes a response from the machine and notifies the listeners.
+func (m *machine) proc(r *tinyg.Response) {
+	m.setConnState(Connected)
+	m.ps.Pub(&Message{Raw: fmt.Sprintf("%v", r)})
+	if r.Er != nil {
+		m.raise(r.Er)
+		m.lim.reset()
+	}
+	m.st.update(r)
+	m.lim.update(r)
+	m.identify(r)
+	m.pubState()
+}
+
+// pubState notifies the listeners about the current state of the machine.
+func (m *machine) pubState() {
+	tmp := *m.st
+	m.mu.Lock()
+	tmp.Alarm = m.alarm
+	tmp.HomingOverride = m.homing && m.override
+	m.last = tmp
+	m.mu.Unlock()
+	m.ps.Pub(&Message{State: &tmp})
 }
 
-func (st *State) String() string {
-	return fmt.Sprintf("[X: %.3f, Y: %.3f, Z: %3f]", st.X, st.Y, st.Z)
+func (m *machine) scan(conn io.Reader, ch chan<- *tinyg.Response, quit <-chan struct{}) {
+	defer close(ch)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !m.jsonMode {
+			ch <- &tinyg.Response{Json: line}
+			continue
+		}
+		r, err := tinyg.ParseResponse(line)
+		if err != nil {
+			// A single garbled line (for example, after a noise on the serial line)
+			// is not a reason to give up on the machine.
+			m.fail(ParseError, line, err)
+			m.setConnState(Degraded)
+			if strings.Contains(line, `"f":[`) {
+				// Most likely, the line acknowledges a command. Pass it with a checksum,
+				// which never matches, so that the command is not waited for forever.
+				ch <- &tinyg.Response{Json: line, Footer: &tinyg.Footer{Checksum: -1}}
+			}
+			continue
+		}
+		ch <- r
+	}
+	select {
+	case <-quit:
+		// The session is over, and the connection was closed on purpose.
+		return
+	default:
+	}
+	if err := scanner.Err(); err != nil {
+		m.fail(ReadError, "", err)
+	}
+	log.Println("Machine connection closed")
 }
 
 type pubsub struct {
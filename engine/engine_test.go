@@ -0,0 +1,807 @@
+package engine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+	"github.com/samofly/gentle/tinyg/sim"
+)
+
+// fakeConn is a connection to a fake machine. Lines written to in are seen by the engine
+// as if they were sent by the machine. Commands sent by the engine are sent to out, if it's not nil.
+type fakeConn struct {
+	io.Reader
+	in  *io.PipeWriter
+	out chan string
+}
+
+func newFakeConn() *fakeConn {
+	r, w := io.Pipe()
+	return &fakeConn{Reader: r, in: w}
+}
+
+func (c *fakeConn) Write(p []byte) (int, error) {
+	if c.out != nil {
+		c.out <- string(p)
+	}
+	return len(p), nil
+}
+
+// oldConn is a machine, which does not know the spindle and the coolant fields of the status reports.
+type oldConn struct {
+	*sim.Device
+}
+
+func (c oldConn) Write(p []byte) (int, error) {
+	if _, err := c.Device.Write([]byte(strings.Replace(string(p), `"spe":t`, `"xyz":t`, 1))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// footer returns a response line acknowledging a command with the given status code.
+func footer(status int) string {
+	line := fmt.Sprintf(`{"r":{},"f":[1,%d,254`, status)
+	var h uint32
+	for i := 0; i < len(line); i++ {
+		h = 31*h + uint32(line[i])
+	}
+	return fmt.Sprintf("%s,%d]}", line, h%9999)
+}
+
+// newAckConn returns a fake machine in json mode, which acknowledges every command.
+// reject tells, which status code to return for a command.
+func newAckConn(reject func(cmd string) int) *fakeConn {
+	conn := newFakeConn()
+	// Like a real serial port, writing to the machine must not wait until it responds.
+	conn.out = make(chan string, 100)
+	go func() {
+		for cmd := range conn.out {
+			if !strings.HasSuffix(cmd, "\n") {
+				// Real-time characters are not acknowledged.
+				continue
+			}
+			status := 0
+			if reject != nil {
+				status = reject(strings.TrimSpace(cmd))
+			}
+			io.WriteString(conn.in, footer(status)+"\n")
+		}
+	}()
+	return conn
+}
+
+// follow subscribes to the machine messages. Unlike Sub, it never drops messages:
+// they are buffered until the test reads them.
+func follow(m Machine) <-chan *Message {
+	in := m.Sub()
+	out := make(chan *Message)
+	go func() {
+		var queue []*Message
+		for {
+			var next *Message
+			var outCh chan<- *Message
+			if len(queue) > 0 {
+				next, outCh = queue[0], out
+			}
+			select {
+			case msg := <-in:
+				queue = append(queue, msg)
+			case outCh <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+	return out
+}
+
+// waitFor reads messages from ch until ok returns true.
+func waitFor(t *testing.T, ch <-chan *Message, what string, ok func(*Message) bool) *Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-ch:
+			if ok(msg) {
+				return msg
+			}
+		case <-timeout:
+			t.Fatalf("Timeout while waiting for %s", what)
+		}
+	}
+}
+
+// newSim connects a new machine to a simulated device, which runs speed times faster than real time,
+// and follows the messages of the machine. ctx times out after 5 seconds. done closes the device and cancels ctx.
+func newSim(speed float64) (dev *sim.Device, m Machine, ch <-chan *Message, ctx context.Context, done func()) {
+	dev = sim.New()
+	dev.SetSpeed(speed)
+	m = New(dev, true)
+	ch = follow(m)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	return dev, m, ch, ctx, func() {
+		cancel()
+		dev.Close()
+	}
+}
+
+func TestConnState(t *testing.T) {
+	conn := newFakeConn()
+	m := New(conn, true)
+	ch := follow(m)
+	for i := 0; m.ConnState() != Connected; i++ {
+		if i > 100 {
+			t.Fatalf("ConnState() = %q, want: %q", m.ConnState(), Connected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	go io.WriteString(conn.in, "garbage\n")
+	msg := waitFor(t, ch, "parse error", func(msg *Message) bool { return msg.Error != nil })
+	if msg.Error.Kind != ParseError || msg.Error.Line != "garbage" {
+		t.Errorf("Unexpected error: %+v, want parse error for %q", msg.Error, "garbage")
+	}
+	waitFor(t, ch, "degraded state", func(msg *Message) bool { return msg.Conn == Degraded })
+
+	go io.WriteString(conn.in, `{"sr":{"mpox":1.000}}`+"\n")
+	waitFor(t, ch, "connected state", func(msg *Message) bool { return msg.Conn == Connected })
+
+	conn.in.CloseWithError(io.ErrUnexpectedEOF)
+	msg = waitFor(t, ch, "read error", func(msg *Message) bool { return msg.Error != nil })
+	if msg.Error.Kind != ReadError {
+		t.Errorf("Unexpected error: %+v, want read error", msg.Error)
+	}
+	waitFor(t, ch, "disconnected state", func(msg *Message) bool { return msg.Conn == Disconnected })
+	if st := m.ConnState(); st != Disconnected {
+		t.Errorf("ConnState() = %q, want: %q", st, Disconnected)
+	}
+
+	// The connection can't be reopened, so the commands must be dropped instead of blocking.
+	go m.Send("G0 X1")
+	msg = waitFor(t, ch, "dropped command", func(msg *Message) bool { return msg.Error != nil })
+	if msg.Error.Kind != DroppedError || msg.Error.Line != "G0 X1" {
+		t.Errorf("Unexpected error: %+v, want dropped command %q", msg.Error, "G0 X1")
+	}
+
+	// Closing the machine, which has given up, must not block.
+	closed := make(chan struct{})
+	go func() {
+		m.(*machine).close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close() of a disconnected machine has not returned")
+	}
+	go m.Hold()
+	msg = waitFor(t, ch, "dropped feedhold", func(msg *Message) bool { return msg.Error != nil })
+	if msg.Error.Kind != DroppedError || msg.Error.Line != "!" {
+		t.Errorf("Unexpected error: %+v, want dropped feedhold", msg.Error)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	conns := make(chan *fakeConn, 2)
+	m := Dial(func() (io.ReadWriter, error) {
+		conn := newFakeConn()
+		conns <- conn
+		return conn, nil
+	}, false)
+	ch := follow(m)
+
+	conn := <-conns
+	conn.in.Close()
+	waitFor(t, ch, "disconnected state", func(msg *Message) bool { return msg.Conn == Disconnected })
+
+	conn = <-conns
+	waitFor(t, ch, "connected state", func(msg *Message) bool { return msg.Conn == Connected })
+	msg := waitFor(t, ch, "rehome request", func(msg *Message) bool { return msg.State != nil })
+	if !msg.State.Rehome {
+		t.Errorf("State.Rehome is false after reconnect, want: true")
+	}
+
+	go io.WriteString(conn.in, "ok\n")
+	msg = waitFor(t, ch, "raw message", func(msg *Message) bool { return msg.Raw != "" })
+	if msg.Raw != "ok" {
+		t.Errorf("Unexpected raw message: %q, want: %q", msg.Raw, "ok")
+	}
+}
+
+func TestSwitch(t *testing.T) {
+	s := NewSwitch(true)
+	ch := follow(s)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := s.Do(ctx, `{"gc":"G0 X1"}`); err == nil || err.(*Error).Kind != DroppedError {
+		t.Errorf("Do without a machine: %v, want: dropped error", err)
+	}
+	// The settings are applied to the machines connected later.
+	s.SetEnvelope(&Envelope{Min: [3]float64{0, 0, -50}, Max: [3]float64{100, 100, 0}})
+
+	devs := make(chan *sim.Device, 2)
+	dial := func() (io.ReadWriter, error) {
+		dev := sim.New()
+		dev.SetSpeed(100)
+		devs <- dev
+		return dev, nil
+	}
+	s.Connect("sim1", dial)
+	first := <-devs
+	waitFor(t, ch, "connected state", func(msg *Message) bool { return msg.Conn == Connected })
+	if _, err := s.Do(ctx, `{"gc":"G0 X1"}`); err != nil {
+		t.Errorf("Do: %v", err)
+	}
+
+	s.Connect("sim2", dial)
+	second := <-devs
+	defer second.Close()
+	waitFor(t, ch, "disconnected state", func(msg *Message) bool { return msg.Conn == Disconnected })
+	waitFor(t, ch, "connected state", func(msg *Message) bool { return msg.Conn == Connected })
+	if dev := s.Device(); dev != "sim2" {
+		t.Errorf("Device() = %q, want: sim2", dev)
+	}
+	if _, err := s.Do(ctx, `{"gc":"G0 X200"}`); err == nil || err.(*Error).Kind != LimitError {
+		t.Errorf("Do out of the envelope: %v, want: limit error", err)
+	}
+	if _, err := first.Write([]byte("{\"sr\":n}\n")); err == nil {
+		t.Errorf("The first device is still open after switching to the second one")
+	}
+
+	s.Disconnect()
+	waitFor(t, ch, "disconnected state", func(msg *Message) bool { return msg.Conn == Disconnected })
+	if st := s.ConnState(); st != Disconnected || s.Device() != "" {
+		t.Errorf("After Disconnect: ConnState() = %q, Device() = %q, want: disconnected and no device", st, s.Device())
+	}
+	go s.Send("G0 X1")
+	msg := waitFor(t, ch, "dropped command", func(msg *Message) bool { return msg.Error != nil })
+	if msg.Error.Kind != DroppedError || msg.Error.Line != "G0 X1" {
+		t.Errorf("Unexpected error: %+v, want dropped command %q", msg.Error, "G0 X1")
+	}
+}
+
+func TestJob(t *testing.T) {
+	conn := newFakeConn()
+	conn.out = make(chan string, 10)
+	m := New(conn, false)
+	ch := follow(m)
+
+	job, err := m.Run("test.nc", strings.NewReader("G0 X1\n\nG0 X2\nG0 X3\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if _, err := m.Run("another.nc", strings.NewReader("G0 X1\n")); err != errJobRunning {
+		t.Errorf("Run while another job is running: %v, want: %v", err, errJobRunning)
+	}
+	for _, want := range []string{"G0 X1\n", "G0 X2\n", "G0 X3\n"} {
+		if got := <-conn.out; got != want {
+			t.Errorf("Unexpected command: %q, want: %q", got, want)
+		}
+	}
+	if err := job.Wait(); err != nil {
+		t.Errorf("job.Wait: %v", err)
+	}
+	msg := waitFor(t, ch, "job done", func(msg *Message) bool { return msg.Job != nil && msg.Job.State == JobDone })
+	if msg.Job.Line != 4 || msg.Job.Lines != 4 || msg.Job.Percent != 100 {
+		t.Errorf("Unexpected progress of the done job: %+v", msg.Job)
+	}
+
+	// Pause, resume and cancel are sent as real-time characters.
+	// The fake machine never acknowledges the init commands in json mode, so the job is stuck.
+	conn = newFakeConn()
+	conn.out = make(chan string, 10)
+	m = New(conn, true)
+	job, err = m.Run("test.nc", strings.NewReader("G0 X1\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	job.Pause()
+	job.Resume()
+	job.Cancel()
+	var got string
+	for !strings.HasSuffix(got, "!%") {
+		got += <-conn.out
+	}
+	if !strings.HasSuffix(got, "!~!%") {
+		t.Errorf("Unexpected commands: %q, want: feedhold, cycle start, feedhold and queue flush", got)
+	}
+	if st := job.Progress().State; st != JobCancelled {
+		t.Errorf("Job state: %q, want: %q", st, JobCancelled)
+	}
+}
+
+func TestRejectedLine(t *testing.T) {
+	conn := newAckConn(func(cmd string) int {
+		if strings.Contains(cmd, "X2") {
+			return 142
+		}
+		return 0
+	})
+	m := New(conn, true)
+	ch := follow(m)
+
+	m.Send("G0 X2")
+	// The fake machine does not tell its identity, so the firmware error comes first.
+	msg := waitFor(t, ch, "status error", func(msg *Message) bool { return msg.Error != nil && msg.Error.Kind != FirmwareError })
+	if msg.Error.Kind != StatusError || msg.Error.Status != tinyg.StatGcodeFeedrateNotSpecified || msg.Error.Line != "G0 X2" {
+		t.Errorf("Unexpected error: %+v, want status error 142 for %q", msg.Error, "G0 X2")
+	}
+
+	job, err := m.Run("test.nc", strings.NewReader("G0 X1\nG0 X2\nG0 X3\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := job.Wait(); err == nil || !strings.HasPrefix(err.Error(), "line 2: status error") {
+		t.Errorf("job.Wait: %v, want: line 2: status error", err)
+	}
+	if p := job.Progress(); p.State != JobFailed || p.Line != 1 {
+		t.Errorf("Unexpected progress of the failed job: %+v", p)
+	}
+}
+
+func TestAlarm(t *testing.T) {
+	// The first clear is refused.
+	refuse := make(chan bool, 1)
+	refuse <- true
+	conn := newAckConn(func(cmd string) int {
+		if cmd != clearCmd {
+			return 0
+		}
+		select {
+		case <-refuse:
+			return int(tinyg.StatCommandNotAccepted)
+		default:
+			return 0
+		}
+	})
+	m := New(conn, true)
+	ch := follow(m)
+
+	go io.WriteString(conn.in, `{"er":{"fb":440.20,"st":204,"msg":"Limit switch hit - Shutdown occurred"}}`+"\n")
+	msg := waitFor(t, ch, "alarm", func(msg *Message) bool { return msg.Alarm != nil })
+	if !msg.Alarm.Active || msg.Alarm.Status != tinyg.StatLimitSwitchHit {
+		t.Errorf("Unexpected alarm: %+v", msg.Alarm)
+	}
+
+	job, err := m.Run("test.nc", strings.NewReader("G0 X1\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := job.Wait(); err == nil || !strings.HasPrefix(err.Error(), "line 1: alarm error") {
+		t.Errorf("job.Wait: %v, want: line 1: alarm error", err)
+	}
+
+	if err := m.ClearAlarm(); err == nil {
+		t.Errorf("ClearAlarm refused by the machine: nil error, want: status error")
+	}
+	if m.(*machine).alarmed() == nil {
+		t.Errorf("The alarm is cleared, although the machine has refused the clear")
+	}
+	if err := m.ClearAlarm(); err != nil {
+		t.Errorf("ClearAlarm: %v", err)
+	}
+	waitFor(t, ch, "cleared alarm", func(msg *Message) bool { return msg.Alarm != nil && !msg.Alarm.Active })
+	job, err = m.Run("test.nc", strings.NewReader("G0 X1\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := job.Wait(); err != nil {
+		t.Errorf("job.Wait after the alarm is cleared: %v", err)
+	}
+}
+
+func TestDo(t *testing.T) {
+	conn := newAckConn(func(cmd string) int {
+		if strings.Contains(cmd, "X2") {
+			return 142
+		}
+		return 0
+	})
+	m := New(conn, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := m.Do(ctx, `{"gc":"G0 X1"}`)
+	if err != nil {
+		t.Fatalf("Do: %v", err)
+	}
+	if resp.Footer == nil || resp.Footer.Status != tinyg.StatOK {
+		t.Errorf("Do: unexpected response: %v, want: a footer with status OK", resp)
+	}
+
+	resp, err = m.Do(ctx, `{"gc":"G0 X2"}`)
+	if e, ok := err.(*Error); !ok || e.Kind != StatusError || e.Status != tinyg.StatGcodeFeedrateNotSpecified {
+		t.Errorf("Do: %v, want: status error 142", err)
+	}
+	if resp == nil || resp.Footer == nil {
+		t.Errorf("Do: unexpected response: %v, want: a response with a footer", resp)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := m.Do(cancelled, `{"gc":"G0 X1"}`); err != context.Canceled {
+		t.Errorf("Do with a cancelled context: %v, want: %v", err, context.Canceled)
+	}
+}
+
+func TestSim(t *testing.T) {
+	dev, m, ch, ctx, done := newSim(100)
+	defer done()
+
+	// More moves than the planner can take.
+	var prog bytes.Buffer
+	for i := 1; i <= 2*plannerSize; i++ {
+		fmt.Fprintf(&prog, "G1 X%d Y%d F6000\n", i, i%3)
+	}
+	fmt.Fprintln(&prog, "G0 X5 Y7")
+	job, err := m.Run("sim", &prog)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := job.Wait(); err != nil {
+		t.Fatalf("Job failed: %v", err)
+	}
+	waitFor(t, ch, "the final position", func(msg *Message) bool {
+		return msg.State != nil && msg.State.X == 5 && msg.State.Y == 7 && msg.State.Status == tinyg.StateReady
+	})
+	if n := dev.Overflows(); n > 0 {
+		t.Errorf("%d bytes lost in the RX buffer", n)
+	}
+
+	dev.InjectError(tinyg.StatGcodeFeedrateNotSpecified)
+	if _, err := m.Do(ctx, `{"gc":"G1 X1"}`); err == nil {
+		t.Errorf("Do with an injected error: nil error, want: status 142")
+	}
+}
+
+func TestSoftLimits(t *testing.T) {
+	_, m, _, ctx, done := newSim(100)
+	defer done()
+	m.SetEnvelope(&Envelope{Min: [3]float64{0, 0, -50}, Max: [3]float64{100, 100, 0}})
+
+	tests := []struct {
+		gc  string
+		err string
+	}{
+		{gc: "G0 X10 Y10"},
+		{gc: "G91 G0 X95", err: "X would go to 105.000, above the soft limit 100.000"},
+		{gc: "G92 X0 Y0"},
+		{gc: "G0 X-15", err: "X would go to -5.000, below the soft limit 0.000"},
+		{gc: "G0 X-5"},
+		{gc: "G92.1"},
+		{gc: "G2 X5 Y22 J6 F1000", err: "X would go to -1.000, below the soft limit 0.000"},
+		{gc: "G3 X5 Y22 J6 F1000"},
+		{gc: "G2 I-50 J0", err: "X would go to -95.000, below the soft limit 0.000"},
+		{gc: "G20 G0 Z0.1", err: "Z would go to 2.540, above the soft limit 0.000"},
+	}
+	for _, tt := range tests {
+		cmd := gcodeCmd(tt.gc, true)
+		_, err := m.Do(ctx, cmd)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.gc, err)
+			}
+			continue
+		}
+		if e, ok := err.(*Error); !ok || e.Kind != LimitError || e.Msg != tt.err || e.Line != cmd {
+			t.Errorf("%s: %v, want: limit error: %s", tt.gc, err, tt.err)
+		}
+	}
+	// The machine would run the hidden line unchecked.
+	for _, cmd := range []string{"G0 X1 ;\nG0 X500", gcodeCmd("G0 X1 (\nG0 X500\n)", true)} {
+		if _, err := m.Do(ctx, cmd); err == nil || err.(*Error).Kind != RejectedError {
+			t.Errorf("%q: %v, want: rejected error", cmd, err)
+		}
+	}
+
+	job, err := m.Run("test.nc", strings.NewReader("G0 X20\nG0 Z-60\nG0 X30\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := job.Wait(); err == nil || !strings.HasPrefix(err.Error(), "line 2: limit error") {
+		t.Errorf("job.Wait: %v, want: line 2: limit error", err)
+	}
+}
+
+func TestSoftLimitsUnknownPosition(t *testing.T) {
+	// Slow enough for the machine to be moving, when the position gets unknown.
+	_, m, _, ctx, done := newSim(10)
+	defer done()
+	m.SetEnvelope(&Envelope{Min: [3]float64{0, 0, -50}, Max: [3]float64{100, 100, 0}})
+
+	if _, err := m.Do(ctx, gcodeCmd("G1 X50 F600", true)); err != nil {
+		t.Fatalf("G1 X50: %v", err)
+	}
+	// A command refused by the machine makes the position unknown. The move after it waits,
+	// until the machine stops and reports the position, instead of being refused.
+	if _, err := m.Do(ctx, gcodeCmd("G28.1", true)); err == nil {
+		t.Fatalf("G28.1: nil error, want: refused by the machine")
+	}
+	if _, err := m.Do(ctx, gcodeCmd("G0 X10", true)); err != nil {
+		t.Errorf("G0 X10 after a refused command: %v", err)
+	}
+}
+
+func TestHoming(t *testing.T) {
+	_, m, ch, ctx, done := newSim(100)
+	defer done()
+	m.RequireHoming(true)
+
+	do := func(gc string, want string) {
+		_, err := m.Do(ctx, gcodeCmd(gc, true))
+		if want == "" {
+			if err != nil {
+				t.Errorf("%s: %v", gc, err)
+			}
+			return
+		}
+		if e, ok := err.(*Error); !ok || e.Kind != HomingError || e.Msg != want {
+			t.Errorf("%s: %v, want: homing error: %s", gc, err, want)
+		}
+	}
+	do("G0 X1 Y1", "X, Y are not homed")
+	do("G2 I-50 J0 F100", "X, Y, Z are not homed")
+	do("G92 X0", "")
+
+	job, err := m.Run("test.nc", strings.NewReader("G0 Z-1\n"))
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := job.Wait(); err == nil || !strings.HasPrefix(err.Error(), "line 1: homing error") {
+		t.Errorf("job.Wait: %v, want: line 1: homing error", err)
+	}
+
+	if err := m.Home("xz"); err == nil {
+		t.Errorf("Home(xz) succeeded, want: error")
+	}
+	if err := m.Home("xy"); err != nil {
+		t.Fatalf("Home(xy): %v", err)
+	}
+	waitFor(t, ch, "X and Y homed", func(msg *Message) bool {
+		return msg.State != nil && msg.State.Homed.X && msg.State.Homed.Y && msg.State.Status == tinyg.StateReady
+	})
+	do("G0 X1 Y1", "")
+	do("G0 X2 Z-1", "Z is not homed")
+
+	m.OverrideHoming(true)
+	do("G0 X2 Z-1", "")
+}
+
+func TestIdentity(t *testing.T) {
+	_, m, ch, ctx, done := newSim(1)
+	defer done()
+	msg := waitFor(t, ch, "identity", func(msg *Message) bool {
+		return msg.State != nil && msg.State.Identity != nil && msg.State.Identity.ID != ""
+	})
+	if id := msg.State.Identity; id.Build != 440.20 || id.Platform != 1 || id.ID != "3X3566-YMX" || !id.Supported {
+		t.Errorf("Unexpected identity: %+v", id)
+	}
+
+	old := sim.New()
+	defer old.Close()
+	old.SetFirmware(380.08, 0.95)
+	m = New(old, true)
+	m.RequireSupportedFirmware(true)
+	ch = follow(m)
+	msg = waitFor(t, ch, "firmware error", func(msg *Message) bool { return msg.Error != nil })
+	if msg.Error.Kind != FirmwareError || !strings.Contains(msg.Error.Msg, "380.08") {
+		t.Errorf("Unexpected error: %+v, want: unsupported firmware build 380.08", msg.Error)
+	}
+	if _, err := m.Do(ctx, `{"gc":"G0 X1"}`); err == nil || !strings.HasPrefix(err.Error(), "firmware error") {
+		t.Errorf("Do(G0 X1) with unsupported firmware: %v, want: firmware error", err)
+	}
+	if _, err := m.Do(ctx, `{"xvm":n}`); err != nil {
+		t.Errorf("Do(query) with unsupported firmware: %v", err)
+	}
+
+	// The identity is checked, even if the machine refuses the queries.
+	dumb := sim.New()
+	defer dumb.Close()
+	for range identityCmds {
+		dumb.InjectError(tinyg.StatUnrecognizedName)
+	}
+	m = New(dumb, true)
+	m.RequireSupportedFirmware(true)
+	ch = follow(m)
+	waitFor(t, ch, "firmware error", func(msg *Message) bool { return msg.Error != nil && msg.Error.Kind == FirmwareError })
+	if _, err := m.Do(ctx, `{"gc":"G0 X1"}`); err == nil || !strings.Contains(err.Error(), "unsupported firmware") {
+		t.Errorf("Do(G0 X1) with unidentified firmware: %v, want: unsupported firmware", err)
+	}
+}
+
+func TestJog(t *testing.T) {
+	_, m, ch, ctx, done := newSim(1)
+	defer done()
+	m.SetEnvelope(&Envelope{Min: [3]float64{-50, -50, -50}, Max: [3]float64{50, 50, 0}})
+	stopped := func(what string, x float64) *State {
+		msg := waitFor(t, ch, what, func(msg *Message) bool {
+			return msg.State != nil && msg.State.Status != tinyg.StateRun && msg.State.X != x && !math.IsNaN(msg.State.X)
+		})
+		return msg.State
+	}
+
+	if err := m.Jog("x", 1, 6000); err != nil {
+		t.Fatalf("Jog: %v", err)
+	}
+	waitFor(t, ch, "X at 1", func(msg *Message) bool { return msg.State != nil && msg.State.X == 1 })
+	if err := m.Jog("x", 0.5, 0); err == nil {
+		t.Errorf("Jog by 0.5: nil error, want: invalid step")
+	}
+	if err := m.Jog("a", 1, 0); err == nil {
+		t.Errorf("Jog of A: nil error, want: invalid axis")
+	}
+
+	// The continuous jog stops on JogStop.
+	if err := m.JogStart("x", -1, 600); err != nil {
+		t.Fatalf("JogStart: %v", err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	m.JogStop()
+	st := stopped("jog stopped", 1)
+	if st.X >= 1 || st.X <= -50 {
+		t.Errorf("X = %g after the jog, want: from -50 to 1", st.X)
+	}
+	// The restoring line is flushed with the jog, and it's sent again.
+	for i := 0; m.State().Distance != tinyg.Absolute; i++ {
+		if i > 100 {
+			t.Fatalf("Distance mode after the jog: %v, want: G90", m.State().Distance)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The jog stops by itself, if it's not renewed.
+	x := st.X
+	start := time.Now()
+	if err := m.JogStart("x", 1, 600); err != nil {
+		t.Fatalf("JogStart: %v", err)
+	}
+	st = stopped("jog timed out", x)
+	if d := time.Since(start); d < JogTimeout/2 || st.X >= 50 {
+		t.Errorf("The jog stopped after %v at X = %g, want: after about %v, before the soft limit", d, st.X, JogTimeout)
+	}
+
+	// The jog restores the motion mode and the feed rate, in the units of the machine.
+	for _, gc := range []string{"G20", "G0 F10"} {
+		if _, err := m.Do(ctx, gcodeCmd(gc, true)); err != nil {
+			t.Fatalf("%s: %v", gc, err)
+		}
+	}
+	// The jog takes the modal state from the status report.
+	if _, err := m.Do(ctx, `{"sr":""}`); err != nil {
+		t.Fatalf("Status report: %v", err)
+	}
+	if err := m.Jog("x", -1, 0); err != nil {
+		t.Fatalf("Jog: %v", err)
+	}
+	if st := m.State(); st.Units != tinyg.Inches || st.Motion != tinyg.StraightTraverse || st.Feed != 10 {
+		t.Errorf("Modal state after the jog: %v %v F%g, want: G20 G0 F10", st.Units, st.Motion, st.Feed)
+	}
+}
+
+func TestOffsets(t *testing.T) {
+	_, m, ch, ctx, done := newSim(100)
+	defer done()
+	m.SetEnvelope(&Envelope{Min: [3]float64{0, 0, -50}, Max: [3]float64{100, 100, 0}})
+	if _, err := m.Do(ctx, gcodeCmd("G0 X10 Y20 Z-5", true)); err != nil {
+		t.Fatalf("G0: %v", err)
+	}
+	waitFor(t, ch, "X at 10", func(msg *Message) bool {
+		return msg.State != nil && msg.State.X == 10 && msg.State.Status != tinyg.StateRun
+	})
+
+	tests := []struct {
+		offset, axes string
+		v            float64
+		reset        bool
+		work, ofs    Coords
+	}{
+		{offset: "g54", axes: "xy", work: Coords{0, 0, -5}, ofs: Coords{10, 20, 0}},
+		{offset: "G92", axes: "Z", v: 1, work: Coords{0, 0, 1}, ofs: Coords{10, 20, -6}},
+		{offset: "G55", axes: "xyz", v: 2, work: Coords{0, 0, 1}, ofs: Coords{10, 20, -6}},
+		{offset: "G92", reset: true, work: Coords{0, 0, -5}, ofs: Coords{10, 20, 0}},
+		{offset: "G54", reset: true, work: Coords{10, 20, -5}, ofs: Coords{0, 0, 0}},
+	}
+	for _, tt := range tests {
+		var err error
+		if tt.reset {
+			err = m.ResetOffset(tt.offset)
+		} else {
+			err = m.SetOffset(tt.offset, tt.axes, tt.v)
+		}
+		if err != nil {
+			t.Errorf("%s %s %g: %v", tt.offset, tt.axes, tt.v, err)
+			continue
+		}
+		// The status is queried, once the offset is set, so the state is up to date.
+		if st := m.State(); st.Work != tt.work || st.Offset != tt.ofs {
+			t.Errorf("%s %s %g: work %+v, offset %+v, want: %+v, %+v", tt.offset, tt.axes, tt.v, st.Work, st.Offset, tt.work, tt.ofs)
+		}
+	}
+
+	// The soft limits follow the offsets of the coordinate systems.
+	if err := m.SetOffset("G54", "x", 0); err != nil {
+		t.Fatalf("SetOffset: %v", err)
+	}
+	if _, err := m.Do(ctx, gcodeCmd("G0 X95", true)); err == nil {
+		t.Errorf("G0 X95 with X offset 10: nil error, want: limit error")
+	}
+	if err := m.SetOffset("G53", "x", 0); err == nil {
+		t.Errorf("SetOffset(G53): nil error, want: invalid offset")
+	}
+	if err := m.SetOffset("G92", "a", 0); err == nil {
+		t.Errorf("SetOffset(A): nil error, want: invalid axes")
+	}
+}
+
+func TestSpindle(t *testing.T) {
+	_, m, ch, _, done := newSim(100)
+	defer done()
+
+	if err := m.SetSpindle(Spindle{On: true, CCW: true, Speed: 12000}); err != nil {
+		t.Fatalf("SetSpindle: %v", err)
+	}
+	waitFor(t, ch, "spindle on", func(msg *Message) bool {
+		return msg.State != nil && msg.State.Spindle != nil && *msg.State.Spindle == Spindle{On: true, CCW: true, Speed: 12000}
+	})
+	if err := m.SetSpindle(Spindle{On: true}); err == nil {
+		t.Errorf("SetSpindle without speed: nil error, want: invalid speed")
+	}
+	if err := m.SetCoolant(Coolant{Flood: true}); err != nil {
+		t.Fatalf("SetCoolant: %v", err)
+	}
+	waitFor(t, ch, "flood coolant", func(msg *Message) bool {
+		return msg.State != nil && msg.State.Coolant != nil && *msg.State.Coolant == Coolant{Flood: true}
+	})
+	if err := m.SetSpindle(Spindle{}); err != nil {
+		t.Fatalf("SetSpindle(off): %v", err)
+	}
+	waitFor(t, ch, "spindle off", func(msg *Message) bool {
+		return msg.State != nil && msg.State.Spindle != nil && !msg.State.Spindle.On
+	})
+
+	// A cut below the work zero is refused, while the spindle is off.
+	tests := []struct {
+		prog string
+		err  string
+	}{
+		{prog: "G1 X1 F300\nG0 Z-1\nG0 Z0\n"},
+		{prog: "G0 X1\nG1 Z-1 F300\n", err: "line 2: spindle error: the cut goes to Z -1.000 below the work zero, while the spindle is off"},
+		{prog: "G92 Z2\nG2 X2 Z-1 I1 F300\n", err: "line 2: spindle error"},
+		{prog: "G0 X10\nG0 Z-1\nG2 I-5 F300\n", err: "line 3: spindle error"},
+		{prog: "G92 Z5\nG1 Z1 F300\n"},
+		{prog: "M3 S1000\nG1 Z-1 F300\nM5\nG1 Z-2\n", err: "line 4: spindle error"},
+	}
+	for _, tt := range tests {
+		_, m, ch, _, done := newSim(100)
+		waitFor(t, ch, "spindle state", func(msg *Message) bool { return msg.State != nil && msg.State.Spindle != nil })
+		job, err := m.Run("test.nc", strings.NewReader(tt.prog))
+		if err != nil {
+			done()
+			t.Fatalf("Run: %v", err)
+		}
+		err = job.Wait()
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%q: %v, want: %q", tt.prog, err, tt.err)
+		}
+		done()
+	}
+
+	// If the machine refuses to report the spindle, the rest of the state is still reported.
+	dev := sim.New()
+	defer dev.Close()
+	m = New(oldConn{dev}, true)
+	ch = follow(m)
+	m.Send("G0 X5")
+	msg := waitFor(t, ch, "X at 5", func(msg *Message) bool { return msg.Error != nil || msg.State != nil && msg.State.X == 5 })
+	if msg.Error != nil {
+		t.Errorf("Unexpected error: %+v", msg.Error)
+	} else if msg.State.Spindle != nil {
+		t.Errorf("Spindle: %+v, want: nil", msg.State.Spindle)
+	}
+}
@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"strings"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+const (
+	// plannerSize is the number of buffers in the TinyG planner queue.
+	plannerSize = 28
+
+	// plannerReserve is the number of planner buffers which are kept free.
+	// TinyG needs some room for the commands which are not moves, but still take a planner buffer.
+	plannerReserve = 4
+
+	// rxSize is the size of the TinyG serial RX buffer.
+	rxSize = 254
+)
+
+// flow keeps several commands in flight without overflowing the TinyG buffers.
+//
+// Two limits are tracked. First, the total length of the commands sent, but not yet
+// acknowledged with a footer, must fit into the serial RX buffer. Second, the moves must
+// not take more planner buffers than available according to the latest queue report.
+//
+// Commands which are not g-code (config and queries) are synchronous: they are only sent
+// when nothing else is in flight, and nothing is sent until they are acknowledged.
+type flow struct {
+	// inFlight is the list of commands sent, but not acknowledged yet. Oldest first.
+	inFlight []*request
+
+	// rxUsed is the number of bytes taken by inFlight commands in the RX buffer.
+	rxUsed int
+
+	// planner is the number of available planner buffers, as reported by TinyG.
+	planner int
+
+	// sync is true, if a synchronous command is in flight.
+	sync bool
+}
+
+func newFlow() *flow {
+	return &flow{planner: plannerSize}
+}
+
+// isGcode returns true, if the command is a g-code line, either raw or wrapped into json.
+func isGcode(cmd string) bool {
+	return !strings.HasPrefix(cmd, "{") || strings.HasPrefix(cmd, `{"gc"`)
+}
+
+// canSend returns true, if the command can be sent to the machine right now.
+func (f *flow) canSend(cmd string) bool {
+	if f.sync {
+		return false
+	}
+	if !isGcode(cmd) {
+		return len(f.inFlight) == 0
+	}
+	if len(f.inFlight) == 0 {
+		// Always make progress, even if the command is too long.
+		return true
+	}
+	if f.rxUsed+len(cmd)+1 > rxSize {
+		return false
+	}
+	// The commands in flight are not planned yet, but they will take their buffers.
+	return f.planner-len(f.inFlight) > plannerReserve
+}
+
+// sent registers the command as sent to the machine.
+func (f *flow) sent(req *request) {
+	f.inFlight = append(f.inFlight, req)
+	f.rxUsed += len(req.cmd) + 1
+	if !isGcode(req.cmd) {
+		f.sync = true
+	}
+}
+
+// update takes a response from the machine into account.
+// If the response acknowledges a command, the request is returned.
+func (f *flow) update(r *tinyg.Response) (req *request, acked bool) {
+	if r.QR != nil {
+		f.planner = *r.QR
+	}
+	if r.Footer == nil || len(f.inFlight) == 0 {
+		return nil, false
+	}
+	req = f.inFlight[0]
+	f.inFlight = f.inFlight[1:]
+	f.rxUsed -= len(req.cmd) + 1
+	f.sync = false
+	return req, true
+}
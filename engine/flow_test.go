@@ -0,0 +1,63 @@
+package engine
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+func intp(v int) *int { return &v }
+
+func TestFlow(t *testing.T) {
+	footer := &tinyg.Response{Footer: &tinyg.Footer{Revision: 1, RxAvail: 10, Checksum: 1234}}
+	move := "G1X1"
+
+	fc := newFlow()
+	for i := 0; i < plannerSize-plannerReserve; i++ {
+		if !fc.canSend(move) {
+			t.Fatalf("canSend(%s) = false after %d moves, want: true", move, i)
+		}
+		fc.sent(&request{cmd: move})
+	}
+	if fc.canSend(move) {
+		t.Errorf("canSend(%s) = true with %d moves in flight, want: false", move, len(fc.inFlight))
+	}
+
+	// Everything is planned, and the planner is full.
+	for len(fc.inFlight) > 0 {
+		fc.update(footer)
+	}
+	fc.update(&tinyg.Response{QR: intp(plannerReserve)})
+	if !fc.canSend(move) {
+		t.Errorf("canSend(%s) = false with nothing in flight, want: true", move)
+	}
+	fc.sent(&request{cmd: move})
+	if fc.canSend(move) {
+		t.Errorf("canSend(%s) = true with a full planner, want: false", move)
+	}
+	fc.update(&tinyg.Response{QR: intp(plannerSize)})
+	if !fc.canSend(move) {
+		t.Errorf("canSend(%s) = false with an empty planner, want: true", move)
+	}
+
+	// Config commands wait for the moves in flight and block everything else.
+	if fc.canSend(`{"sr":""}`) {
+		t.Errorf(`canSend({"sr":""}) = true with a move in flight, want: false`)
+	}
+	if req, ok := fc.update(footer); !ok || req.cmd != move {
+		t.Errorf("update(footer) = %+v, %v, want: %q, true", req, ok, move)
+	}
+	fc.sent(&request{cmd: `{"sr":""}`})
+	if fc.canSend(move) {
+		t.Errorf("canSend(%s) = true with a config command in flight, want: false", move)
+	}
+	fc.update(footer)
+
+	// Long lines must fit into the RX buffer.
+	long := `{"gc":"G1 X` + strings.Repeat("1", rxSize/2) + `"}`
+	fc.sent(&request{cmd: long})
+	if fc.canSend(long) {
+		t.Errorf("canSend(long) = true with %d bytes in flight, want: false", fc.rxUsed)
+	}
+}
@@ -0,0 +1,86 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/samofly/gentle/gcode"
+)
+
+// homeAxes are the sets of axes which can be homed together.
+var homeAxes = map[string]bool{"X": true, "Y": true, "Z": true, "XY": true, "XYZ": true}
+
+func (m *machine) Home(axes string) error {
+	axes = strings.ToUpper(axes)
+	if !homeAxes[axes] {
+		return fmt.Errorf("can't home %q, want X, Y, Z, XY or XYZ", axes)
+	}
+	var words []string
+	for _, a := range axes {
+		words = append(words, string(a)+"0")
+	}
+	m.Send(gcodeCmd("G28.2 "+strings.Join(words, " "), m.jsonMode))
+	return nil
+}
+
+func (m *machine) RequireHoming(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.homing = on
+}
+
+func (m *machine) OverrideHoming(on bool) {
+	m.mu.Lock()
+	changed := m.override != on
+	m.override = on
+	m.mu.Unlock()
+	if !changed {
+		return
+	}
+	if on {
+		log.Print("Homing interlock overridden by the operator: motion is allowed without homing")
+	} else {
+		log.Print("Homing interlock override is cancelled")
+	}
+}
+
+// interlock returns an error, if the command moves an axis, which is not homed,
+// and the homing interlock is enabled. It's only called by the run goroutine.
+func (m *machine) interlock(cmd string) error {
+	m.mu.Lock()
+	on := m.homing && !m.override
+	m.mu.Unlock()
+	if !on {
+		return nil
+	}
+	line, ok := gcodeLine(cmd)
+	if !ok {
+		return nil
+	}
+	b, err := gcode.Parse(line)
+	if err != nil || !b.Moves() {
+		// The machine will reject the line, if it's garbage.
+		return nil
+	}
+	if m.st.Rehome {
+		return errors.New("the connection was lost, the machine must be re-homed")
+	}
+	homed := map[byte]bool{'X': m.st.Homed.X, 'Y': m.st.Homed.Y, 'Z': m.st.Homed.Z}
+	// An arc moves both axes of its plane, even without their words, and the plane is not tracked.
+	arc := b.Has('I') || b.Has('J') || b.Has('K') || b.Has('R')
+	var axes []string
+	for _, a := range []byte("XYZ") {
+		if (arc || b.Has(a)) && !homed[a] {
+			axes = append(axes, string(a))
+		}
+	}
+	switch len(axes) {
+	case 0:
+		return nil
+	case 1:
+		return fmt.Errorf("%s is not homed", axes[0])
+	}
+	return fmt.Errorf("%s are not homed", strings.Join(axes, ", "))
+}
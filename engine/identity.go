@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// Identity tells which machine is connected: its firmware and hardware.
+type Identity struct {
+	// Build is the firmware build number (fb), such as 440.20.
+	Build float64 `json:"build"`
+
+	// Version is the firmware version (fv), such as 0.97.
+	Version float64 `json:"version"`
+
+	// Platform is the hardware platform (hp). 1 is TinyG.
+	Platform float64 `json:"platform"`
+
+	// Hardware is the hardware version (hv), such as 8 for TinyG v8.
+	Hardware float64 `json:"hardware"`
+
+	// ID is the unique board identifier (id).
+	ID string `json:"id"`
+
+	// Supported is true, if the firmware is known to work with the engine.
+	Supported bool `json:"supported"`
+}
+
+// firmware is a range of firmware builds for a hardware platform.
+type firmware struct {
+	platform           float64
+	minBuild, maxBuild float64
+	name               string
+}
+
+// supportedFirmware are the firmware builds the engine is tested with. The json protocol,
+// the status codes and the status report fields are different in the other builds.
+var supportedFirmware = []firmware{
+	{platform: 1, minBuild: 440.18, maxBuild: 440.99, name: "TinyG 0.97 (builds 440.18 and later)"},
+}
+
+// idCmd queries the board identifier. It's the last of identityCmds.
+const idCmd = `{"id":n}`
+
+// identityCmds query the identity of the machine. They are sent first on connect.
+var identityCmds = []string{`{"fb":n}`, `{"fv":n}`, `{"hp":n}`, `{"hv":n}`, idCmd}
+
+// supported returns true, if the firmware of the machine is in the supportedFirmware table.
+func (id *Identity) supported() bool {
+	for _, f := range supportedFirmware {
+		if id.Platform == f.platform && id.Build >= f.minBuild && id.Build <= f.maxBuild {
+			return true
+		}
+	}
+	return false
+}
+
+// identify takes the identity values from the response to a query.
+// It's only called by the run goroutine.
+func (m *machine) identify(r *tinyg.Response) {
+	if len(r.Body) == 0 {
+		return
+	}
+	var body struct {
+		Fb, Fv, Hp, Hv *float64
+		ID             *string
+	}
+	if json.Unmarshal(r.Body, &body) != nil {
+		return
+	}
+	if body.Fb == nil && body.Fv == nil && body.Hp == nil && body.Hv == nil && body.ID == nil {
+		return
+	}
+	if m.ident == nil {
+		m.ident = new(Identity)
+	}
+	id := m.ident
+	for _, v := range []struct {
+		dst *float64
+		src *float64
+	}{{&id.Build, body.Fb}, {&id.Version, body.Fv}, {&id.Platform, body.Hp}, {&id.Hardware, body.Hv}} {
+		if v.src != nil {
+			*v.dst = *v.src
+		}
+	}
+	if body.ID != nil {
+		id.ID = *body.ID
+	}
+}
+
+// identified checks the collected identity against the supported firmware and publishes it.
+// It's called, once the id, which is queried last, is acknowledged, whatever the status:
+// the builds, which don't know some of the values, refuse them. It's only called by the run goroutine.
+func (m *machine) identified() {
+	id := m.ident
+	if id == nil {
+		id = new(Identity)
+	}
+	m.ident = nil
+	id.Supported = id.supported()
+	m.st.Identity = id
+	m.pubState()
+	if id.Supported {
+		log.Printf("Machine %s: firmware build %.2f, version %.3f, hardware platform %g, version %g",
+			id.ID, id.Build, id.Version, id.Platform, id.Hardware)
+		return
+	}
+	var names []string
+	for _, f := range supportedFirmware {
+		names = append(names, f.name)
+	}
+	m.fail(FirmwareError, "", fmt.Errorf("unsupported firmware build %.2f (version %.3f) on hardware platform %g, supported: %v",
+		id.Build, id.Version, id.Platform, names))
+}
+
+func (m *machine) RequireSupportedFirmware(on bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.strictFirmware = on
+}
+
+// unsupported returns an error, if the g-code command must be refused,
+// because the firmware is not supported. It's only called by the run goroutine.
+func (m *machine) unsupported(cmd string) error {
+	m.mu.Lock()
+	strict := m.strictFirmware
+	m.mu.Unlock()
+	if !strict || !isGcode(cmd) {
+		return nil
+	}
+	id := m.st.Identity
+	switch {
+	case id == nil:
+		return fmt.Errorf("the firmware is not identified yet")
+	case !id.Supported:
+		return fmt.Errorf("unsupported firmware build %.2f", id.Build)
+	}
+	return nil
+}
@@ -0,0 +1,362 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Real-time characters are sent to TinyG immediately, bypassing the queue of commands.
+const (
+	// feedhold pauses the motion.
+	feedhold = '!'
+
+	// cycleStart resumes the motion after a feedhold.
+	cycleStart = '~'
+
+	// queueFlush discards the moves queued in the planner. It only works during a feedhold.
+	queueFlush = '%'
+)
+
+// progressInterval is the minimum interval between two progress messages of a running job.
+const progressInterval = 250 * time.Millisecond
+
+// errJobRunning is returned, if a job is started while another one is running.
+var errJobRunning = errors.New("another job is running")
+
+// JobState is the state of a job.
+type JobState string
+
+const (
+	// JobRunning means that the job lines are being sent to the machine.
+	JobRunning JobState = "running"
+
+	// JobPaused means that the machine is in feedhold, and no lines are sent.
+	JobPaused JobState = "paused"
+
+	// JobDone means that all the lines of the job are acknowledged by the machine.
+	JobDone JobState = "done"
+
+	// JobCancelled means that the job was cancelled by the operator.
+	JobCancelled JobState = "cancelled"
+
+	// JobFailed means that the job could not be completed.
+	JobFailed JobState = "failed"
+)
+
+// Progress describes the progress of a job.
+type Progress struct {
+	// Name is the name of the job, usually the name of the g-code file.
+	Name string `json:"name"`
+
+	State JobState `json:"state"`
+
+	// Line is the number of the last line acknowledged by the machine. Lines are numbered from 1.
+	Line int `json:"line"`
+
+	// Lines is the total number of lines in the job.
+	Lines int `json:"lines"`
+
+	// Percent is the percentage of lines acknowledged by the machine.
+	Percent float64 `json:"percent"`
+
+	// Elapsed is the time spent running the job, in seconds. Pauses are not counted.
+	Elapsed float64 `json:"elapsed"`
+
+	// ETA is the estimated time to complete the job, in seconds.
+	ETA float64 `json:"eta"`
+
+	// Err is the reason of a failure, if the job has failed.
+	Err string `json:"err,omitempty"`
+}
+
+// Job is a g-code program streamed through the machine.
+type Job struct {
+	m     *machine
+	name  string
+	lines []string
+
+	// cancelCh is closed, when the job is cancelled.
+	cancelCh chan struct{}
+
+	// done is closed, when the job is over.
+	done chan struct{}
+
+	mu    sync.Mutex
+	state JobState
+	line  int
+	err   error
+
+	// wake is closed and replaced, when the state changes.
+	wake chan struct{}
+
+	// ran is the time spent running before the last pause.
+	ran time.Duration
+
+	// started is the time when the job was started or resumed for the last time.
+	started time.Time
+
+	// published is the time when the progress was published for the last time.
+	published time.Time
+}
+
+// gcodeCmd converts a g-code line to a command for the machine.
+func gcodeCmd(line string, jsonMode bool) string {
+	if !jsonMode {
+		return line
+	}
+	data, err := json.Marshal(struct {
+		Gc string `json:"gc"`
+	}{line})
+	if err != nil {
+		// Can't happen, a string can always be marshaled.
+		panic(err)
+	}
+	return string(data)
+}
+
+func (m *machine) Run(name string, src io.Reader) (*Job, error) {
+	var lines []string
+	s := bufio.NewScanner(src)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	j := &Job{
+		m:        m,
+		name:     name,
+		lines:    lines,
+		cancelCh: make(chan struct{}),
+		done:     make(chan struct{}),
+		state:    JobRunning,
+		wake:     make(chan struct{}),
+		started:  time.Now(),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.job != nil {
+		return nil, errJobRunning
+	}
+	m.job = j
+	go j.run()
+	return j, nil
+}
+
+func (m *machine) Hold()   { m.realtime(feedhold) }
+func (m *machine) Resume() { m.realtime(cycleStart) }
+func (m *machine) Flush()  { m.realtime(queueFlush) }
+
+// run streams the job lines to the machine.
+func (j *Job) run() {
+	defer close(j.done)
+	j.publish(true)
+
+	var nums []int
+	for i, line := range j.lines {
+		if strings.TrimSpace(line) != "" {
+			nums = append(nums, i+1)
+		}
+	}
+	results := make(chan *result, len(nums))
+	collected := make(chan struct{})
+	go func() {
+		defer close(collected)
+		if err := j.collect(results, nums); err != nil {
+			j.stop(JobFailed, err)
+		}
+	}()
+
+	for _, n := range nums {
+		if !j.waitRunning() {
+			break
+		}
+		req := &request{cmd: gcodeCmd(strings.TrimSpace(j.lines[n-1]), j.m.jsonMode), job: true, line: n, done: results}
+		select {
+		case j.m.toCh <- req:
+			continue
+		case <-j.m.stopped:
+			j.m.drop(req)
+		case <-j.cancelCh:
+		}
+		break
+	}
+	<-collected
+	j.mu.Lock()
+	if j.state == JobRunning || j.state == JobPaused {
+		j.line = len(j.lines)
+	}
+	j.mu.Unlock()
+	j.finish(JobDone, nil)
+}
+
+// collect waits for the job lines to be acknowledged by the machine and updates the progress.
+// nums are the numbers of the lines sent, in order.
+func (j *Job) collect(results <-chan *result, nums []int) error {
+	for _, n := range nums {
+		select {
+		case res := <-results:
+			if res.err != nil {
+				return fmt.Errorf("line %d: %v", res.line, res.err)
+			}
+		case <-j.cancelCh:
+			return nil
+		}
+		j.mu.Lock()
+		j.line = n
+		j.mu.Unlock()
+		j.publish(false)
+	}
+	return nil
+}
+
+// waitRunning blocks while the job is paused. It returns false, if the job is over.
+func (j *Job) waitRunning() bool {
+	for {
+		j.mu.Lock()
+		state, wake := j.state, j.wake
+		j.mu.Unlock()
+		switch state {
+		case JobRunning:
+			return true
+		case JobPaused:
+			<-wake
+		default:
+			return false
+		}
+	}
+}
+
+// setState changes the state of the job, if it's not over yet.
+func (j *Job) setState(state JobState, err error) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != JobRunning && j.state != JobPaused {
+		return false
+	}
+	now := time.Now()
+	if j.state == JobRunning {
+		j.ran += now.Sub(j.started)
+	}
+	j.started = now
+	j.state = state
+	j.err = err
+	close(j.wake)
+	j.wake = make(chan struct{})
+	return true
+}
+
+// finish moves the job into a final state and releases the machine.
+// It returns false, if the job is already over.
+func (j *Job) finish(state JobState, err error) bool {
+	if !j.setState(state, err) {
+		return false
+	}
+	j.m.mu.Lock()
+	if j.m.job == j {
+		j.m.job = nil
+	}
+	j.m.mu.Unlock()
+	j.publish(true)
+	return true
+}
+
+// publish sends the job progress to the listeners. Unless forced, it's throttled.
+func (j *Job) publish(force bool) {
+	j.mu.Lock()
+	now := time.Now()
+	if !force && now.Sub(j.published) < progressInterval {
+		j.mu.Unlock()
+		return
+	}
+	j.published = now
+	j.mu.Unlock()
+	p := j.Progress()
+	j.m.ps.Pub(&Message{Job: &p})
+}
+
+// Progress returns the current progress of the job.
+func (j *Job) Progress() Progress {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	elapsed := j.ran
+	if j.state == JobRunning {
+		elapsed += time.Since(j.started)
+	}
+	p := Progress{
+		Name:    j.name,
+		State:   j.state,
+		Line:    j.line,
+		Lines:   len(j.lines),
+		Elapsed: elapsed.Seconds(),
+	}
+	if p.Lines > 0 {
+		p.Percent = 100 * float64(p.Line) / float64(p.Lines)
+	}
+	if p.Line > 0 && p.Line < p.Lines {
+		p.ETA = p.Elapsed * float64(p.Lines-p.Line) / float64(p.Line)
+	}
+	if j.err != nil {
+		p.Err = j.err.Error()
+	}
+	return p
+}
+
+// Pause puts the machine into feedhold and stops sending the job lines.
+func (j *Job) Pause() {
+	if j.setState(JobPaused, nil) {
+		j.m.Hold()
+		j.publish(true)
+	}
+}
+
+// Resume resumes the motion and continues sending the job lines.
+func (j *Job) Resume() {
+	j.mu.Lock()
+	paused := j.state == JobPaused
+	j.mu.Unlock()
+	if paused && j.setState(JobRunning, nil) {
+		j.m.Resume()
+		j.publish(true)
+	}
+}
+
+// Cancel stops the motion, discards the moves queued in the machine and stops sending the job lines.
+// The machine remains in feedhold.
+func (j *Job) Cancel() {
+	j.stop(JobCancelled, nil)
+}
+
+// stop stops the motion and the job. The machine remains in feedhold.
+func (j *Job) stop(state JobState, err error) {
+	if !j.finish(state, err) {
+		return
+	}
+	close(j.cancelCh)
+	// The machine may be busy delivering the results of the job lines, don't wait for it.
+	go func() {
+		j.m.Hold()
+		j.m.Flush()
+	}()
+}
+
+// Wait waits until the job is over and returns an error, if the job did not complete.
+func (j *Job) Wait() error {
+	<-j.done
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch j.state {
+	case JobDone:
+		return nil
+	case JobCancelled:
+		return errors.New("job cancelled")
+	}
+	return j.err
+}
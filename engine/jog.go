@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// JogSteps are the distances of the incremental jog, in mm.
+var JogSteps = []float64{0.01, 0.1, 1, 10}
+
+const (
+	// DefaultJogFeed is the feed rate of the jog, mm/min, if none is given.
+	DefaultJogFeed = 1000
+
+	// JogTimeout stops the continuous jog, if it's not renewed in time: for example,
+	// because the client is gone before it could stop the jog.
+	JogTimeout = time.Second
+
+	// jogTravel is the distance of the continuous jog along an axis without the soft limits, mm.
+	jogTravel = 1000
+
+	// jogAckTimeout is the time to wait for the machine to accept a jog move.
+	jogAckTimeout = 5 * time.Second
+)
+
+// jogging is the continuous jog in progress.
+type jogging struct {
+	axis  int
+	dir   int
+	timer *time.Timer
+
+	// restore is the line, which restores the modal state after the jog.
+	// It's flushed together with the jog, so it's sent again, when the jog is stopped.
+	restore string
+}
+
+// jogAxis returns the index of the axis: "X", "Y" or "Z".
+func jogAxis(axis string) (int, error) {
+	i := strings.Index("XYZ", strings.ToUpper(axis))
+	if len(axis) != 1 || i < 0 {
+		return 0, fmt.Errorf("can't jog %q, want X, Y or Z", axis)
+	}
+	return i, nil
+}
+
+// jogLines returns the jog move and the line, which restores the modal state of the machine after it,
+// since the move switches to mm, its own distance mode, G1 and its feed rate.
+// The feed rate is restored in mm: the units are set after it in the block.
+func (m *machine) jogLines(move string) []string {
+	st := m.State()
+	restore := fmt.Sprintf("%v %v %v", st.Distance, st.Units, st.Motion)
+	if st.Feed > 0 {
+		feed := st.Feed
+		if st.Units == tinyg.Inches {
+			feed = math.Floor(feed*25.4*1000+0.5) / 1000
+		}
+		restore += fmt.Sprintf(" F%g", feed)
+	}
+	return []string{move, restore}
+}
+
+// jog sends the lines of the jog and waits until the machine accepts them.
+// The full status report is requested then, so that the next jog restores the modal state
+// the machine is in, not the one of the status report, which may be behind.
+func (m *machine) jog(lines []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), jogAckTimeout)
+	defer cancel()
+	for _, line := range lines {
+		if _, err := m.Do(ctx, gcodeCmd(line, m.jsonMode)); err != nil {
+			return err
+		}
+	}
+	if m.jsonMode {
+		if _, err := m.Do(ctx, `{"sr":""}`); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *machine) Jog(axis string, step, feed float64) error {
+	i, err := jogAxis(axis)
+	if err != nil {
+		return err
+	}
+	valid := false
+	for _, s := range JogSteps {
+		valid = valid || math.Abs(step) == s
+	}
+	if !valid {
+		return fmt.Errorf("invalid jog step %g, want one of %v mm", step, JogSteps)
+	}
+	if feed <= 0 {
+		feed = DefaultJogFeed
+	}
+	if err := m.idle("jog"); err != nil {
+		return err
+	}
+	return m.jog(m.jogLines(fmt.Sprintf("G91 G21 G1 %c%g F%g", "XYZ"[i], step, feed)))
+}
+
+func (m *machine) JogStart(axis string, dir int, feed float64) error {
+	i, err := jogAxis(axis)
+	if err != nil {
+		return err
+	}
+	if dir != 1 && dir != -1 {
+		return fmt.Errorf("invalid jog direction %d, want 1 or -1", dir)
+	}
+	if feed <= 0 {
+		feed = DefaultJogFeed
+	}
+	m.mu.Lock()
+	if j := m.jogging; j != nil && j.axis == i && j.dir == dir {
+		// The same jog is renewed.
+		j.timer.Reset(JogTimeout)
+		m.mu.Unlock()
+		return nil
+	}
+	m.mu.Unlock()
+	m.JogStop()
+	if err := m.idle("jog"); err != nil {
+		return err
+	}
+
+	// The jog goes to the soft limit, if there's one, or far enough otherwise.
+	move := fmt.Sprintf("G91 G21 G1 %c%g F%g", "XYZ"[i], float64(dir*jogTravel), feed)
+	if env := m.envelope(); env != nil {
+		limit := env.Max[i]
+		if dir < 0 {
+			limit = env.Min[i]
+		}
+		if !math.IsInf(limit, 0) {
+			move = fmt.Sprintf("G90 G21 G53 G1 %c%g F%g", "XYZ"[i], limit, feed)
+		}
+	}
+	lines := m.jogLines(move)
+	j := &jogging{axis: i, dir: dir, restore: lines[1]}
+	m.mu.Lock()
+	m.jogging = j
+	j.timer = time.AfterFunc(JogTimeout, func() {
+		log.Printf("Jog %c is not renewed in %v, stopping", "XYZ"[i], JogTimeout)
+		m.stopJog(j)
+	})
+	m.mu.Unlock()
+	if err := m.jog(lines); err != nil {
+		m.stopJog(j)
+		return err
+	}
+	return nil
+}
+
+func (m *machine) JogStop() {
+	m.mu.Lock()
+	j := m.jogging
+	m.mu.Unlock()
+	if j != nil {
+		m.stopJog(j)
+	}
+}
+
+// stopJog stops the continuous jog with a feedhold and a queue flush, if it's still in progress.
+// Only the jog may be queued, since the jog is refused while a job is running.
+// It waits until the modal state is restored, so that the next jog is checked from the position,
+// where the machine has stopped.
+func (m *machine) stopJog(j *jogging) {
+	m.mu.Lock()
+	if m.jogging != j {
+		m.mu.Unlock()
+		return
+	}
+	m.jogging = nil
+	j.timer.Stop()
+	m.mu.Unlock()
+	m.Hold()
+	m.Flush()
+	ctx, cancel := context.WithTimeout(context.Background(), jogAckTimeout)
+	defer cancel()
+	if _, err := m.Do(ctx, gcodeCmd(j.restore, m.jsonMode)); err != nil {
+		log.Print("Error: could not restore the modal state after the jog: ", err)
+	}
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Control tells which client drives the machine. The other clients only watch it.
+type Control struct {
+	// Holder is the id of the client, which holds control, or empty, if nobody does.
+	Holder string `json:"holder"`
+
+	// User is the name of the user of the holder, if the users log in.
+	User string `json:"user,omitempty"`
+
+	// Requester is the id of the client, which has asked the holder for control, if any.
+	Requester string `json:"requester,omitempty"`
+
+	// RequesterUser is the name of the user of the requester.
+	RequesterUser string `json:"requesterUser,omitempty"`
+}
+
+// who returns the id of the client with the name of its user, if any.
+func who(id, user string) string {
+	if user == "" {
+		return id
+	}
+	return fmt.Sprintf("%s (%s)", id, user)
+}
+
+func (c Control) String() string {
+	if c.Holder == "" {
+		return "nobody holds control"
+	}
+	s := who(c.Holder, c.User) + " holds control"
+	if c.Requester != "" {
+		s += ", " + who(c.Requester, c.RequesterUser) + " requests it"
+	}
+	return s
+}
+
+// Lease is the control lease of the machine: only one client holds it at a time, so that the commands
+// of several clients are not interleaved. The clients are identified by the ids chosen by the caller.
+// Every change is published to the listeners as a Message with Control.
+type Lease struct {
+	ps *pubsub
+
+	mu sync.Mutex
+	c  Control
+}
+
+func newLease(ps *pubsub) *Lease {
+	return &Lease{ps: ps}
+}
+
+// Control returns the current holder of the lease.
+func (l *Lease) Control() Control {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.c
+}
+
+// set changes the lease and notifies the listeners. The caller must hold the lock.
+func (l *Lease) set(c Control) {
+	if c == l.c {
+		return
+	}
+	l.c = c
+	log.Print("Control: ", c)
+	tmp := c
+	l.ps.Pub(&Message{Control: &tmp})
+}
+
+// Check returns a ControlError, if another client holds control. If nobody does,
+// the client takes it, so that a single client does not have to request it.
+func (l *Lease) Check(id, user string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch l.c.Holder {
+	case id:
+		return nil
+	case "":
+		l.set(Control{Holder: id, User: user})
+		return nil
+	}
+	return &Error{Kind: ControlError, Msg: fmt.Sprintf("%s holds control, request it first", who(l.c.Holder, l.c.User))}
+}
+
+// Request gives control to the client, if nobody holds it. Otherwise, the request is recorded
+// for the holder to hand control over, replacing the previous request. It returns true, if control is given.
+func (l *Lease) Request(id, user string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch l.c.Holder {
+	case id:
+		return true
+	case "":
+		l.set(Control{Holder: id, User: user})
+		return true
+	}
+	c := l.c
+	c.Requester, c.RequesterUser = id, user
+	l.set(c)
+	return false
+}
+
+// Handover passes control from the holder to the client, which has requested it.
+func (l *Lease) Handover(from, to string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.c.Holder != from {
+		return &Error{Kind: ControlError, Msg: fmt.Sprintf("%s does not hold control", from)}
+	}
+	if to == "" || to != l.c.Requester {
+		return &Error{Kind: ControlError, Msg: fmt.Sprintf("%q has not requested control", to)}
+	}
+	l.set(Control{Holder: l.c.Requester, User: l.c.RequesterUser})
+	return nil
+}
+
+// Release gives up control. If another client has requested it, the client gets it.
+func (l *Lease) Release(id string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.c.Holder != id {
+		return &Error{Kind: ControlError, Msg: fmt.Sprintf("%s does not hold control", id)}
+	}
+	l.set(Control{Holder: l.c.Requester, User: l.c.RequesterUser})
+	return nil
+}
+
+// Take gives control to the client, even if another one holds it. It's meant for the admin,
+// who has to stop a client, which does not let go, and it's logged.
+func (l *Lease) Take(id, user string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.c.Holder != "" && l.c.Holder != id {
+		log.Printf("%s takes control from %s", who(id, user), who(l.c.Holder, l.c.User))
+	}
+	c := Control{Holder: id, User: user}
+	if l.c.Requester != id {
+		c.Requester, c.RequesterUser = l.c.Requester, l.c.RequesterUser
+	}
+	l.set(c)
+}
+
+// Leave releases control and withdraws the request of the client, which is gone.
+func (l *Lease) Leave(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.c
+	if c.Requester == id {
+		c.Requester, c.RequesterUser = "", ""
+	}
+	if c.Holder == id {
+		c = Control{Holder: c.Requester, User: c.RequesterUser}
+	}
+	l.set(c)
+}
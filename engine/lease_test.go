@@ -0,0 +1,59 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLease(t *testing.T) {
+	ps := newPubSub()
+	ch := ps.Sub()
+	l := newLease(ps)
+
+	tests := []struct {
+		desc string
+		op   func() error
+		want Control
+		kind ErrorKind
+	}{
+		{"a drives a free machine", func() error { return l.Check("a", "ann") }, Control{Holder: "a", User: "ann"}, ""},
+		{"b drives", func() error { return l.Check("b", "bob") }, Control{Holder: "a", User: "ann"}, ControlError},
+		{"b releases", func() error { return l.Release("b") }, Control{Holder: "a", User: "ann"}, ControlError},
+		{"b requests", func() error { l.Request("b", "bob"); return nil }, Control{Holder: "a", User: "ann", Requester: "b", RequesterUser: "bob"}, ""},
+		{"a hands over to c", func() error { return l.Handover("a", "c") }, Control{Holder: "a", User: "ann", Requester: "b", RequesterUser: "bob"}, ControlError},
+		{"a hands over to b", func() error { return l.Handover("a", "b") }, Control{Holder: "b", User: "bob"}, ""},
+		{"a requests", func() error { l.Request("a", "ann"); return nil }, Control{Holder: "b", User: "bob", Requester: "a", RequesterUser: "ann"}, ""},
+		{"b releases to a", func() error { return l.Release("b") }, Control{Holder: "a", User: "ann"}, ""},
+		{"b requests again", func() error { l.Request("b", "bob"); return nil }, Control{Holder: "a", User: "ann", Requester: "b", RequesterUser: "bob"}, ""},
+		{"c takes", func() error { l.Take("c", "cat"); return nil }, Control{Holder: "c", User: "cat", Requester: "b", RequesterUser: "bob"}, ""},
+		{"b leaves", func() error { l.Leave("b"); return nil }, Control{Holder: "c", User: "cat"}, ""},
+		{"c leaves", func() error { l.Leave("c"); return nil }, Control{}, ""},
+	}
+	for _, tt := range tests {
+		prev := l.Control()
+		err := tt.op()
+		var kind ErrorKind
+		if e, ok := err.(*Error); ok {
+			kind = e.Kind
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.desc, err)
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: error %v, want kind %q", tt.desc, err, tt.kind)
+		}
+		if got := l.Control(); got != tt.want {
+			t.Errorf("%s: %v, want: %v", tt.desc, got, tt.want)
+		}
+		if tt.want == prev {
+			continue
+		}
+		select {
+		case msg := <-ch:
+			if msg.Control == nil || *msg.Control != tt.want {
+				t.Errorf("%s: message %+v, want control: %v", tt.desc, msg, tt.want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%s: no message", tt.desc)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/samofly/gentle/gcode"
+	"github.com/samofly/gentle/tinyg"
+)
+
+// Envelope is the working envelope of the machine: the allowed range of the X, Y and Z
+// machine coordinates, in mm. Moves which leave it are refused before they are sent (soft limits).
+type Envelope struct {
+	Min, Max gcode.Point
+}
+
+// NoLimits returns an envelope, which does not limit any axis.
+// Set the limits of the axes which need them.
+func NoLimits() *Envelope {
+	inf := math.Inf(1)
+	return &Envelope{Min: gcode.Point{-inf, -inf, -inf}, Max: gcode.Point{inf, inf, inf}}
+}
+
+// check returns an error, if the move leaves the envelope.
+func (env *Envelope) check(mv *gcode.Move) error {
+	min, max := mv.Bounds()
+	for i := range min {
+		// Allow for the rounding errors of the offsets and the inches.
+		const eps = 1e-6
+		if min[i] < env.Min[i]-eps {
+			return fmt.Errorf("%c would go to %.3f, below the soft limit %.3f", "XYZ"[i], min[i], env.Min[i])
+		}
+		if max[i] > env.Max[i]+eps {
+			return fmt.Errorf("%c would go to %.3f, above the soft limit %.3f", "XYZ"[i], max[i], env.Max[i])
+		}
+	}
+	return nil
+}
+
+// moving returns true, if the machine may be moving or about to move in the state.
+func moving(s tinyg.MachineState) bool {
+	switch s {
+	case tinyg.StateRun, tinyg.StateHold, tinyg.StateProbe, tinyg.StateCycle, tinyg.StateHoming, tinyg.StateJog:
+		return true
+	}
+	return false
+}
+
+// limits follows the position, where the commands sent to the machine will leave it,
+// to check the moves against the envelope. It's only accessed by the run goroutine.
+type limits struct {
+	// geo is the state at the end of the commands sent. It's nil, if the position is not known:
+	// then it's taken from the status reports, once the machine is idle.
+	geo *gcode.State
+
+	// offsets and g92 are the origins as reported by the machine or tracked by geo.
+	offsets [tinyg.G59 + 1]gcode.Point
+	g92     gcode.Point
+
+	// ofs is the active work offset from the status reports, if known.
+	ofs    gcode.Point
+	ofsSet [3]bool
+
+	// spindle is true, if the state of the spindle in geo is known: it's taken from the status reports,
+	// or set by the commands sent.
+	spindle bool
+}
+
+// errPositionUnknown is returned by check for a move, while the position is not known.
+var errPositionUnknown = errors.New("the position is not known yet, can't check the soft limits")
+
+// spindleOffError is returned by check for a cutting move of a job below the work zero,
+// while the spindle is known to be off.
+type spindleOffError string
+
+func (e spindleOffError) Error() string { return string(e) }
+
+// cutting are the motion modes, which cut the material.
+var cutting = map[tinyg.MotionMode]bool{tinyg.StraightFeed: true, tinyg.ArcCW: true, tinyg.ArcCCW: true}
+
+// spindleCodes are the M codes, which set the state of the spindle.
+var spindleCodes = map[int]bool{20: true, 30: true, 40: true, 50: true, 300: true}
+
+// reset forgets the tracked position, for example, when the queued moves are flushed.
+func (l *limits) reset() {
+	if l.geo != nil {
+		l.offsets, l.g92 = l.geo.Offsets, l.geo.G92
+	}
+	l.geo = nil
+}
+
+// update takes the offsets reported by the machine into account.
+func (l *limits) update(r *tinyg.Response) {
+	for i, v := range []*float64{r.Ofsx, r.Ofsy, r.Ofsz} {
+		if v != nil {
+			l.ofs[i], l.ofsSet[i] = *v, true
+		}
+	}
+	if len(r.Body) == 0 {
+		return
+	}
+	var body map[string]map[string]float64
+	if json.Unmarshal(r.Body, &body) != nil {
+		return
+	}
+	for k, g := range body {
+		var p *gcode.Point
+		switch {
+		case k == "g92":
+			p = &l.g92
+		case len(k) == 3 && k >= "g54" && k <= "g59":
+			p = &l.offsets[tinyg.G54+tinyg.CoordSystem(k[2]-'4')]
+		default:
+			continue
+		}
+		for i, a := range []string{"x", "y", "z"} {
+			if v, ok := g[a]; ok {
+				p[i] = v
+			}
+		}
+	}
+}
+
+// sync takes the position and the modal state from the state of the idle machine.
+// The position stays unknown, if the machine has not reported it yet.
+func (l *limits) sync(st *State) {
+	if math.IsNaN(st.X) || math.IsNaN(st.Y) || math.IsNaN(st.Z) {
+		return
+	}
+	geo := gcode.NewState()
+	geo.Pos = gcode.Point{st.X, st.Y, st.Z}
+	geo.Units, geo.Distance, geo.Coord, geo.Motion, geo.Feed = st.Units, st.Distance, st.Coord, st.Motion, st.Feed
+	geo.Offsets, geo.G92 = l.offsets, l.g92
+	l.spindle = st.Spindle != nil
+	if st.Spindle != nil && st.Spindle.On {
+		geo.Spindle, geo.Speed = gcode.SpindleCW, st.Spindle.Speed
+		if st.Spindle.CCW {
+			geo.Spindle = gcode.SpindleCCW
+		}
+	}
+	if geo.Coord >= tinyg.G54 && geo.Coord <= tinyg.G59 {
+		for i := range l.ofs {
+			// The work offset reported by the machine is the truth,
+			// attribute the difference to G92, which applies to all the coordinate systems.
+			if l.ofsSet[i] {
+				geo.G92[i] = l.ofs[i] - geo.Offsets[geo.Coord][i]
+			}
+		}
+	}
+	l.geo = geo
+}
+
+// gcodeLine returns the g-code line of a command, raw or wrapped into json.
+func gcodeLine(cmd string) (string, bool) {
+	if !strings.HasPrefix(cmd, "{") {
+		return cmd, true
+	}
+	var c struct {
+		Gc *string `json:"gc"`
+	}
+	if json.Unmarshal([]byte(cmd), &c) != nil || c.Gc == nil {
+		return "", false
+	}
+	return *c.Gc, true
+}
+
+// check tracks the command and returns an error, if it would move the machine out of the envelope.
+// idle tells that nothing is moving or queued, so the position may be taken from st.
+// If the position is not known, a move is refused with errPositionUnknown: the caller should wait until
+// the machine is idle and check it again.
+// Without an envelope, the position is only tracked. If the command is a line of a job,
+// a cutting move below the work zero is refused with a spindleOffError, while the spindle is known to be off.
+func (l *limits) check(env *Envelope, cmd string, idle bool, st *State, job bool) error {
+	line, ok := gcodeLine(cmd)
+	if !ok {
+		return nil
+	}
+	if l.geo == nil && idle {
+		l.sync(st)
+	}
+	b, err := gcode.Parse(line)
+	if err != nil {
+		l.reset()
+		if env != nil {
+			return fmt.Errorf("can't check the soft limits: %v", err)
+		}
+		return nil
+	}
+	if l.geo == nil {
+		if env != nil && b.HasAxes() {
+			return errPositionUnknown
+		}
+		return nil
+	}
+	next := *l.geo
+	mv, err := next.Next(b)
+	if err != nil {
+		l.reset()
+		if env != nil {
+			return fmt.Errorf("can't check the soft limits: %v", err)
+		}
+		return nil
+	}
+	if env != nil && mv != nil {
+		if err := env.check(mv); err != nil {
+			return err
+		}
+	}
+	spindle := l.spindle
+	for _, w := range b.Words {
+		spindle = spindle || w.Letter == 'M' && spindleCodes[w.Code()]
+	}
+	if job && spindle && next.Spindle == gcode.SpindleOff && mv != nil && cutting[next.Motion] {
+		min, _ := mv.Bounds()
+		if z := min[2] - next.Offsets[next.Coord][2] - next.G92[2]; z < -1e-6 {
+			return spindleOffError(fmt.Sprintf("the cut goes to Z %.3f below the work zero, while the spindle is off", z))
+		}
+	}
+	l.spindle = spindle
+	for _, w := range b.Words {
+		if w.Letter == 'G' && (w.Code() == 280 || w.Code() == 300) {
+			// G28 and G30 end at the stored positions, which are not tracked.
+			l.reset()
+			return nil
+		}
+	}
+	*l.geo = next
+	return nil
+}
+
+func (m *machine) SetEnvelope(env *Envelope) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.env = env
+}
+
+// envelope returns the working envelope, or nil, if there are no soft limits.
+func (m *machine) envelope() *Envelope {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.env
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// offsetTimeout is the time to wait for the machine to accept a change of the offsets.
+const offsetTimeout = 5 * time.Second
+
+// offsetCmd returns the g-code, which sets the offset for the current position, and the name
+// of the offset in the config of TinyG: G92, or G10 L20 with the number of the coordinate system.
+func offsetCmd(offset string) (string, string, error) {
+	offset = strings.ToUpper(offset)
+	if offset == "G92" {
+		return "G92", "g92", nil
+	}
+	for sys := tinyg.G54; sys <= tinyg.G59; sys++ {
+		if offset == sys.String() {
+			return fmt.Sprintf("G10 L20 P%d", sys), strings.ToLower(offset), nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid offset %q, want G92 or G54 to G59", offset)
+}
+
+func (m *machine) SetOffset(offset, axes string, v float64) error {
+	cmd, name, err := offsetCmd(offset)
+	if err != nil {
+		return err
+	}
+	axes = strings.ToUpper(axes)
+	if !homeAxes[axes] {
+		return fmt.Errorf("can't set the offset of %q, want X, Y, Z, XY or XYZ", axes)
+	}
+	for _, a := range axes {
+		cmd += fmt.Sprintf(" %c%g", a, v)
+	}
+	return m.setOffset(name, cmd)
+}
+
+func (m *machine) ResetOffset(offset string) error {
+	cmd, name, err := offsetCmd(offset)
+	if err != nil {
+		return err
+	}
+	if name == "g92" {
+		cmd = "G92.1"
+	} else {
+		cmd = strings.Replace(cmd, "L20", "L2", 1) + " X0 Y0 Z0"
+	}
+	return m.setOffset(name, cmd)
+}
+
+// setOffset sends the g-code, which changes the offset, and waits until the machine accepts it.
+// Then the offset and the status are queried, so that the soft limits and the work coordinates
+// are up to date.
+func (m *machine) setOffset(name, line string) error {
+	if err := m.idle("change the offsets"); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), offsetTimeout)
+	defer cancel()
+	cmds := []string{gcodeCmd(line, m.jsonMode)}
+	if m.jsonMode {
+		cmds = append(cmds, fmt.Sprintf(`{"%s":n}`, name), `{"sr":""}`)
+	}
+	for _, cmd := range cmds {
+		if _, err := m.Do(ctx, cmd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package engine
+
+import (
+	"log"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// request is a command for the machine.
+type request struct {
+	cmd string
+
+	// job is true, if the command is a line of a job.
+	job bool
+
+	// line is the number of the job line.
+	line int
+
+	// init is true for the commands sent on connect.
+	init bool
+
+	// done, if not nil, receives the result of the command, once it's acknowledged by the machine
+	// or dropped. The machine never waits for the receiver, so it must be read continuously
+	// or have enough buffer space.
+	done chan<- *result
+}
+
+// result is the outcome of a command.
+type result struct {
+	// resp is the response which acknowledged the command. It's nil, if the command was
+	// not acknowledged, or if the machine is not in json mode.
+	resp *tinyg.Response
+
+	err error
+
+	// line is the number of the job line. Lines refused before they are sent
+	// are replied to out of order.
+	line int
+}
+
+// reply delivers the result of the request to whoever issued it.
+// If nobody waits for the result, the error, if any, is published to the listeners.
+func (m *machine) reply(req *request, resp *tinyg.Response, e *Error) {
+	if req.done == nil {
+		if e != nil {
+			log.Print("Error: ", e)
+			m.ps.Pub(&Message{Error: e})
+		}
+		return
+	}
+	res := &result{resp: resp, line: req.line}
+	if e != nil {
+		res.err = e
+	}
+	req.done <- res
+}
+
+// ack checks the response, which acknowledges the request, and replies.
+func (m *machine) ack(req *request, resp *tinyg.Response) {
+	if err := resp.Verify(); err != nil {
+		m.reply(req, resp, &Error{Kind: ParseError, Msg: err.Error(), Line: resp.Json})
+		return
+	}
+	if st := resp.Footer.Status; !st.OK() {
+		m.reply(req, resp, &Error{Kind: StatusError, Msg: st.Message(), Line: req.cmd, Status: st})
+		return
+	}
+	m.reply(req, resp, nil)
+}
@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// spindleTimeout is the time to wait for the machine to accept a spindle or coolant command.
+const spindleTimeout = 5 * time.Second
+
+func (m *machine) SetSpindle(sp Spindle) error {
+	line := "M5"
+	if sp.On {
+		if sp.Speed <= 0 {
+			return fmt.Errorf("invalid spindle speed %g, want a positive one", sp.Speed)
+		}
+		code := "M3"
+		if sp.CCW {
+			code = "M4"
+		}
+		line = fmt.Sprintf("%s S%g", code, sp.Speed)
+	}
+	return m.modal("control the spindle", line)
+}
+
+func (m *machine) SetCoolant(c Coolant) error {
+	// M7 and M8 only turn the coolant on, so it's turned off first.
+	lines := []string{"M9"}
+	if c.Mist {
+		lines = append(lines, "M7")
+	}
+	if c.Flood {
+		lines = append(lines, "M8")
+	}
+	return m.modal("control the coolant", lines...)
+}
+
+// modal sends the lines, which change the modal state of the machine, and waits until the machine accepts them.
+// They're refused while a job is running, since the job relies on the state it has set.
+func (m *machine) modal(action string, lines ...string) error {
+	if err := m.idle(action); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), spindleTimeout)
+	defer cancel()
+	for _, line := range lines {
+		if _, err := m.Do(ctx, gcodeCmd(line, m.jsonMode)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,218 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// State is the cnc machine state
+type State struct {
+	// X, Y and Z are the position in the machine coordinates, mm.
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+
+	// Offset is the active work offset: the origin of the work coordinates in the machine coordinates, mm.
+	// It's the origin of the coordinate system plus the G92 offset.
+	Offset Coords `json:"offset"`
+
+	// Work is the position in the work coordinates, mm.
+	Work Coords `json:"work"`
+
+	// Status is the combined machine state, such as Ready, Running, Holding or Alarm.
+	Status tinyg.MachineState `json:"status"`
+
+	// Home tells whether the machine is homed.
+	Home tinyg.HomingState `json:"home"`
+
+	// Homed tells which axes are homed.
+	Homed HomedAxes `json:"homed"`
+
+	// HomingOverride is true, if the operator allowed the motion without homing.
+	HomingOverride bool `json:"homingOverride,omitempty"`
+
+	Units    tinyg.Units        `json:"units"`
+	Coord    tinyg.CoordSystem  `json:"coord"`
+	Motion   tinyg.MotionMode   `json:"motion"`
+	Distance tinyg.DistanceMode `json:"distance"`
+
+	// Feed is the programmed feed rate.
+	Feed float64 `json:"feed"`
+
+	// Vel is the current velocity.
+	Vel float64 `json:"vel"`
+
+	// Line is the line number of the g-code block being executed.
+	Line int `json:"line"`
+
+	// Spindle and Coolant are the states of the spindle and the coolant,
+	// once they are reported by the machine. They are replaced, not modified, on update.
+	Spindle *Spindle `json:"spindle,omitempty"`
+	Coolant *Coolant `json:"coolant,omitempty"`
+
+	// Alarm is the latched alarm, if any.
+	Alarm *Alarm `json:"alarm,omitempty"`
+
+	// Identity is the identity of the connected machine, once it's known.
+	Identity *Identity `json:"identity,omitempty"`
+
+	// Rehome is true, if the connection to the machine was lost and restored.
+	// The position can't be trusted anymore, so the machine must be re-homed
+	// before jobs can continue.
+	Rehome bool `json:"rehome,omitempty"`
+}
+
+// Coords are the coordinates of a point, mm. The unknown ones are NaN.
+type Coords struct {
+	X, Y, Z float64
+}
+
+// MarshalJSON encodes the unknown coordinates as null.
+func (c Coords) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		X *float64 `json:"x"`
+		Y *float64 `json:"y"`
+		Z *float64 `json:"z"`
+	}{coord(c.X), coord(c.Y), coord(c.Z)})
+}
+
+// Spindle is the state of the spindle.
+type Spindle struct {
+	On bool `json:"on"`
+
+	// CCW is true, if the spindle turns counterclockwise (M4).
+	CCW bool `json:"ccw"`
+
+	// Speed is the programmed spindle speed, rpm.
+	Speed float64 `json:"speed"`
+}
+
+// Coolant is the state of the coolant.
+type Coolant struct {
+	Mist  bool `json:"mist"`
+	Flood bool `json:"flood"`
+}
+
+// HomedAxes tells which axes are homed.
+type HomedAxes struct {
+	X bool `json:"x"`
+	Y bool `json:"y"`
+	Z bool `json:"z"`
+}
+
+func (st *State) String() string {
+	return fmt.Sprintf("[X: %.3f, Y: %.3f, Z: %3f, %v]", st.X, st.Y, st.Z, st.Status)
+}
+
+// MarshalJSON encodes the unknown coordinates as null, since json has no NaN.
+func (st State) MarshalJSON() ([]byte, error) {
+	type state State
+	return json.Marshal(struct {
+		state
+		X *float64 `json:"x"`
+		Y *float64 `json:"y"`
+		Z *float64 `json:"z"`
+	}{state(st), coord(st.X), coord(st.Y), coord(st.Z)})
+}
+
+func coord(v float64) *float64 {
+	if math.IsNaN(v) {
+		return nil
+	}
+	return &v
+}
+
+// update applies a status report to the state.
+func (st *State) update(r *tinyg.Response) {
+	if r.Mpox != nil {
+		st.X = *r.Mpox
+	}
+	if r.Mpoy != nil {
+		st.Y = *r.Mpoy
+	}
+	if r.Mpoz != nil {
+		st.Z = *r.Mpoz
+	}
+	if r.Ofsx != nil {
+		st.Offset.X = *r.Ofsx
+	}
+	if r.Ofsy != nil {
+		st.Offset.Y = *r.Ofsy
+	}
+	if r.Ofsz != nil {
+		st.Offset.Z = *r.Ofsz
+	}
+	st.Work = Coords{st.X - st.Offset.X, st.Y - st.Offset.Y, st.Z - st.Offset.Z}
+	if r.Stat != nil {
+		st.Status = *r.Stat
+		if st.Status == tinyg.StateHoming {
+			// The machine is being re-homed, the position will be reliable again.
+			st.Rehome = false
+		}
+	}
+	if r.Home != nil {
+		st.Home = *r.Home
+	}
+	if r.Homx != nil {
+		st.Homed.X = *r.Homx == tinyg.Homed
+	}
+	if r.Homy != nil {
+		st.Homed.Y = *r.Homy == tinyg.Homed
+	}
+	if r.Homz != nil {
+		st.Homed.Z = *r.Homz == tinyg.Homed
+	}
+	if r.Unit != nil {
+		st.Units = *r.Unit
+	}
+	if r.Coor != nil {
+		st.Coord = *r.Coor
+	}
+	if r.Momo != nil {
+		st.Motion = *r.Momo
+	}
+	if r.Dist != nil {
+		st.Distance = *r.Dist
+	}
+	if r.Feed != nil {
+		st.Feed = *r.Feed
+	}
+	if r.Vel != nil {
+		st.Vel = *r.Vel
+	}
+	if r.Line != nil {
+		st.Line = *r.Line
+	}
+	if r.Spe != nil || r.Spd != nil || r.Sps != nil {
+		var sp Spindle
+		if st.Spindle != nil {
+			sp = *st.Spindle
+		}
+		if r.Spe != nil {
+			sp.On = *r.Spe != 0
+		}
+		if r.Spd != nil {
+			sp.CCW = *r.Spd != 0
+		}
+		if r.Sps != nil {
+			sp.Speed = *r.Sps
+		}
+		st.Spindle = &sp
+	}
+	if r.Com != nil || r.Cof != nil {
+		var c Coolant
+		if st.Coolant != nil {
+			c = *st.Coolant
+		}
+		if r.Com != nil {
+			c.Mist = *r.Com != 0
+		}
+		if r.Cof != nil {
+			c.Flood = *r.Cof != 0
+		}
+		st.Coolant = &c
+	}
+}
@@ -0,0 +1,21 @@
+package engine
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestStateJSON(t *testing.T) {
+	st := &State{X: 1.5, Y: math.NaN(), Z: math.NaN(), Work: Coords{0.5, math.NaN(), 2}}
+	data, err := json.Marshal(&Message{State: st})
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+	for _, want := range []string{`"x":1.5`, `"y":null`, `"z":null`, `"status":"Initializing"`, `"work":{"x":0.5,"y":null,"z":2}`} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("Marshal: %s, want: %s", data, want)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// errNoMachine is the reason of the commands refused, while no machine is connected.
+var errNoMachine = errors.New("no machine is connected")
+
+// Switch is a Machine, which talks to the machine connected at the moment.
+// The machine may be connected, disconnected and replaced at runtime, for example,
+// to open another serial port or to change the baud rate. The listeners subscribed to the switch
+// receive the messages of all the machines connected over time.
+// While no machine is connected, the commands are dropped.
+// The control lease of the clients is kept across the machines.
+type Switch struct {
+	jsonMode bool
+	ps       *pubsub
+	lease    *Lease
+
+	mu  sync.Mutex
+	m   *machine
+	dev string
+
+	// The settings applied to every connected machine.
+	env                      *Envelope
+	homing, override, strict bool
+}
+
+// NewSwitch returns a switch with no machine connected.
+func NewSwitch(jsonMode bool) *Switch {
+	ps := newPubSub()
+	return &Switch{jsonMode: jsonMode, ps: ps, lease: newLease(ps)}
+}
+
+// Lease returns the control lease of the clients.
+func (s *Switch) Lease() *Lease {
+	return s.lease
+}
+
+// Connect disconnects the current machine, if any, and connects to the one, which is dialed with dial.
+// dev is the name of the device for the listeners, such as "/dev/ttyUSB0".
+// The machine is redialed, if the connection is lost, until it's disconnected.
+func (s *Switch) Connect(dev string, dial Dialer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m != nil {
+		s.m.close()
+	}
+	m := newMachine(dial, s.jsonMode, s.ps)
+	m.env, m.homing, m.override, m.strictFirmware = s.env, s.homing, s.override, s.strict
+	s.m, s.dev = m, dev
+	log.Printf("Connecting to %s", dev)
+	go m.run()
+}
+
+// Disconnect disconnects the current machine, if any, and waits until its connection is closed.
+func (s *Switch) Disconnect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.m == nil {
+		return
+	}
+	log.Printf("Disconnecting from %s", s.dev)
+	s.m.close()
+	s.m, s.dev = nil, ""
+}
+
+// Device returns the name of the connected device, or an empty string, if there's none.
+func (s *Switch) Device() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dev
+}
+
+// machine returns the connected machine, or nil.
+func (s *Switch) machine() *machine {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.m
+}
+
+// drop tells the listeners that the command is dropped, because no machine is connected.
+func (s *Switch) drop(cmd string) {
+	e := &Error{Kind: DroppedError, Msg: errNoMachine.Error(), Line: cmd}
+	log.Print("Error: ", e)
+	s.ps.Pub(&Message{Error: e})
+}
+
+func (s *Switch) Send(cmd string) {
+	if m := s.machine(); m != nil {
+		m.Send(cmd)
+		return
+	}
+	s.drop(cmd)
+}
+
+func (s *Switch) Do(ctx context.Context, cmd string) (*tinyg.Response, error) {
+	if m := s.machine(); m != nil {
+		return m.Do(ctx, cmd)
+	}
+	return nil, &Error{Kind: DroppedError, Msg: errNoMachine.Error(), Line: cmd}
+}
+
+func (s *Switch) Sub() <-chan *Message {
+	return s.ps.Sub()
+}
+
+func (s *Switch) ConnState() ConnState {
+	if m := s.machine(); m != nil {
+		return m.ConnState()
+	}
+	return Disconnected
+}
+
+func (s *Switch) State() *State {
+	if m := s.machine(); m != nil {
+		return m.State()
+	}
+	return initialState()
+}
+
+func (s *Switch) Job() *Job {
+	if m := s.machine(); m != nil {
+		return m.Job()
+	}
+	return nil
+}
+
+func (s *Switch) Hold() {
+	if m := s.machine(); m != nil {
+		m.Hold()
+		return
+	}
+	s.drop(string(feedhold))
+}
+
+func (s *Switch) Resume() {
+	if m := s.machine(); m != nil {
+		m.Resume()
+		return
+	}
+	s.drop(string(cycleStart))
+}
+
+func (s *Switch) Flush() {
+	if m := s.machine(); m != nil {
+		m.Flush()
+		return
+	}
+	s.drop(string(queueFlush))
+}
+
+func (s *Switch) Run(name string, src io.Reader) (*Job, error) {
+	if m := s.machine(); m != nil {
+		return m.Run(name, src)
+	}
+	return nil, errNoMachine
+}
+
+func (s *Switch) ClearAlarm() error {
+	if m := s.machine(); m != nil {
+		return m.ClearAlarm()
+	}
+	return errNoMachine
+}
+
+func (s *Switch) SetEnvelope(env *Envelope) {
+	s.mu.Lock()
+	s.env = env
+	m := s.m
+	s.mu.Unlock()
+	if m != nil {
+		m.SetEnvelope(env)
+	}
+}
+
+func (s *Switch) Home(axes string) error {
+	if m := s.machine(); m != nil {
+		return m.Home(axes)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) RequireHoming(on bool) {
+	s.mu.Lock()
+	s.homing = on
+	m := s.m
+	s.mu.Unlock()
+	if m != nil {
+		m.RequireHoming(on)
+	}
+}
+
+func (s *Switch) OverrideHoming(on bool) {
+	s.mu.Lock()
+	s.override = on
+	m := s.m
+	s.mu.Unlock()
+	if m != nil {
+		m.OverrideHoming(on)
+	}
+}
+
+func (s *Switch) RequireSupportedFirmware(on bool) {
+	s.mu.Lock()
+	s.strict = on
+	m := s.m
+	s.mu.Unlock()
+	if m != nil {
+		m.RequireSupportedFirmware(on)
+	}
+}
+
+func (s *Switch) Jog(axis string, step, feed float64) error {
+	if m := s.machine(); m != nil {
+		return m.Jog(axis, step, feed)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) SetOffset(offset, axes string, v float64) error {
+	if m := s.machine(); m != nil {
+		return m.SetOffset(offset, axes, v)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) ResetOffset(offset string) error {
+	if m := s.machine(); m != nil {
+		return m.ResetOffset(offset)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) SetSpindle(sp Spindle) error {
+	if m := s.machine(); m != nil {
+		return m.SetSpindle(sp)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) SetCoolant(c Coolant) error {
+	if m := s.machine(); m != nil {
+		return m.SetCoolant(c)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) JogStart(axis string, dir int, feed float64) error {
+	if m := s.machine(); m != nil {
+		return m.JogStart(axis, dir, feed)
+	}
+	return errNoMachine
+}
+
+func (s *Switch) JogStop() {
+	if m := s.machine(); m != nil {
+		m.JogStop()
+	}
+}
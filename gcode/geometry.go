@@ -0,0 +1,181 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// Axis indexes of a Point.
+const (
+	X = iota
+	Y
+	Z
+)
+
+// mmPerInch converts the inches of G20 into mm.
+const mmPerInch = 25.4
+
+// Point is a position of the X, Y and Z axes, in mm.
+type Point [3]float64
+
+func (p Point) String() string {
+	return fmt.Sprintf("[X: %g, Y: %g, Z: %g]", p[X], p[Y], p[Z])
+}
+
+// Move is the motion made by a block, in machine coordinates.
+type Move struct {
+	From, To Point
+
+	// Arc is true for G2 and G3 moves. CW is true for G2.
+	Arc bool
+	CW  bool
+
+	// Center is the center of the arc. Only the coordinates in the plane of the arc are meaningful.
+	Center Point
+	Plane  tinyg.Plane
+}
+
+// planeAxes returns the axes of the plane in the order which defines the direction of the arcs,
+// and the letters of the offsets of the arc center along them.
+func planeAxes(p tinyg.Plane) (a, b int, la, lb byte) {
+	switch p {
+	case tinyg.PlaneXZ:
+		return Z, X, 'K', 'I'
+	case tinyg.PlaneYZ:
+		return Y, Z, 'J', 'K'
+	}
+	return X, Y, 'I', 'J'
+}
+
+// arcCenter computes the center of the arc from the I, J, K offsets or the radius R.
+// scale converts the block units into mm.
+func arcCenter(b *Block, mv *Move, scale float64) (Point, error) {
+	a, c, la, lc := planeAxes(mv.Plane)
+	center := mv.From
+	if r, ok := b.Get('R'); ok {
+		r *= scale
+		da, dc := mv.To[a]-mv.From[a], mv.To[c]-mv.From[c]
+		d := math.Hypot(da, dc)
+		if d == 0 {
+			return center, &Error{Msg: "arc with R can't be a full circle"}
+		}
+		h2 := r*r - d*d/4
+		if h2 < -1e-9*r*r {
+			return center, &Error{Msg: fmt.Sprintf("arc radius %g is too small for the end point", math.Abs(r))}
+		}
+		h := math.Sqrt(math.Max(h2, 0))
+		// The center of a short counterclockwise arc is on the left of the chord.
+		side := 1.0
+		if mv.CW {
+			side = -side
+		}
+		if r < 0 {
+			side = -side
+		}
+		center[a] = mv.From[a] + da/2 - side*h*dc/d
+		center[c] = mv.From[c] + dc/2 + side*h*da/d
+		return center, nil
+	}
+	oa, _ := b.Get(la)
+	oc, _ := b.Get(lc)
+	center[a] += oa * scale
+	center[c] += oc * scale
+	return center, nil
+}
+
+// normAngle returns the angle in the range [0, 2π).
+func normAngle(v float64) float64 {
+	v = math.Mod(v, 2*math.Pi)
+	if v < 0 {
+		v += 2 * math.Pi
+	}
+	return v
+}
+
+// Bounds returns the corners of the smallest box, which contains the move.
+func (mv *Move) Bounds() (min, max Point) {
+	for i := range min {
+		min[i] = math.Min(mv.From[i], mv.To[i])
+		max[i] = math.Max(mv.From[i], mv.To[i])
+	}
+	if !mv.Arc {
+		return min, max
+	}
+	a, c, _, _ := planeAxes(mv.Plane)
+	r := math.Hypot(mv.From[a]-mv.Center[a], mv.From[c]-mv.Center[c])
+	start := math.Atan2(mv.From[c]-mv.Center[c], mv.From[a]-mv.Center[a])
+	end := math.Atan2(mv.To[c]-mv.Center[c], mv.To[a]-mv.Center[a])
+	if mv.CW {
+		// A clockwise arc from start to end covers the same points as a counterclockwise one from end to start.
+		start, end = end, start
+	}
+	span := normAngle(end - start)
+	if span < 1e-9 {
+		span = 2 * math.Pi
+	}
+	// Check the extreme points of the circle: along the first and the second axes of the plane.
+	for k := 0; k < 4; k++ {
+		ang := float64(k) * math.Pi / 2
+		if normAngle(ang-start) > span {
+			continue
+		}
+		pa := mv.Center[a] + r*math.Cos(ang)
+		pc := mv.Center[c] + r*math.Sin(ang)
+		min[a], max[a] = math.Min(min[a], pa), math.Max(max[a], pa)
+		min[c], max[c] = math.Min(min[c], pc), math.Max(max[c], pc)
+	}
+	return min, max
+}
+
+// Extent is the size of a program.
+type Extent struct {
+	// Lines is the number of lines in the program, and Moves is the number of the moves.
+	Lines, Moves int
+
+	// Min and Max are the corners of the smallest box, which contains all the moves.
+	// They're zero, if there are no moves.
+	Min, Max Point
+}
+
+// Measure interprets the program, which starts at the origin, and returns its extent.
+// The coordinates are the machine ones, with the offsets set by the program itself.
+func Measure(r io.Reader) (*Extent, error) {
+	ext := new(Extent)
+	st := NewState()
+	s := bufio.NewScanner(r)
+	for ; s.Scan(); ext.Lines++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "%" {
+			continue
+		}
+		b, err := Parse(text)
+		if err == nil {
+			var mv *Move
+			if mv, err = st.Next(b); err == nil && mv != nil {
+				min, max := mv.Bounds()
+				if ext.Moves == 0 {
+					ext.Min, ext.Max = min, max
+				}
+				for i := range min {
+					ext.Min[i] = math.Min(ext.Min[i], min[i])
+					ext.Max[i] = math.Max(ext.Max[i], max[i])
+				}
+				ext.Moves++
+			}
+		}
+		if err != nil {
+			e := err.(*Error)
+			e.Line = ext.Lines + 1
+			return nil, e
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ext, nil
+}
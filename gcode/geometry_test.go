@@ -0,0 +1,131 @@
+package gcode
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+func near(a, b Point) bool {
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-6 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBounds(t *testing.T) {
+	tests := []struct {
+		name     string
+		mv       Move
+		min, max Point
+	}{
+		{
+			name: "line",
+			mv:   Move{From: Point{1, 5, 0}, To: Point{3, 2, -1}},
+			min:  Point{1, 2, -1},
+			max:  Point{3, 5, 0},
+		},
+		{
+			name: "counterclockwise half circle",
+			mv:   Move{From: Point{10, 0, 0}, To: Point{-10, 0, 0}, Arc: true},
+			min:  Point{-10, 0, 0},
+			max:  Point{10, 10, 0},
+		},
+		{
+			name: "clockwise half circle",
+			mv:   Move{From: Point{10, 0, 0}, To: Point{-10, 0, 0}, Arc: true, CW: true},
+			min:  Point{-10, -10, 0},
+			max:  Point{10, 0, 0},
+		},
+		{
+			name: "full circle",
+			mv:   Move{From: Point{10, 0, 0}, To: Point{10, 0, 0}, Arc: true, Center: Point{5, 0, 0}},
+			min:  Point{0, -5, 0},
+			max:  Point{10, 5, 0},
+		},
+		{
+			name: "helix in the XZ plane",
+			mv:   Move{From: Point{0, 0, 1}, To: Point{1, 3, 0}, Arc: true, Plane: tinyg.PlaneXZ},
+			min:  Point{0, 0, 0},
+			max:  Point{1, 3, 1},
+		},
+	}
+	for _, tt := range tests {
+		min, max := tt.mv.Bounds()
+		if !near(min, tt.min) || !near(max, tt.max) {
+			t.Errorf("%s: Bounds() = %v, %v, want: %v, %v", tt.name, min, max, tt.min, tt.max)
+		}
+	}
+}
+
+func TestArcCenter(t *testing.T) {
+	tests := []struct {
+		line   string
+		mv     Move
+		center Point
+		err    string
+	}{
+		{line: "G2 X10 I5", mv: Move{To: Point{10, 0, 0}}, center: Point{5, 0, 0}},
+		{line: "G3 X10 Y10 R10", mv: Move{To: Point{10, 10, 0}}, center: Point{0, 10, 0}},
+		{line: "G2 X10 Y10 R10", mv: Move{To: Point{10, 10, 0}, CW: true}, center: Point{10, 0, 0}},
+		{line: "G2 X10 Y10 R-10", mv: Move{To: Point{10, 10, 0}, CW: true}, center: Point{0, 10, 0}},
+		{line: "G2 X10 R1", mv: Move{To: Point{10, 0, 0}}, err: "arc radius 1 is too small for the end point"},
+		{line: "G2 R1", mv: Move{}, err: "arc with R can't be a full circle"},
+	}
+	for _, tt := range tests {
+		b, err := Parse(tt.line)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.line, err)
+		}
+		center, err := arcCenter(b, &tt.mv, 1)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error: %v, want: %s", tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.line, err)
+			continue
+		}
+		if !near(center, tt.center) {
+			t.Errorf("%s: center: %v, want: %v", tt.line, center, tt.center)
+		}
+	}
+}
+
+func TestMeasure(t *testing.T) {
+	tests := []struct {
+		prog string
+		ext  Extent
+		err  string
+	}{
+		{prog: "%\n(empty)\n%\n", ext: Extent{Lines: 3}},
+		{
+			prog: "G21 G90\nG0 X10 Y5\nG1 Z-2 F300\nG2 X-10 Y5 I-10 J0\nG0 Z5\n",
+			ext:  Extent{Lines: 5, Moves: 4, Min: Point{-10, -5, -2}, Max: Point{10, 5, 5}},
+		},
+		{prog: "G20\nG0 X1\n", ext: Extent{Lines: 2, Moves: 1, Min: Point{0, 0, 0}, Max: Point{25.4, 0, 0}}},
+		{prog: "G0 X1\nG1 X2\n", err: "line 2: feed rate is not set"},
+	}
+	for _, tt := range tests {
+		ext, err := Measure(strings.NewReader(tt.prog))
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: error: %v, want: %s", tt.prog, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.prog, err)
+			continue
+		}
+		if ext.Lines != tt.ext.Lines || ext.Moves != tt.ext.Moves || !near(ext.Min, tt.ext.Min) || !near(ext.Max, tt.ext.Max) {
+			t.Errorf("%q: %+v, want: %+v", tt.prog, ext, tt.ext)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Package gcode parses g-code and tracks the modal state of the machine.
+// The dialect is the one understood by TinyG, which is close to RS274/NGC.
+package gcode
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Error is an invalid line of g-code.
+type Error struct {
+	// Line is the number of the line in the program, starting from 1.
+	// It's 0, if a single line is parsed.
+	Line int
+
+	// Col is the position of the error in the line, starting from 1.
+	// It's 0, if the error is not about a particular position.
+	Col int
+
+	Msg string
+}
+
+func (e *Error) Error() string {
+	var pos string
+	if e.Line > 0 {
+		pos = fmt.Sprintf("line %d: ", e.Line)
+	}
+	if e.Col > 0 {
+		pos += fmt.Sprintf("col %d: ", e.Col)
+	}
+	return pos + e.Msg
+}
+
+// Word is a g-code word: a letter followed by a number, like G1 or X10.5.
+type Word struct {
+	Letter byte
+	Value  float64
+}
+
+func (w Word) String() string {
+	return string(w.Letter) + strconv.FormatFloat(w.Value, 'f', -1, 64)
+}
+
+// Code returns the number of a G or M word multiplied by 10, so that G1 is 10 and G28.2 is 282.
+func (w Word) Code() int {
+	return int(math.Floor(w.Value*10 + 0.5))
+}
+
+// letters are the letters of the words TinyG understands.
+const letters = "ABCDFGHIJKLMNPQRSTXYZ"
+
+// Block is a parsed line of g-code.
+type Block struct {
+	// Delete is true, if the block starts with the block delete character (/).
+	Delete bool
+
+	// Line is the line number from the N word, or 0, if there's none.
+	Line int
+
+	// Words are the words of the block in order, except N.
+	Words []Word
+
+	// Comments are the comments of the block, without the parentheses.
+	Comments []string
+}
+
+// String returns the canonical form of the block: upper-case words separated by spaces,
+// numbers without leading and trailing zeros, no comments and no checksum.
+func (b *Block) String() string {
+	var parts []string
+	if b.Delete {
+		parts = append(parts, "/")
+	}
+	if b.Line > 0 {
+		parts = append(parts, fmt.Sprintf("N%d", b.Line))
+	}
+	for _, w := range b.Words {
+		parts = append(parts, w.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// Empty returns true, if the block has no words. It may still have comments.
+func (b *Block) Empty() bool {
+	return b.Line == 0 && len(b.Words) == 0
+}
+
+// Get returns the value of the word with the letter, if the block has it.
+// For G and M words, which may repeat, the first one is returned.
+func (b *Block) Get(letter byte) (float64, bool) {
+	for _, w := range b.Words {
+		if w.Letter == letter {
+			return w.Value, true
+		}
+	}
+	return 0, false
+}
+
+// Has returns true, if the block has a word with the letter.
+func (b *Block) Has(letter byte) bool {
+	_, ok := b.Get(letter)
+	return ok
+}
+
+// Codes returns the codes of all the words with the letter, usually G or M. See Word.Code.
+func (b *Block) Codes(letter byte) []int {
+	var codes []int
+	for _, w := range b.Words {
+		if w.Letter == letter {
+			codes = append(codes, w.Code())
+		}
+	}
+	return codes
+}
+
+// checksum computes the checksum of a line: xor of all the bytes before '*'.
+func checksum(s string) int {
+	var c byte
+	for i := 0; i < len(s); i++ {
+		c ^= s[i]
+	}
+	return int(c)
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isSpace(c byte) bool { return c == ' ' || c == '\t' }
+
+// Parse parses a line of g-code. Only the syntax is checked, use State.Apply to check the meaning.
+// The line must not have line breaks: the machine would run the next line, which is not checked,
+// even if it looks like a part of a comment.
+func Parse(line string) (*Block, error) {
+	b := new(Block)
+	fail := func(i int, format string, args ...interface{}) (*Block, error) {
+		return nil, &Error{Col: i + 1, Msg: fmt.Sprintf(format, args...)}
+	}
+	if i := strings.IndexAny(line, "\r\n"); i >= 0 {
+		return fail(i, "line break in a block")
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < len(line); {
+		c := line[i]
+		switch {
+		case isSpace(c):
+			i++
+		case c == '/' && len(b.Words) == 0 && b.Line == 0 && !b.Delete:
+			b.Delete = true
+			i++
+		case c == '(':
+			end := strings.IndexAny(line[i+1:], "()")
+			if end < 0 || line[i+1+end] == '(' {
+				return fail(i, "unterminated comment")
+			}
+			b.Comments = append(b.Comments, strings.TrimSpace(line[i+1:i+1+end]))
+			i += end + 2
+		case c == ';':
+			b.Comments = append(b.Comments, strings.TrimSpace(line[i+1:]))
+			i = len(line)
+		case c == '*':
+			want, err := strconv.Atoi(strings.TrimSpace(line[i+1:]))
+			if err != nil {
+				return fail(i, "malformed checksum %q", line[i+1:])
+			}
+			if got := checksum(line[:i]); got != want {
+				return fail(i, "checksum mismatch: %d, want: %d", want, got)
+			}
+			i = len(line)
+		default:
+			letter := c
+			if letter >= 'a' && letter <= 'z' {
+				letter -= 'a' - 'A'
+			}
+			if letter < 'A' || letter > 'Z' {
+				return fail(i, "unexpected character %q", c)
+			}
+			if strings.IndexByte(letters, letter) < 0 {
+				return fail(i, "unsupported word %c", letter)
+			}
+			start := i
+			i++
+			for i < len(line) && isSpace(line[i]) {
+				i++
+			}
+			j := i
+			if j < len(line) && (line[j] == '+' || line[j] == '-') {
+				j++
+			}
+			for j < len(line) && (isDigit(line[j]) || line[j] == '.') {
+				j++
+			}
+			num := line[i:j]
+			v, err := strconv.ParseFloat(num, 64)
+			if err != nil {
+				if num == "" {
+					return fail(start, "missing number after %c", letter)
+				}
+				return fail(i, "malformed number %q", num)
+			}
+			if letter != 'G' && letter != 'M' {
+				if seen[letter] {
+					return fail(start, "repeated word %c", letter)
+				}
+				seen[letter] = true
+			}
+			if letter == 'N' {
+				if len(b.Words) > 0 {
+					return fail(start, "line number must be the first word")
+				}
+				if v < 0 || v != math.Trunc(v) {
+					return fail(start, "line number must be a non-negative integer")
+				}
+				b.Line = int(v)
+			} else {
+				b.Words = append(b.Words, Word{Letter: letter, Value: v})
+			}
+			i = j
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,168 @@
+package gcode
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		block *Block
+		canon string
+		err   string
+	}{
+		{
+			name:  "empty",
+			line:  "  ",
+			block: &Block{},
+		},
+		{
+			name:  "move",
+			line:  "g1x10.50 y-2 F100",
+			block: &Block{Words: []Word{{'G', 1}, {'X', 10.5}, {'Y', -2}, {'F', 100}}},
+			canon: "G1 X10.5 Y-2 F100",
+		},
+		{
+			name:  "leading zeros and decimal codes",
+			line:  "G01 G28.2 X0",
+			block: &Block{Words: []Word{{'G', 1}, {'G', 28.2}, {'X', 0}}},
+			canon: "G1 G28.2 X0",
+		},
+		{
+			name:  "spaces between letter and number",
+			line:  "G 0 X +.5",
+			block: &Block{Words: []Word{{'G', 0}, {'X', 0.5}}},
+			canon: "G0 X0.5",
+		},
+		{
+			name:  "comments",
+			line:  "(start) G0 X1 (go) ; rest of the line (ignored)",
+			block: &Block{Words: []Word{{'G', 0}, {'X', 1}}, Comments: []string{"start", "go", "rest of the line (ignored)"}},
+			canon: "G0 X1",
+		},
+		{
+			name:  "line number and block delete",
+			line:  "/N20 M3 S1000",
+			block: &Block{Delete: true, Line: 20, Words: []Word{{'M', 3}, {'S', 1000}}},
+			canon: "/ N20 M3 S1000",
+		},
+		{
+			name:  "valid checksum",
+			line:  "N3 T0*57",
+			block: &Block{Line: 3, Words: []Word{{'T', 0}}},
+			canon: "N3 T0",
+		},
+		{
+			name: "checksum mismatch",
+			line: "N3 T0*58",
+			err:  "col 6: checksum mismatch: 58, want: 57",
+		},
+		{
+			name: "malformed checksum",
+			line: "G0*x",
+			err:  `col 3: malformed checksum "x"`,
+		},
+		{
+			name: "unterminated comment",
+			line: "G0 (X1",
+			err:  "col 4: unterminated comment",
+		},
+		{
+			name: "nested comment",
+			line: "G0 (a (b) c)",
+			err:  "col 4: unterminated comment",
+		},
+		{
+			name: "line break after a comment",
+			line: "G0 X1 ;\n$xvm=1",
+			err:  "col 8: line break in a block",
+		},
+		{
+			name: "line break in a comment",
+			line: "G0 X1 (\nM3 S99999\n)",
+			err:  "col 8: line break in a block",
+		},
+		{
+			name: "carriage return",
+			line: "G0 X1\r",
+			err:  "col 6: line break in a block",
+		},
+		{
+			name: "missing number",
+			line: "G0 X",
+			err:  "col 4: missing number after X",
+		},
+		{
+			name: "malformed number",
+			line: "G1 X1.2.3",
+			err:  `col 5: malformed number "1.2.3"`,
+		},
+		{
+			name: "unsupported word",
+			line: "G0 E5",
+			err:  "col 4: unsupported word E",
+		},
+		{
+			name: "unexpected character",
+			line: "G0 X1 #5",
+			err:  "col 7: unexpected character '#'",
+		},
+		{
+			name: "repeated axis",
+			line: "G0 X1 X2",
+			err:  "col 7: repeated word X",
+		},
+		{
+			name: "line number not first",
+			line: "G0 N10",
+			err:  "col 4: line number must be the first word",
+		},
+		{
+			name: "fractional line number",
+			line: "N1.5 G0",
+			err:  "col 1: line number must be a non-negative integer",
+		},
+	}
+	for _, tt := range tests {
+		b, err := Parse(tt.line)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: Parse(%q) error: %v, want: %s", tt.name, tt.line, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Parse(%q): %v", tt.name, tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(b, tt.block) {
+			t.Errorf("%s: Parse(%q) = %+v, want: %+v", tt.name, tt.line, b, tt.block)
+		}
+		if got := b.String(); got != tt.canon {
+			t.Errorf("%s: String() = %q, want: %q", tt.name, got, tt.canon)
+		}
+	}
+}
+
+func TestWordCode(t *testing.T) {
+	for _, tt := range []struct {
+		w    Word
+		code int
+	}{
+		{Word{'G', 0}, 0},
+		{Word{'G', 1}, 10},
+		{Word{'G', 28.2}, 282},
+		{Word{'G', 92.1}, 921},
+		{Word{'M', 30}, 300},
+	} {
+		if got := tt.w.Code(); got != tt.code {
+			t.Errorf("%v.Code() = %d, want: %d", tt.w, got, tt.code)
+		}
+	}
+	if got := fmt.Sprint(Word{'G', 28.2}); got != "G28.2" {
+		t.Errorf("String() = %q, want: G28.2", got)
+	}
+}
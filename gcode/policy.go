@@ -0,0 +1,143 @@
+package gcode
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Policy is a whitelist of the g-code which may be sent to the machine.
+//
+// A policy is loaded from a json file like this:
+//
+//	{
+//	  "g": ["G0", "G1", "G2", "G3", "G17", "G21", "G90", "G91"],
+//	  "m": ["M3", "M5"],
+//	  "ranges": {"F": {"min": 1, "max": 3000}, "S": {"max": 12000}, "Z": {"min": -50}}
+//	}
+//
+// Only the listed G and M codes are allowed. The values of the words with ranges
+// must be within them, as written in the g-code, regardless of the units.
+type Policy struct {
+	g, m   map[int]bool
+	ranges map[byte]Range
+}
+
+// Range limits the value of a word. A missing limit is not checked.
+type Range struct {
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+}
+
+func (r Range) contains(v float64) bool {
+	return (r.Min == nil || v >= *r.Min) && (r.Max == nil || v <= *r.Max)
+}
+
+func (r Range) String() string {
+	switch {
+	case r.Min != nil && r.Max != nil:
+		return fmt.Sprintf("from %g to %g", *r.Min, *r.Max)
+	case r.Min != nil:
+		return fmt.Sprintf("at least %g", *r.Min)
+	case r.Max != nil:
+		return fmt.Sprintf("at most %g", *r.Max)
+	}
+	return "any"
+}
+
+// defaultCodes are the codes allowed, if no policy is configured: everything used by
+// the usual CAM output, but not the commands which change the machine setup or probe.
+var defaultCodes = []string{
+	"G0", "G1", "G2", "G3", "G4", "G17", "G18", "G19", "G20", "G21", "G28.2", "G40", "G49",
+	"G53", "G54", "G55", "G56", "G57", "G58", "G59", "G61", "G61.1", "G64", "G80",
+	"G90", "G91", "G92", "G92.1", "G94",
+	"M0", "M1", "M2", "M3", "M4", "M5", "M6", "M7", "M8", "M9", "M30",
+}
+
+// DefaultPolicy returns the policy used, if none is configured.
+func DefaultPolicy() *Policy {
+	p, err := newPolicy(defaultCodes, nil)
+	if err != nil {
+		// Can't happen, the default codes are valid.
+		panic(err)
+	}
+	return p
+}
+
+// ParsePolicy parses a policy from json.
+func ParsePolicy(data []byte) (*Policy, error) {
+	var f struct {
+		G      []string         `json:"g"`
+		M      []string         `json:"m"`
+		Ranges map[string]Range `json:"ranges"`
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, err
+	}
+	return newPolicy(append(f.G, f.M...), f.Ranges)
+}
+
+// LoadPolicy reads a policy from a json file.
+func LoadPolicy(name string) (*Policy, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	p, err := ParsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return p, nil
+}
+
+func newPolicy(codes []string, ranges map[string]Range) (*Policy, error) {
+	p := &Policy{g: make(map[int]bool), m: make(map[int]bool), ranges: make(map[byte]Range)}
+	for _, c := range codes {
+		b, err := Parse(c)
+		if err != nil || len(b.Words) != 1 || b.Line > 0 || (b.Words[0].Letter != 'G' && b.Words[0].Letter != 'M') {
+			return nil, fmt.Errorf("invalid code %q, want a single G or M code like G1 or M3", c)
+		}
+		w := b.Words[0]
+		if w.Letter == 'G' {
+			p.g[w.Code()] = true
+		} else {
+			p.m[w.Code()] = true
+		}
+	}
+	for k, r := range ranges {
+		letter := strings.ToUpper(k)
+		if len(letter) != 1 || !strings.Contains(letters, letter) || letter == "G" || letter == "M" {
+			return nil, fmt.Errorf("invalid range for %q, want a letter of a word like X or F", k)
+		}
+		if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+			return nil, fmt.Errorf("invalid range for %s: min %g is greater than max %g", letter, *r.Min, *r.Max)
+		}
+		p.ranges[letter[0]] = r
+	}
+	return p, nil
+}
+
+// Check returns an error, if the block is not allowed by the policy.
+// A nil policy allows everything.
+func (p *Policy) Check(b *Block) error {
+	if p == nil {
+		return nil
+	}
+	for _, w := range b.Words {
+		allowed := true
+		switch w.Letter {
+		case 'G':
+			allowed = p.g[w.Code()]
+		case 'M':
+			allowed = p.m[w.Code()]
+		}
+		if !allowed {
+			return &Error{Msg: fmt.Sprintf("%v is not allowed by the policy", w)}
+		}
+		if r, ok := p.ranges[w.Letter]; ok && !r.contains(w.Value) {
+			return &Error{Msg: fmt.Sprintf("%v is not allowed by the policy: %c must be %v", w, w.Letter, r)}
+		}
+	}
+	return nil
+}
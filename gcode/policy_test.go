@@ -0,0 +1,60 @@
+package gcode
+
+import "testing"
+
+func TestPolicy(t *testing.T) {
+	p, err := ParsePolicy([]byte(`{
+		"g": ["G0", "G1", "G28.2", "G90"],
+		"m": ["M3", "M5"],
+		"ranges": {"F": {"min": 1, "max": 3000}, "s": {"max": 12000}, "Z": {"min": -5}}
+	}`))
+	if err != nil {
+		t.Fatalf("ParsePolicy: %v", err)
+	}
+	tests := []struct {
+		line string
+		err  string
+	}{
+		{line: "G90 G1 X10 Z-5 F3000"},
+		{line: "G28.2 Z0"},
+		{line: "M3 S12000"},
+		{line: "(just a comment)"},
+		{line: "G2 X1 I1", err: "G2 is not allowed by the policy"},
+		{line: "G28.3 X0", err: "G28.3 is not allowed by the policy"},
+		{line: "M8", err: "M8 is not allowed by the policy"},
+		{line: "G1 X1 F3001", err: "F3001 is not allowed by the policy: F must be from 1 to 3000"},
+		{line: "M3 S20000", err: "S20000 is not allowed by the policy: S must be at most 12000"},
+		{line: "G0 Z-10", err: "Z-10 is not allowed by the policy: Z must be at least -5"},
+	}
+	for _, tt := range tests {
+		b, err := Parse(tt.line)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.line, err)
+		}
+		err = p.Check(b)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || err.Error() != tt.err) {
+			t.Errorf("Check(%q): %v, want: %q", tt.line, err, tt.err)
+		}
+	}
+
+	b, _ := Parse("G38.2 Z-10 F100")
+	if err := DefaultPolicy().Check(b); err == nil {
+		t.Errorf("DefaultPolicy allows probing, want: not allowed")
+	}
+	if err := (*Policy)(nil).Check(b); err != nil {
+		t.Errorf("nil policy: %v, want: everything allowed", err)
+	}
+
+	for _, bad := range []string{
+		`{"g": ["X1"]}`,
+		`{"g": ["G1 G2"]}`,
+		`{"ranges": {"G": {"min": 0}}}`,
+		`{"ranges": {"XY": {"min": 0}}}`,
+		`{"ranges": {"F": {"min": 10, "max": 1}}}`,
+		`{"g": "G1"}`,
+	} {
+		if _, err := ParsePolicy([]byte(bad)); err == nil {
+			t.Errorf("ParsePolicy(%s) succeeded, want: error", bad)
+		}
+	}
+}
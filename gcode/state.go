@@ -0,0 +1,413 @@
+package gcode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// Spindle is the state of the spindle.
+type Spindle int
+
+const (
+	SpindleOff Spindle = iota // M5
+	SpindleCW                 // M3
+	SpindleCCW                // M4
+)
+
+var spindleNames = []string{"M5", "M3", "M4"}
+
+func (s Spindle) String() string {
+	if s < 0 || int(s) >= len(spindleNames) {
+		return fmt.Sprintf("Unknown(%d)", int(s))
+	}
+	return spindleNames[s]
+}
+
+// State is the modal state of the machine, as defined by the g-code executed so far.
+type State struct {
+	Motion   tinyg.MotionMode
+	Plane    tinyg.Plane
+	Units    tinyg.Units
+	Distance tinyg.DistanceMode
+	Coord    tinyg.CoordSystem
+
+	// Feed is the feed rate in units per minute. It's 0, if not set yet.
+	Feed float64
+
+	Spindle Spindle
+
+	// Speed is the spindle speed (S).
+	Speed float64
+
+	// Tool is the selected tool (T).
+	Tool int
+
+	// Line is the last line number (N).
+	Line int
+
+	// Pos is the position at the end of the last move in machine coordinates.
+	Pos Point
+
+	// Offsets are the origins of the coordinate systems in machine coordinates,
+	// indexed by tinyg.CoordSystem.
+	Offsets [tinyg.G59 + 1]Point
+
+	// G92 is the origin offset set by G92.
+	G92 Point
+}
+
+// NewState returns the state after the reset of the machine with the default settings.
+// No motion mode is active, so that a stray axis word does not move the machine.
+// The machine is at the origin, and there are no offsets.
+func NewState() *State {
+	return &State{
+		Motion: tinyg.MotionCancel,
+		Plane:  tinyg.PlaneXY,
+		Units:  tinyg.Millimeters,
+		Coord:  tinyg.G54,
+	}
+}
+
+// Modal groups of G and M codes. Two codes of the same group can't be in one block.
+const (
+	groupNonModal = iota
+	groupMotion
+	groupPlane
+	groupDistance
+	groupFeedMode
+	groupUnits
+	groupCutterComp
+	groupToolLength
+	groupCoord
+	groupPath
+	groupStop
+	groupSpindle
+	groupCoolant
+	groupOverride
+	groupToolChange
+)
+
+// gGroups are the supported G codes with their modal groups. See Word.Code.
+var gGroups = map[int]int{
+	0: groupMotion, 10: groupMotion, 20: groupMotion, 30: groupMotion, 382: groupMotion, 800: groupMotion,
+	170: groupPlane, 180: groupPlane, 190: groupPlane,
+	900: groupDistance, 910: groupDistance,
+	930: groupFeedMode, 940: groupFeedMode,
+	200: groupUnits, 210: groupUnits,
+	400: groupCutterComp,
+	490: groupToolLength,
+	540: groupCoord, 550: groupCoord, 560: groupCoord, 570: groupCoord, 580: groupCoord, 590: groupCoord,
+	610: groupPath, 611: groupPath, 640: groupPath,
+	40: groupNonModal, 100: groupNonModal, 280: groupNonModal, 281: groupNonModal, 282: groupNonModal,
+	283: groupNonModal, 284: groupNonModal, 300: groupNonModal, 301: groupNonModal, 530: groupNonModal,
+	920: groupNonModal, 921: groupNonModal,
+}
+
+// mGroups are the supported M codes with their modal groups.
+var mGroups = map[int]int{
+	0: groupStop, 10: groupStop, 20: groupStop, 300: groupStop, 600: groupStop,
+	30: groupSpindle, 40: groupSpindle, 50: groupSpindle,
+	70: groupCoolant, 80: groupCoolant, 90: groupCoolant,
+	480: groupOverride, 490: groupOverride, 500: groupOverride,
+	60: groupToolChange,
+}
+
+// axisNonModal are the non-modal G codes, which use the axis words.
+var axisNonModal = map[int]bool{100: true, 280: true, 282: true, 283: true, 300: true, 920: true}
+
+// axes are the letters of the axis words.
+const axes = "XYZABC"
+
+// HasAxes returns true, if the block has any axis words.
+func (b *Block) HasAxes() bool {
+	for _, w := range b.Words {
+		if strings.IndexByte(axes, w.Letter) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// hasArcWords returns true, if the block has the center offsets (I, J, K) or the radius (R) of an arc.
+func (b *Block) hasArcWords() bool {
+	return b.Has('I') || b.Has('J') || b.Has('K') || b.Has('R')
+}
+
+// Moves returns true, if the block may move the machine: it has axis words, which are not
+// the arguments of a command which sets the coordinates, such as G92 or G10, or homes (G28.2).
+// The words of an arc count too: with G2 or G3, an arc without the axis words is a full circle.
+func (b *Block) Moves() bool {
+	if !b.HasAxes() && !b.hasArcWords() {
+		return false
+	}
+	for _, w := range b.Words {
+		if w.Letter != 'G' {
+			continue
+		}
+		switch w.Code() {
+		case 100, 282, 283, 920:
+			return false
+		}
+	}
+	return true
+}
+
+func codeName(letter byte, code int) string {
+	return Word{Letter: letter, Value: float64(code) / 10}.String()
+}
+
+// Apply checks the block against the state and updates the state.
+// If the block is invalid, the state is not changed.
+func (s *State) Apply(b *Block) error {
+	_, err := s.Next(b)
+	return err
+}
+
+// Next is like Apply, but it also returns the move made by the block, if any.
+// The position after G28 and G30 is not known, it's left at the intermediate point.
+// An arc with the center offsets, but without the axis words, is a full circle back to the current point.
+func (s *State) Next(b *Block) (*Move, error) {
+	fail := func(format string, args ...interface{}) error {
+		return &Error{Msg: fmt.Sprintf(format, args...)}
+	}
+	next := *s
+	if b.Line > 0 {
+		next.Line = b.Line
+	}
+
+	var nonModal []int
+	groups := func(letter byte, known map[int]int) (map[int]int, error) {
+		used := make(map[int]int)
+		for _, code := range b.Codes(letter) {
+			g, ok := known[code]
+			if !ok {
+				return nil, fail("unsupported %s", codeName(letter, code))
+			}
+			if g == groupNonModal {
+				nonModal = append(nonModal, code)
+				continue
+			}
+			if prev, ok := used[g]; ok {
+				return nil, fail("%s and %s can't be in the same block", codeName(letter, prev), codeName(letter, code))
+			}
+			used[g] = code
+		}
+		return used, nil
+	}
+	gUsed, err := groups('G', gGroups)
+	if err != nil {
+		return nil, err
+	}
+	mUsed, err := groups('M', mGroups)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonModal) > 1 {
+		return nil, fail("%s and %s can't be in the same block", codeName('G', nonModal[0]), codeName('G', nonModal[1]))
+	}
+
+	switch code, ok := gUsed[groupMotion]; {
+	case !ok:
+	case code == 382:
+		// Probing only lasts for the block.
+	case code == 800:
+		next.Motion = tinyg.MotionCancel
+	default:
+		next.Motion = tinyg.MotionMode(code / 10)
+	}
+	if code, ok := gUsed[groupPlane]; ok {
+		next.Plane = tinyg.Plane(code/10 - 17)
+	}
+	if code, ok := gUsed[groupDistance]; ok {
+		next.Distance = tinyg.DistanceMode(code/10 - 90)
+	}
+	if code, ok := gUsed[groupUnits]; ok {
+		next.Units = tinyg.Units(code/10 - 20)
+	}
+	if code, ok := gUsed[groupCoord]; ok {
+		next.Coord = tinyg.CoordSystem(code/10 - 53)
+	}
+	switch mUsed[groupSpindle] {
+	case 30:
+		next.Spindle = SpindleCW
+	case 40:
+		next.Spindle = SpindleCCW
+	case 50:
+		next.Spindle = SpindleOff
+	}
+	if code := mUsed[groupStop]; code == 20 || code == 300 {
+		// The end of the program stops the spindle.
+		next.Spindle = SpindleOff
+	}
+
+	if f, ok := b.Get('F'); ok {
+		if f <= 0 {
+			return nil, fail("feed rate must be positive")
+		}
+		next.Feed = f
+	}
+	if v, ok := b.Get('S'); ok {
+		if v < 0 {
+			return nil, fail("spindle speed must not be negative")
+		}
+		next.Speed = v
+	}
+	if v, ok := b.Get('T'); ok {
+		if v < 0 || v != math.Trunc(v) {
+			return nil, fail("tool must be a non-negative integer")
+		}
+		next.Tool = int(v)
+	}
+
+	var code int
+	if len(nonModal) > 0 {
+		code = nonModal[0]
+	}
+	switch code {
+	case 40:
+		if !b.Has('P') {
+			return nil, fail("G4 needs P, the time to dwell")
+		}
+	case 100:
+		if !b.Has('L') || !b.Has('P') {
+			return nil, fail("G10 needs L and P")
+		}
+	case 282:
+		if !b.HasAxes() {
+			return nil, fail("G28.2 needs the axes to home")
+		}
+	}
+
+	motion := next.Motion
+	if gUsed[groupMotion] == 382 {
+		// Probing moves at the feed rate.
+		motion = tinyg.StraightFeed
+	}
+	arc := motion == tinyg.ArcCW || motion == tinyg.ArcCCW
+	moves := b.HasAxes() || arc && code == 0 && b.hasArcWords()
+	if moves && !axisNonModal[code] {
+		switch {
+		case motion == tinyg.MotionCancel:
+			return nil, fail("axis words without a motion mode")
+		case motion != tinyg.StraightTraverse && next.Feed == 0:
+			return nil, fail("feed rate is not set")
+		case arc && !b.hasArcWords():
+			return nil, fail("arc needs I, J, K or R")
+		}
+	}
+
+	scale := 1.0
+	if next.Units == tinyg.Inches {
+		scale = mmPerInch
+	}
+	var mv *Move
+	switch code {
+	case 100:
+		p, _ := b.Get('P')
+		l, _ := b.Get('L')
+		if p < float64(tinyg.G54) || p > float64(tinyg.G59) || p != math.Trunc(p) {
+			return nil, fail("G10 P must be from 1 to 6")
+		}
+		origin := &next.Offsets[int(p)]
+		for i := range origin {
+			v, ok := b.Get(axes[i])
+			if !ok {
+				continue
+			}
+			switch l {
+			case 2:
+				origin[i] = v * scale
+			case 20:
+				origin[i] = next.Pos[i] - next.G92[i] - v*scale
+			default:
+				return nil, fail("G10 L must be 2 or 20")
+			}
+		}
+	case 282:
+		// Homing sets the position of the homed axes to zero.
+		for i := range next.Pos {
+			if b.Has(axes[i]) {
+				next.Pos[i] = 0
+			}
+		}
+	case 283:
+		for i := range next.Pos {
+			if v, ok := b.Get(axes[i]); ok {
+				next.Pos[i] = v * scale
+			}
+		}
+	case 920:
+		for i := range next.G92 {
+			if v, ok := b.Get(axes[i]); ok {
+				next.G92[i] = next.Pos[i] - next.Offsets[next.Coord][i] - v*scale
+			}
+		}
+	case 921:
+		next.G92 = Point{}
+	}
+
+	if moves && (!axisNonModal[code] || code == 280 || code == 300) {
+		mv = &Move{From: next.Pos, To: next.Pos, Plane: next.Plane}
+		for i := range mv.To {
+			v, ok := b.Get(axes[i])
+			if !ok {
+				continue
+			}
+			switch {
+			case code == 530:
+				mv.To[i] = v * scale
+			case next.Distance == tinyg.Incremental:
+				mv.To[i] += v * scale
+			default:
+				mv.To[i] = v*scale + next.Offsets[next.Coord][i] + next.G92[i]
+			}
+		}
+		if arc {
+			mv.Arc, mv.CW = true, motion == tinyg.ArcCW
+			if mv.Center, err = arcCenter(b, mv, scale); err != nil {
+				return nil, err
+			}
+		}
+		next.Pos = mv.To
+	}
+
+	*s = next
+	return mv, nil
+}
+
+// Program parses a whole program and checks it against the policy and the state, which is updated.
+// A nil policy allows everything. It returns the canonical form of the lines, one per input line, so that the line numbers
+// don't change. Lines without words, such as comments and the % program delimiters, are empty.
+func Program(r io.Reader, st *State, p *Policy) ([]string, error) {
+	var lines []string
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "%" {
+			lines = append(lines, "")
+			continue
+		}
+		b, err := Parse(text)
+		if err == nil {
+			err = p.Check(b)
+		}
+		if err == nil {
+			err = st.Apply(b)
+		}
+		if err != nil {
+			e := err.(*Error)
+			e.Line = n
+			return nil, e
+		}
+		lines = append(lines, b.String())
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
@@ -0,0 +1,286 @@
+package gcode
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  func(st *State) bool
+		err   string
+	}{
+		{
+			name:  "modal state",
+			lines: []string{"G20 G91 G55 G18", "G1 X1 F10", "M4 S2000 T3", "N42 G2 X0 I1"},
+			want: func(st *State) bool {
+				return st.Units == tinyg.Inches && st.Distance == tinyg.Incremental && st.Coord == tinyg.G55 &&
+					st.Plane == tinyg.PlaneXZ && st.Motion == tinyg.ArcCW && st.Feed == 10 &&
+					st.Spindle == SpindleCCW && st.Speed == 2000 && st.Tool == 3 && st.Line == 42
+			},
+		},
+		{
+			name:  "motion mode persists",
+			lines: []string{"G0 X1", "X2 Y2"},
+			want:  func(st *State) bool { return st.Motion == tinyg.StraightTraverse },
+		},
+		{
+			name:  "program end stops the spindle",
+			lines: []string{"M3 S1000", "M30"},
+			want:  func(st *State) bool { return st.Spindle == SpindleOff },
+		},
+		{
+			name:  "non-modal commands with axes",
+			lines: []string{"G92 X0 Y0", "G28.2 Z0", "G10 L2 P1 X5"},
+			want:  func(st *State) bool { return st.Motion == tinyg.MotionCancel },
+		},
+		{
+			name:  "axis words without motion mode",
+			lines: []string{"X10"},
+			err:   "axis words without a motion mode",
+		},
+		{
+			name:  "cancelled motion mode",
+			lines: []string{"G0 X1", "G80", "Y1"},
+			err:   "axis words without a motion mode",
+		},
+		{
+			name:  "feed rate not set",
+			lines: []string{"G1 X10"},
+			err:   "feed rate is not set",
+		},
+		{
+			name:  "zero feed rate",
+			lines: []string{"G1 X10 F0"},
+			err:   "feed rate must be positive",
+		},
+		{
+			name:  "arc without center",
+			lines: []string{"G2 X10 F100"},
+			err:   "arc needs I, J, K or R",
+		},
+		{
+			name:  "same modal group",
+			lines: []string{"G0 G1 X1"},
+			err:   "G0 and G1 can't be in the same block",
+		},
+		{
+			name:  "two non-modal commands",
+			lines: []string{"G4 G92 P1"},
+			err:   "G4 and G92 can't be in the same block",
+		},
+		{
+			name:  "unsupported G code",
+			lines: []string{"G41"},
+			err:   "unsupported G41",
+		},
+		{
+			name:  "unsupported M code",
+			lines: []string{"M100"},
+			err:   "unsupported M100",
+		},
+		{
+			name:  "dwell without time",
+			lines: []string{"G4"},
+			err:   "G4 needs P, the time to dwell",
+		},
+		{
+			name:  "homing without axes",
+			lines: []string{"G28.2"},
+			err:   "G28.2 needs the axes to home",
+		},
+	}
+	for _, tt := range tests {
+		st := NewState()
+		var err error
+		for _, line := range tt.lines {
+			var b *Block
+			if b, err = Parse(line); err != nil {
+				t.Fatalf("%s: Parse(%q): %v", tt.name, line, err)
+			}
+			before := *st
+			if err = st.Apply(b); err != nil {
+				if *st != before {
+					t.Errorf("%s: Apply(%q) failed, but changed the state: %+v, was: %+v", tt.name, line, *st, before)
+				}
+				break
+			}
+		}
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: error: %v, want: %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.want(st) {
+			t.Errorf("%s: unexpected state: %+v", tt.name, *st)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	tests := []struct {
+		name     string
+		lines    []string
+		from, to Point
+		arc      bool
+		pos      Point
+	}{
+		{
+			name:  "absolute move",
+			lines: []string{"G0 X10 Y20"},
+			to:    Point{10, 20, 0},
+		},
+		{
+			name:  "incremental move",
+			lines: []string{"G0 X10", "G91 X-3 Z-1"},
+			from:  Point{10, 0, 0},
+			to:    Point{7, 0, -1},
+		},
+		{
+			name:  "inches",
+			lines: []string{"G20 G0 X1"},
+			to:    Point{25.4, 0, 0},
+		},
+		{
+			name:  "coordinate system",
+			lines: []string{"G10 L2 P2 X100 Y50", "G55 G0 X1 Y1"},
+			to:    Point{101, 51, 0},
+		},
+		{
+			name:  "coordinate system set from the position",
+			lines: []string{"G0 X30", "G10 L20 P1 X0", "G0 X5"},
+			from:  Point{30, 0, 0},
+			to:    Point{35, 0, 0},
+		},
+		{
+			name:  "G92 offset",
+			lines: []string{"G0 X40", "G92 X0", "X-10"},
+			from:  Point{40, 0, 0},
+			to:    Point{30, 0, 0},
+		},
+		{
+			name:  "G92 offset cancelled",
+			lines: []string{"G0 X40", "G92 X0", "G92.1", "X-10"},
+			from:  Point{40, 0, 0},
+			to:    Point{-10, 0, 0},
+		},
+		{
+			name:  "machine coordinates",
+			lines: []string{"G10 L2 P1 Z-20", "G53 G0 Z-1"},
+			to:    Point{0, 0, -1},
+		},
+		{
+			name:  "arc",
+			lines: []string{"G2 X10 I5 F100"},
+			to:    Point{10, 0, 0},
+			arc:   true,
+		},
+		{
+			name:  "full circle",
+			lines: []string{"G0 X10", "G2 I-5 F100"},
+			from:  Point{10, 0, 0},
+			to:    Point{10, 0, 0},
+			arc:   true,
+		},
+		{
+			name:  "homing",
+			lines: []string{"G0 X10 Y10", "G28.2 X0"},
+			pos:   Point{0, 10, 0},
+		},
+		{
+			name:  "position set",
+			lines: []string{"G28.3 X5 Z-2"},
+			pos:   Point{5, 0, -2},
+		},
+	}
+	for _, tt := range tests {
+		st := NewState()
+		var mv *Move
+		for _, line := range tt.lines {
+			b, err := Parse(line)
+			if err != nil {
+				t.Fatalf("%s: Parse(%q): %v", tt.name, line, err)
+			}
+			if mv, err = st.Next(b); err != nil {
+				t.Fatalf("%s: Next(%q): %v", tt.name, line, err)
+			}
+		}
+		if tt.to == (Point{}) {
+			if mv != nil {
+				t.Errorf("%s: unexpected move: %+v", tt.name, mv)
+			}
+			if st.Pos != tt.pos {
+				t.Errorf("%s: position: %v, want: %v", tt.name, st.Pos, tt.pos)
+			}
+			continue
+		}
+		if mv == nil {
+			t.Errorf("%s: no move", tt.name)
+			continue
+		}
+		if mv.From != tt.from || mv.To != tt.to || mv.Arc != tt.arc {
+			t.Errorf("%s: move: %+v, want: from %v to %v", tt.name, mv, tt.from, tt.to)
+		}
+		if st.Pos != mv.To {
+			t.Errorf("%s: position: %v, want: %v", tt.name, st.Pos, mv.To)
+		}
+	}
+}
+
+func TestMoves(t *testing.T) {
+	for _, tt := range []struct {
+		line  string
+		moves bool
+	}{
+		{"G0 X1", true},
+		{"Y2", true},
+		{"G91 G1 Z-1 F100", true},
+		{"G28 Z5", true},
+		{"G28.2 X0 Y0", false},
+		{"G28.3 X0", false},
+		{"G92 X0", false},
+		{"G10 L20 P1 X0", false},
+		{"M3 S1000", false},
+		{"G4 P1", false},
+		{"G2 I-50 J0", true},
+		{"R5", true},
+	} {
+		b, err := Parse(tt.line)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tt.line, err)
+		}
+		if got := b.Moves(); got != tt.moves {
+			t.Errorf("Moves(%q) = %v, want: %v", tt.line, got, tt.moves)
+		}
+	}
+}
+
+func TestProgram(t *testing.T) {
+	prog := "%\n(engrave)\nG21 G90\ng0 x0 y0\n\nG1 Z-1 F100 ; plunge\n%\n"
+	lines, err := Program(strings.NewReader(prog), NewState(), nil)
+	if err != nil {
+		t.Fatalf("Program: %v", err)
+	}
+	want := []string{"", "", "G21 G90", "G0 X0 Y0", "", "G1 Z-1 F100", ""}
+	if strings.Join(lines, "|") != strings.Join(want, "|") {
+		t.Errorf("Program: %q, want: %q", lines, want)
+	}
+
+	_, err = Program(strings.NewReader("G21\nG1 X1\n"), NewState(), nil)
+	if err == nil || err.Error() != "line 2: feed rate is not set" {
+		t.Errorf("Program: %v, want: line 2: feed rate is not set", err)
+	}
+	_, err = Program(strings.NewReader("G21\n\nG0 X(\n"), NewState(), nil)
+	if err == nil || err.Error() != "line 3: col 4: missing number after X" {
+		t.Errorf("Program: %v, want: line 3: col 4: missing number after X", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/tinyg"
+)
+
+// queryTimeout is the maximum time to wait for the machine to answer a config query.
+const queryTimeout = 10 * time.Second
+
+// runCommand runs a command given on the command line instead of the interactive session:
+//
+//	config save <file>: save the configuration of the machine to a json file
+//	config diff <file>: show the difference between the saved configuration and the machine
+//	config load <file>: apply the saved configuration to the machine
+func runCommand(m engine.Machine, args []string) error {
+	if len(args) == 3 && args[0] == "config" {
+		switch args[1] {
+		case "save":
+			return saveConfig(m, args[2])
+		case "diff":
+			return loadConfig(os.Stdout, m, args[2], true)
+		case "load":
+			return loadConfig(os.Stdout, m, args[2], false)
+		}
+	}
+	return fmt.Errorf("unknown command %q, want: probe, or config save|diff|load <file>", strings.Join(args, " "))
+}
+
+// query returns a function, which sends json commands to the machine and waits for the responses.
+func query(m engine.Machine) tinyg.Query {
+	return func(cmd string) (*tinyg.Response, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), queryTimeout)
+		defer cancel()
+		return m.Do(ctx, cmd)
+	}
+}
+
+// saveConfig reads the configuration of the machine and saves it to a json file.
+func saveConfig(m engine.Machine, name string) error {
+	c, err := tinyg.ReadConfig(query(m))
+	if err != nil {
+		return err
+	}
+	if err := c.Save(name); err != nil {
+		return err
+	}
+	log.Printf("Saved the configuration (groups %s) to %s", strings.Join(c.Groups(), ", "), name)
+	return nil
+}
+
+// loadConfig shows the difference between the saved configuration and the machine.
+// Unless dryRun is true, it sends the changed settings to the machine and verifies them.
+func loadConfig(w io.Writer, m engine.Machine, name string, dryRun bool) error {
+	saved, err := tinyg.LoadConfig(name)
+	if err != nil {
+		return err
+	}
+	live, err := tinyg.ReadConfig(query(m))
+	if err != nil {
+		return err
+	}
+	if saved.Build != live.Build {
+		log.Printf("Warning: %s was saved from the firmware build %.2f, the machine has %.2f", name, saved.Build, live.Build)
+	}
+	changes := saved.Diff(live)
+	if len(changes) == 0 {
+		fmt.Fprintln(w, "The configuration of the machine is up to date")
+		return nil
+	}
+	fmt.Fprintf(w, "%d settings differ:\n", len(changes))
+	for _, ch := range changes {
+		fmt.Fprintln(w, "  ", ch)
+	}
+	if dryRun {
+		return nil
+	}
+	if err := tinyg.Apply(query(m), changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Applied and verified %d settings\n", len(changes))
+	return nil
+}
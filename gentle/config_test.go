@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/tinyg"
+	"github.com/samofly/gentle/tinyg/sim"
+)
+
+func TestConfig(t *testing.T) {
+	dev := sim.New()
+	defer dev.Close()
+	m := engine.New(dev, true)
+
+	dir, err := ioutil.TempDir("", "gentle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "tinyg.json")
+	if err := runCommand(m, []string{"config", "save", name}); err != nil {
+		t.Fatalf("config save: %v", err)
+	}
+	c, err := tinyg.LoadConfig(name)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if c.Build != 440.20 || len(c.Motors) != 4 || len(c.Axes) != 4 || c.Axes["x"]["vm"] != 16000.0 || c.Sys["id"] != "3X3566-YMX" {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+
+	c.Axes["x"]["vm"] = 12000.0
+	c.Axes["y"]["xx"] = 1.0
+	if err := c.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := loadConfig(&out, m, name, true); err != nil {
+		t.Fatalf("config diff: %v", err)
+	}
+	if want := "2 settings differ:\n   xvm: 16000 -> 12000\n   yxx: (missing) -> 1\n"; out.String() != want {
+		t.Errorf("config diff:\n%s\nwant:\n%s", out.String(), want)
+	}
+	out.Reset()
+	err = loadConfig(&out, m, name, false)
+	if e, ok := err.(*tinyg.ConfigError); !ok || len(e.Rejected) != 1 || e.Rejected["yxx"] == nil || len(e.Unchanged) != 0 {
+		t.Errorf("config load: %v, want: yxx rejected", err)
+	}
+	delete(c.Axes["y"], "xx")
+	if err := c.Save(name); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := loadConfig(&out, m, name, false); err != nil || out.String() != "The configuration of the machine is up to date\n" {
+		t.Errorf("config load after xvm is applied: %q, %v, want: up to date", out.String(), err)
+	}
+
+	if err := runCommand(m, []string{"config", "save"}); err == nil {
+		t.Errorf("config save without a file: nil error, want: unknown command")
+	}
+}
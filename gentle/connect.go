@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/tinyg/sim"
+	"github.com/samofly/serial"
+)
+
+// simPrefix is the prefix of a simulated device name. It may be followed by the speed of the simulation.
+const simPrefix = "sim:"
+
+// devPath returns the path of the device. The ports may be given without /dev/, like ttyUSB0.
+func devPath(dev string) string {
+	if strings.HasPrefix(dev, simPrefix) || strings.Contains(dev, "/") {
+		return dev
+	}
+	return "/dev/" + dev
+}
+
+// openDev opens the serial device or starts a simulated one.
+func openDev(dev string, baud int) (io.ReadWriter, error) {
+	if strings.HasPrefix(dev, simPrefix) {
+		d := sim.New()
+		if speed := strings.TrimPrefix(dev, simPrefix); speed != "" {
+			f, err := strconv.ParseFloat(speed, 64)
+			if err != nil || f <= 0 {
+				d.Close()
+				return nil, fmt.Errorf("invalid speed of the simulation: %q", speed)
+			}
+			d.SetSpeed(f)
+		}
+		log.Print("Simulated TinyG started")
+		return d, nil
+	}
+	s, err := serial.Open(dev, baud)
+	if err != nil {
+		return nil, fmt.Errorf("could not open serial port at %s: %v", dev, err)
+	}
+	log.Print("Port opened at ", dev)
+	return s, nil
+}
+
+// connect connects the switch to the device, replacing the machine connected before.
+// The device is opened in the background, and reopened, if the connection is lost.
+// If dev is empty, the serial ports are probed, and the first TinyG found is connected at its baud rate.
+func connect(sw *engine.Switch, dev string, baud int) error {
+	if dev == "" {
+		// The connected port must be free to be probed.
+		sw.Disconnect()
+		found := probe()
+		if len(found) == 0 {
+			return fmt.Errorf("no TinyG found at the serial ports, specify the device")
+		}
+		dev, baud = found[0].Dev, found[0].Baud
+	}
+	if baud <= 0 {
+		return fmt.Errorf("invalid baud rate %d", baud)
+	}
+	dev = devPath(dev)
+	sw.Connect(dev, func() (io.ReadWriter, error) {
+		return openDev(dev, baud)
+	})
+	return nil
+}
+
+// switchCmd handles the commands of the terminal, which connect and disconnect the machine:
+// $ports lists the serial ports, $connect [dev [baud]] connects to the device or the TinyG found
+// by the probe, and $disconnect disconnects the machine. It returns false, if cmd is not such a command.
+func switchCmd(w io.Writer, sw *engine.Switch, cmd string) bool {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[0] {
+	case "$ports":
+		ports := listPorts()
+		if len(ports) == 0 {
+			fmt.Fprintln(w, "No serial ports found")
+		}
+		for _, p := range ports {
+			fmt.Fprintln(w, p)
+		}
+	case "$connect":
+		if len(fields) > 3 {
+			fmt.Fprintln(w, "Usage: $connect [dev [baud]]")
+			return true
+		}
+		dev, baud := "", *baudRate
+		if len(fields) >= 2 {
+			dev = fields[1]
+		}
+		if len(fields) == 3 {
+			var err error
+			if baud, err = strconv.Atoi(fields[2]); err != nil {
+				fmt.Fprintf(w, "Invalid baud rate %q\n", fields[2])
+				return true
+			}
+		}
+		if err := connect(sw, dev, baud); err != nil {
+			fmt.Fprintln(w, err)
+		}
+	case "$disconnect":
+		sw.Disconnect()
+	default:
+		return false
+	}
+	return true
+}
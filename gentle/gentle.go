@@ -4,7 +4,9 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,52 +14,127 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"golang.org/x/net/websocket"
 
 	"github.com/samofly/gentle/engine"
-	"github.com/samofly/serial"
+	"github.com/samofly/gentle/gcode"
 )
 
 var (
-	ttyDev   = flag.String("dev", "/dev/ttyUSB0", "Serial device to open")
+	ttyDev   = flag.String("dev", "", "Serial device to open on start, like /dev/ttyUSB0. Use sim: or sim:<speed> for a simulated TinyG. If empty, the serial ports are probed for TinyG")
 	baudRate = flag.Int("rate", 115200, "Baud rate")
 	jsonMode = flag.Bool("json", true, "Whether to use TinyG json protocol. If false, just send raw gcode")
 	web      = flag.Bool("web", false, "Whether to start a web interface")
 	port     = flag.Int("port", 9000, "HTTP port (only used with if -web is active)")
+	play     = flag.String("play", "", "G-code file to stream to the machine on start")
+	policy   = flag.String("policy", "", "JSON file with the whitelist of G and M codes and the ranges of the values. If empty, the default whitelist is used")
+	strict   = flag.Bool("strict", false, "Refuse g-code, if the firmware of the machine is not supported. Otherwise, only warn")
+	homing   = flag.Bool("homing", false, "Refuse motion commands until the axes are homed (json mode only). Use $override to move anyway")
+	stage    = flag.String("staging", "", "Directory with the g-code programs, which are uploaded, listed and played by the clients. If empty, there's no staging directory")
+	envelope = flag.String("envelope", "", "Working envelope in machine coordinates, mm, like x=0:300,y=0:200,z=-80:0. Moves which leave it are refused. Axes not listed are not limited")
+	accounts = flag.String("users", "", "JSON file with the user accounts. If set, the web interface needs a login, and the commands are allowed by the role of the user. Add the users with $useradd")
 )
 
-// sanitizeG handle Gnn commands. cmd is upper-case, trimmed and starts with 'G'
-func sanitizeG(cmd string) (string, error) {
-	return cmd, nil
+// parseEnvelope parses the -envelope flag.
+func parseEnvelope(s string) (*engine.Envelope, error) {
+	env := engine.NoLimits()
+	for _, part := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		i := strings.Index("xyz", strings.ToLower(kv[0]))
+		if len(kv) != 2 || len(kv[0]) != 1 || i < 0 {
+			return nil, fmt.Errorf("invalid envelope %q, want axis=min:max, like x=0:300", part)
+		}
+		r := strings.SplitN(kv[1], ":", 2)
+		if len(r) != 2 {
+			return nil, fmt.Errorf("invalid range of %s: %q, want min:max, like 0:300", kv[0], kv[1])
+		}
+		min, err1 := strconv.ParseFloat(r[0], 64)
+		max, err2 := strconv.ParseFloat(r[1], 64)
+		if err1 != nil || err2 != nil || min > max {
+			return nil, fmt.Errorf("invalid range of %s: %q, want min:max, like 0:300", kv[0], kv[1])
+		}
+		env.Min[i], env.Max[i] = min, max
+	}
+	return env, nil
 }
 
-// sanitizeCmd checks gcode command and returns a canonically-formatted gcode without comments.
-func sanitizeCmd(cmd string) (string, error) {
-	cmd = strings.ToUpper(strings.TrimSpace(cmd))
-	if cmd == "" {
-		return "", nil
+// sanitizeCmd checks a g-code line against the policy and returns it canonically formatted, without comments.
+// The modal state is not checked here: the web, the jobs and the jogs change it too, so the machine checks it.
+func sanitizeCmd(pol *gcode.Policy, cmd string) (string, error) {
+	b, err := gcode.Parse(cmd)
+	if err != nil {
+		return "", err
 	}
+	if err := pol.Check(b); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
 
-	// TODO(krasin): implement a proper gcode parser.
-	switch cmd[0] {
-	case 'G':
-		return sanitizeG(cmd)
-	case 'F':
-		return cmd, nil
-	case 'M':
-		return cmd, nil
-	default:
-		return "", fmt.Errorf("sanitizeCmd(%q): %q command not recognized", cmd, cmd[0])
+// checkRaw checks a command from a web client against the policy and returns the command to send.
+// The command is either a g-code line, or a json command for TinyG. Only g-code is checked, the json commands
+// which are not g-code, such as config and queries, are allowed. The g-code is sent as it's checked:
+// canonically formatted, without comments. A command must be a single line, the machine would run
+// the next one unchecked.
+func checkRaw(pol *gcode.Policy, raw string) (string, error) {
+	if strings.ContainsAny(raw, "\r\n") {
+		return "", fmt.Errorf("the command must be a single line")
+	}
+	if !strings.HasPrefix(strings.TrimSpace(raw), "{") {
+		return sanitizeCmd(pol, raw)
+	}
+	var cmd map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(raw), &cmd); err != nil {
+		return "", fmt.Errorf("malformed json command: %v", err)
+	}
+	gc, ok := cmd["gc"]
+	if !ok {
+		return raw, nil
+	}
+	var line string
+	if err := json.Unmarshal(gc, &line); err != nil {
+		return "", fmt.Errorf("malformed json command: %v", err)
+	}
+	line, err := sanitizeCmd(pol, line)
+	if err != nil {
+		return "", err
+	}
+	if cmd["gc"], err = json.Marshal(line); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return "", err
 	}
+	return string(data), nil
+}
 
-	return cmd, nil
+// reject tells the client that the command has not been sent to the machine.
+func reject(w io.Writer, cmd string, reason error) {
+	data, err := json.Marshal(&engine.Message{Error: &engine.Error{Kind: engine.RejectedError, Msg: reason.Error(), Line: cmd}})
+	if err != nil {
+		log.Printf("Error: failed to marshal json for a rejection of %q, err: %v", cmd, err)
+		return
+	}
+	if _, err := w.Write(data); err != nil {
+		log.Print("Error: failed to deliver message, err: ", err)
+	}
 }
 
 type server struct {
-	m engine.Machine
+	m        engine.Machine
+	policy   *gcode.Policy
+	jsonMode bool
+
+	// files is the staging directory, if any.
+	files *staging
+
+	// users are the user accounts. If nil, there's no login, and everyone may do everything.
+	users *users
 }
 
 func downstream(w io.Writer, ch <-chan *engine.Message) {
@@ -74,37 +151,61 @@ func downstream(w io.Writer, ch <-chan *engine.Message) {
 	}
 }
 
-type webRequest struct {
-	Raw string `json:"raw"`
-}
-
 func (s *server) Serve(ws *websocket.Conn) {
 	defer log.Printf("Connection closed.")
 	defer ws.Close()
 
 	go downstream(ws, s.m.Sub())
 
+	c := newClient(s, ws, sessionToken(ws.Request()))
+	defer c.close()
+
 	in := bufio.NewScanner(ws)
 	var js jsonSplitter
 	in.Split(js.Split)
 	for in.Scan() {
 		log.Printf("incoming json message: %s", in.Text())
-		var req webRequest
+		var req request
 		if err := json.Unmarshal(in.Bytes(), &req); err != nil {
 			log.Printf("Failed to unmarshal incoming request: %v, err: %v", in.Bytes(), err)
 			return
 		}
-		if req.Raw == "" {
-			log.Printf("Only raw messages are currently supported")
+		if req.Cmd == "" && req.Raw != "" {
+			c.handleRaw(req.Raw)
 			continue
 		}
-		s.m.Send(req.Raw)
+		c.handle(&req)
 	}
 	if err := in.Err(); err != nil {
 		log.Printf("Error while reading from connection with %v: %v", ws.RemoteAddr(), err)
 	}
 }
 
+// serveRaw handles a command of the old protocol.
+func (s *server) serveRaw(w io.Writer, raw string) {
+	if control(rawErrors{w: w, cmd: raw}, s.m, s.m.Job(), raw) {
+		return
+	}
+	cmd, err := checkRaw(s.policy, raw)
+	if err != nil {
+		log.Printf("Rejected %q: %v", raw, err)
+		reject(w, raw, err)
+		return
+	}
+	s.m.Send(cmd)
+}
+
+// rawErrors passes the errors of a control command of the old protocol to the client as rejections.
+type rawErrors struct {
+	w   io.Writer
+	cmd string
+}
+
+func (r rawErrors) Write(p []byte) (int, error) {
+	reject(r.w, r.cmd, errors.New(strings.TrimSpace(string(p))))
+	return len(p), nil
+}
+
 func handleEmbed(w http.ResponseWriter, req *http.Request) {
 	p := path.Clean(req.URL.Path)
 
@@ -124,11 +225,31 @@ func handleEmbed(w http.ResponseWriter, req *http.Request) {
 	http.ServeContent(w, req, p, time.Time{}, bytes.NewReader(data))
 }
 
-func runWeb(port int, m engine.Machine) {
-	s := &server{m: m}
-	http.Handle("/ws", websocket.Handler(s.Serve))
-	http.HandleFunc("/", handleEmbed)
-	err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+// mux returns the handler of the web interface.
+func (s *server) mux() *http.ServeMux {
+	mux := http.NewServeMux()
+	var ws http.Handler = websocket.Handler(s.Serve)
+	if s.users != nil {
+		// The session is checked before the upgrade, the commands are checked against the role of the user.
+		ws = s.users.require(viewer, viewer, ws)
+		mux.HandleFunc("/login", s.users.handleLogin)
+		mux.HandleFunc("/logout", s.users.handleLogout)
+	}
+	mux.Handle("/ws", ws)
+	if s.files != nil {
+		var h http.Handler = s.files
+		if s.users != nil {
+			h = s.users.require(viewer, operator, s.files)
+		}
+		mux.Handle("/files", h)
+	}
+	mux.HandleFunc("/", handleEmbed)
+	return mux
+}
+
+func runWeb(port int, m engine.Machine, pol *gcode.Policy, files *staging, u *users) {
+	s := &server{m: m, policy: pol, jsonMode: *jsonMode, files: files, users: u}
+	err := http.ListenAndServe(fmt.Sprintf(":%d", port), s.mux())
 	if err != nil {
 		panic("ListenAndServe: " + err.Error())
 	}
@@ -137,6 +258,15 @@ func runWeb(port int, m engine.Machine) {
 func print(w io.Writer, ch <-chan *engine.Message) {
 	for msg := range ch {
 		str := msg.Raw
+		if msg.Error != nil {
+			str = "Error: " + msg.Error.Error()
+		}
+		if msg.Control != nil {
+			str = "Web: " + msg.Control.String()
+		}
+		if msg.Alarm != nil && msg.Alarm.Active {
+			str = fmt.Sprintf("ALARM: %s (status %d). Use $clear to clear it.", msg.Alarm.Msg, msg.Alarm.Status)
+		}
 		if str == "" {
 			data, err := json.Marshal(msg)
 			if err != nil {
@@ -155,49 +285,296 @@ func print(w io.Writer, ch <-chan *engine.Message) {
 	}
 }
 
+// control handles the commands which control the machine instead of being sent to it:
+// feedhold (!), cycle start (~), queue flush (%), alarm clear ($clear), homing ($home xyz),
+// the override of the homing interlock ($override on|off), the jog ($jog <axis> <step> [feed])
+// the work offsets ($offset <g92|g54..g59> <axes> [value] or $offset <g92|g54..g59> reset),
+// the spindle ($spindle <rpm> [ccw] or $spindle off) and the coolant ($coolant mist|flood|both|off).
+// If the job is active, the real-time commands pause, resume or cancel it.
+// The errors are written to w. It returns false, if cmd is not a control command.
+func control(w io.Writer, m engine.Machine, job *engine.Job, cmd string) bool {
+	if job != nil {
+		if st := job.Progress().State; st != engine.JobRunning && st != engine.JobPaused {
+			job = nil
+		}
+	}
+	fields := strings.Fields(cmd)
+	if len(fields) == 2 {
+		switch fields[0] {
+		case "$home":
+			if err := m.Home(fields[1]); err != nil {
+				fmt.Fprintln(w, err)
+			}
+			return true
+		case "$override":
+			m.OverrideHoming(fields[1] == "on")
+			return true
+		}
+	}
+	if len(fields) >= 3 && len(fields) <= 4 && fields[0] == "$jog" {
+		var step, feed float64
+		var err error
+		if step, err = strconv.ParseFloat(fields[2], 64); err == nil && len(fields) == 4 {
+			feed, err = strconv.ParseFloat(fields[3], 64)
+		}
+		if err == nil {
+			err = m.Jog(fields[1], step, feed)
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+		}
+		return true
+	}
+	if len(fields) >= 3 && len(fields) <= 4 && fields[0] == "$offset" {
+		var err error
+		switch {
+		case fields[2] == "reset" && len(fields) == 3:
+			err = m.ResetOffset(fields[1])
+		case len(fields) == 3:
+			err = m.SetOffset(fields[1], fields[2], 0)
+		default:
+			var v float64
+			if v, err = strconv.ParseFloat(fields[3], 64); err == nil {
+				err = m.SetOffset(fields[1], fields[2], v)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+		}
+		return true
+	}
+	if len(fields) >= 2 && len(fields) <= 3 && fields[0] == "$spindle" {
+		var sp engine.Spindle
+		var err error
+		if fields[1] != "off" {
+			sp.On, sp.CCW = true, len(fields) == 3 && fields[2] == "ccw"
+			sp.Speed, err = strconv.ParseFloat(fields[1], 64)
+			if err == nil && len(fields) == 3 && !sp.CCW {
+				err = fmt.Errorf("invalid spindle direction %q, want ccw", fields[2])
+			}
+		}
+		if err == nil {
+			err = m.SetSpindle(sp)
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+		}
+		return true
+	}
+	if len(fields) == 2 && fields[0] == "$coolant" {
+		c, ok := map[string]engine.Coolant{
+			"off":   {},
+			"mist":  {Mist: true},
+			"flood": {Flood: true},
+			"both":  {Mist: true, Flood: true},
+		}[fields[1]]
+		err := fmt.Errorf("invalid coolant %q, want mist, flood, both or off", fields[1])
+		if ok {
+			err = m.SetCoolant(c)
+		}
+		if err != nil {
+			fmt.Fprintln(w, err)
+		}
+		return true
+	}
+	switch strings.TrimSpace(cmd) {
+	case "!":
+		if job != nil {
+			job.Pause()
+		} else {
+			m.Hold()
+		}
+	case "~":
+		if job != nil {
+			job.Resume()
+		} else {
+			m.Resume()
+		}
+	case "%":
+		if job != nil {
+			job.Cancel()
+		} else {
+			m.Flush()
+		}
+	case "$clear", "$clr":
+		if err := m.ClearAlarm(); err != nil {
+			fmt.Fprintln(w, err)
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// playFile checks the g-code program against the policy and streams it to the machine.
+func playFile(m engine.Machine, pol *gcode.Policy, name string) (*engine.Job, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lines, err := gcode.Program(f, gcode.NewState(), pol)
+	if err != nil {
+		return nil, err
+	}
+	return m.Run(path.Base(name), strings.NewReader(strings.Join(lines, "\n")))
+}
+
+// watchJob waits for the job to finish and logs, if it fails.
+func watchJob(name string, job *engine.Job) {
+	if err := job.Wait(); err != nil {
+		log.Printf("Job %s: %v", name, err)
+	}
+}
+
+// cmdTimeout is the maximum time to wait for the machine to acknowledge a command entered by the operator.
+const cmdTimeout = time.Minute
+
+// execLines sends the commands to the machine one by one and reports the commands rejected by the machine.
+func execLines(m engine.Machine, lines <-chan string) {
+	for cmd := range lines {
+		ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
+		_, err := m.Do(ctx, cmd)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Command %s failed: %v\n", cmd, err)
+		}
+	}
+}
+
 func main() {
 	flag.Parse()
 
-	if *ttyDev == "" {
-		log.Fatal("-dev (serial device) is not specified.")
+	pol := gcode.DefaultPolicy()
+	if *policy != "" {
+		var err error
+		if pol, err = gcode.LoadPolicy(*policy); err != nil {
+			log.Fatal("Could not load the policy: ", err)
+		}
 	}
-	s, err := serial.Open(*ttyDev, *baudRate)
-	if err != nil {
-		log.Fatalf("Could not open serial port at %s: %v", *ttyDev, err)
+
+	m := engine.NewSwitch(*jsonMode)
+	if *homing && *jsonMode {
+		m.RequireHoming(true)
+	}
+	if *strict {
+		if !*jsonMode {
+			log.Fatal("-strict needs -json: the firmware can't be identified in the text mode")
+		}
+		m.RequireSupportedFirmware(true)
+	}
+	if *envelope != "" {
+		if !*jsonMode {
+			log.Fatal("-envelope needs -json: the position of the machine is not known in the text mode")
+		}
+		env, err := parseEnvelope(*envelope)
+		if err != nil {
+			log.Fatal(err)
+		}
+		m.SetEnvelope(env)
 	}
-	defer s.Close()
-	log.Print("Port opened at ", *ttyDev)
 
-	m := engine.New(s, *jsonMode)
+	if flag.NArg() == 1 && flag.Arg(0) == "probe" {
+		if err := runProbe(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if err := connect(m, *ttyDev, *baudRate); err != nil {
+		if *ttyDev != "" || flag.NArg() > 0 {
+			log.Fatal(err)
+		}
+		// The web and the terminal work without a machine, it may be connected later.
+		log.Print(err)
+	}
+
+	if flag.NArg() > 0 {
+		if !*jsonMode {
+			log.Fatal("Commands need -json: the machine can't be queried in the text mode")
+		}
+		if err := runCommand(m, flag.Args()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	go print(os.Stdout, m.Sub())
 
+	var files *staging
+	if *stage != "" {
+		var err error
+		if files, err = newStaging(*stage); err != nil {
+			log.Fatal("Could not open the staging directory: ", err)
+		}
+	}
+
+	var u *users
+	if *accounts != "" {
+		var err error
+		if u, err = loadUsers(*accounts); err != nil {
+			log.Fatal("Could not load the users: ", err)
+		}
+		if len(u.list()) == 0 {
+			log.Print("There are no users yet, add an admin with $useradd <name> admin <password>")
+		}
+	} else if *web {
+		log.Print("Warning: there are no user accounts, anyone who reaches the web interface controls the machine. Use -users")
+	}
+
 	if *web {
-		go runWeb(*port, m)
+		go runWeb(*port, m, pol, files, u)
 	}
 
-	// init
-	m.Send(`{"sr":""}`)
+	if *play != "" {
+		job, err := playFile(m, pol, *play)
+		if err != nil {
+			log.Fatalf("Could not play %s: %v", *play, err)
+		}
+		go watchJob(*play, job)
+	}
+
+	// The lines are executed one by one in the background,
+	// so that the control commands work while a line waits for the machine.
+	lines := make(chan string, 100)
+	go execLines(m, lines)
 
 	fmt.Fprintln(os.Stderr, "Please, enter g-code lines below:")
+	fmt.Fprintln(os.Stderr, "Use ! to pause (feedhold), ~ to resume and % to cancel the job or flush the queue.")
+	fmt.Fprintln(os.Stderr, "Use $clear to clear the alarm.")
+	fmt.Fprintln(os.Stderr, "Use $home x, y, z, xy or xyz to home the axes, and $override on or off to move without homing.")
+	fmt.Fprintln(os.Stderr, "Use $jog <axis> <step> [feed] to jog the axis by 0.01, 0.1, 1 or 10 mm, like $jog x -0.1.")
+	fmt.Fprintln(os.Stderr, "Use $offset <g92|g54..g59> <axes> [value] to zero or set the work offset at the current position, like $offset g54 xy,")
+	fmt.Fprintln(os.Stderr, "and $offset <g92|g54..g59> reset to clear it.")
+	fmt.Fprintln(os.Stderr, "Use $spindle <rpm> [ccw] or $spindle off to control the spindle, and $coolant mist, flood, both or off.")
+	fmt.Fprintln(os.Stderr, "Use $ports to list the serial ports, $connect [dev [baud]] to connect to the machine (the probe finds it without dev) and $disconnect to disconnect.")
+	fmt.Fprintln(os.Stderr, "Use $files to list the programs in the staging directory and $play <name> to run one.")
+	fmt.Fprintln(os.Stderr, "Use $users to list the users of the web interface, $useradd <name> <viewer|operator|admin> <password> and $userdel <name> to manage them.")
 	in := bufio.NewScanner(os.Stdin)
 	for in.Scan() {
-		if !*jsonMode {
-			m.Send(strings.TrimSpace(in.Text()))
+		if switchCmd(os.Stderr, m, in.Text()) {
 			continue
 		}
-		gcode, err := sanitizeCmd(in.Text())
+		if stagingCmd(os.Stderr, m, pol, files, in.Text()) {
+			continue
+		}
+		if usersCmd(os.Stderr, u, in.Text()) {
+			continue
+		}
+		if control(os.Stderr, m, m.Job(), in.Text()) {
+			continue
+		}
+		cmd, err := sanitizeCmd(pol, in.Text())
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Invalid gcode: %v\n", err)
-			// Invalid / unrecognized gcode is a halting condition,
-			// because we don't know what's the supposed CNC state after this line,
-			// and it may hurt the part and the mill.
-			os.Exit(1)
+			fmt.Fprintf(os.Stderr, "Rejected %q: %v\n", in.Text(), err)
+			continue
 		}
-		if gcode == "" {
+		if cmd == "" {
 			continue
 		}
-		m.Send(fmt.Sprintf(`{"gc":"%s"}`, gcode))
+		if *jsonMode {
+			cmd = fmt.Sprintf(`{"gc":"%s"}`, cmd)
+		}
+		lines <- cmd
 	}
 	if err := in.Err(); err != nil {
 		log.Fatal("Failed to read from stdin: ", err)
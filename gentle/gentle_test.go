@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/gcode"
+	"github.com/samofly/gentle/tinyg/sim"
+)
+
+func TestCheckRaw(t *testing.T) {
+	pol := gcode.DefaultPolicy()
+	tests := []struct {
+		raw, cmd string
+	}{
+		{raw: "g0 x10 (go)", cmd: "G0 X10"},
+		{raw: `{"gc":"g1 x1 f100 ; cut"}`, cmd: `{"gc":"G1 X1 F100"}`},
+		{raw: `{"sr":""}`, cmd: `{"sr":""}`},
+		{raw: `{"xvm":16000}`, cmd: `{"xvm":16000}`},
+		{raw: "G38.2 Z-10 F100"},
+		{raw: `{"gc":"G38.2 Z-10 F100"}`},
+		{raw: `{"gc":"G0 X"}`},
+		{raw: `{"gc":`},
+		{raw: "$xvm=16000"},
+		// The next line would not be checked, but the machine would run it.
+		{raw: "G0 X1 ;\n$xvm=1"},
+		{raw: "G0 X1 ;\nG10 L2 P1 X100"},
+		{raw: "G0 X1 (\nM3 S99999 G38.2 Z-100\n)"},
+		{raw: `{"gc":"G0 X1 ;\nG10 L2 P1 X100"}`},
+		{raw: "{\"sr\":\"\"}\n$xvm=1"},
+	}
+	for _, tt := range tests {
+		cmd, err := checkRaw(pol, tt.raw)
+		if tt.cmd == "" && err == nil {
+			t.Errorf("checkRaw(%q) = %q, want: error", tt.raw, cmd)
+		}
+		if tt.cmd != "" && (err != nil || cmd != tt.cmd) {
+			t.Errorf("checkRaw(%q) = %q, %v, want: %q", tt.raw, cmd, err, tt.cmd)
+		}
+	}
+}
+
+func TestReject(t *testing.T) {
+	var buf bytes.Buffer
+	_, err := checkRaw(gcode.DefaultPolicy(), "G38.2 Z-1")
+	reject(&buf, "G38.2 Z-1", err)
+	var msg engine.Message
+	if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", buf.Bytes(), err)
+	}
+	if msg.Error == nil || msg.Error.Kind != engine.RejectedError || msg.Error.Line != "G38.2 Z-1" || msg.Error.Msg == "" {
+		t.Errorf("reject: %s, want: a rejected error with the line and the reason", buf.Bytes())
+	}
+}
+
+func TestServeRawJob(t *testing.T) {
+	dev := sim.New()
+	defer dev.Close()
+	m := engine.New(dev, true)
+	s := &server{m: m, policy: gcode.DefaultPolicy(), jsonMode: true}
+	job, err := m.Run("slow.nc", strings.NewReader("G1 X10 F60\nG1 X20\nG1 X30\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The real-time commands of the web pause and cancel the job, like the ones of the terminal.
+	var buf bytes.Buffer
+	s.serveRaw(&buf, "!")
+	if st := job.Progress().State; st != engine.JobPaused {
+		t.Errorf("Job after !: %s, want: %s", st, engine.JobPaused)
+	}
+	s.serveRaw(&buf, "%")
+	select {
+	case <-waitJob(job):
+	case <-time.After(5 * time.Second):
+		t.Fatal("The job has not stopped after %")
+	}
+	if st := job.Progress().State; st != engine.JobCancelled {
+		t.Errorf("Job after %%: %s, want: %s", st, engine.JobCancelled)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("Unexpected output: %s", buf.Bytes())
+	}
+}
+
+func TestServeRawErrors(t *testing.T) {
+	s := &server{m: engine.NewSwitch(true), policy: gcode.DefaultPolicy(), jsonMode: true}
+	var buf bytes.Buffer
+	s.serveRaw(&buf, "$home x")
+	var msg engine.Message
+	if err := json.Unmarshal(buf.Bytes(), &msg); err != nil {
+		t.Fatalf("Unmarshal(%s): %v", buf.Bytes(), err)
+	}
+	if msg.Error == nil || msg.Error.Kind != engine.RejectedError || msg.Error.Line != "$home x" || msg.Error.Msg != "no machine is connected" {
+		t.Errorf("$home without a machine: %s, want: a rejected error", buf.Bytes())
+	}
+}
+
+// waitJob returns a channel, which is closed, once the job is over.
+func waitJob(job *engine.Job) <-chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		job.Wait()
+		close(done)
+	}()
+	return done
+}
+
+func TestSanitizeCmd(t *testing.T) {
+	pol := gcode.DefaultPolicy()
+	if got, err := sanitizeCmd(pol, "g01 x10.0 f100 (cut)"); err != nil || got != "G1 X10 F100" {
+		t.Errorf("sanitizeCmd: %q, %v, want: G1 X10 F100", got, err)
+	}
+	// The modes may be set by the web or a job, so the machine checks them.
+	if got, err := sanitizeCmd(pol, "x20"); err != nil || got != "X20" {
+		t.Errorf("sanitizeCmd: %q, %v, want: X20", got, err)
+	}
+	if _, err := sanitizeCmd(pol, "x"); err == nil {
+		t.Errorf("sanitizeCmd(x) succeeded, want: parse error")
+	}
+	if _, err := sanitizeCmd(pol, "G28.3 X0"); err == nil {
+		t.Errorf("sanitizeCmd(G28.3 X0) succeeded, want: not allowed by the policy")
+	}
+}
+
+func TestParseEnvelope(t *testing.T) {
+	env, err := parseEnvelope("x=0:300, Z=-80:0")
+	if err != nil {
+		t.Fatalf("parseEnvelope: %v", err)
+	}
+	if env.Min[0] != 0 || env.Max[0] != 300 || env.Min[2] != -80 || env.Max[2] != 0 || !math.IsInf(env.Max[1], 1) {
+		t.Errorf("parseEnvelope: %+v, want: x from 0 to 300, z from -80 to 0 and no limits for y", env)
+	}
+	for _, s := range []string{"", "x", "a=0:1", "x=0", "x=1:0", "y=0:1mm"} {
+		if _, err := parseEnvelope(s); err == nil {
+			t.Errorf("parseEnvelope(%q) succeeded, want: error", s)
+		}
+	}
+}
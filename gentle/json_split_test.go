@@ -122,7 +122,7 @@ func TestJsonScanner(t *testing.T) {
 				break
 			}
 			if !reflect.DeepEqual(cur, want) {
-				t.Errorf("%q: unexpected message: %v, want: %v", cur, want)
+				t.Errorf("%q: unexpected message: %v, want: %v", tt.name, cur, want)
 				ok = false
 				break
 			}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+	"github.com/samofly/serial"
+)
+
+// sysTTY is the sysfs directory with the tty devices.
+const sysTTY = "/sys/class/tty"
+
+// portPatterns match the USB serial adapters on Mac OS X, where there's no sysfs.
+var portPatterns = []string{"/dev/tty.usbserial*", "/dev/tty.usbmodem*"}
+
+// probeBauds are the baud rates tried by the probe, the default of TinyG first.
+var probeBauds = []int{115200, 230400, 57600, 38400, 19200, 9600}
+
+// probeTimeout is the time to wait for TinyG to answer the probe at a baud rate.
+const probeTimeout = time.Second
+
+// sysfsPorts returns the serial ports found in the sysfs directory of the tty devices.
+// The virtual terminals have no device, and the legacy ports, which are always there,
+// are platform devices. Both are skipped.
+func sysfsPorts(dir string) ([]string, error) {
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ports []string
+	for _, fi := range list {
+		subsystem, err := filepath.EvalSymlinks(filepath.Join(dir, fi.Name(), "device", "subsystem"))
+		if err != nil || filepath.Base(subsystem) == "platform" {
+			continue
+		}
+		ports = append(ports, "/dev/"+fi.Name())
+	}
+	return ports, nil
+}
+
+// probeResult is a TinyG found by the probe.
+type probeResult struct {
+	Dev  string `json:"dev"`
+	Baud int    `json:"baud"`
+
+	// Build and Version are the firmware build and version.
+	Build   float64 `json:"build"`
+	Version float64 `json:"version"`
+}
+
+func (r *probeResult) String() string {
+	return fmt.Sprintf("TinyG at %s, %d baud, firmware build %.2f, version %.3f", r.Dev, r.Baud, r.Build, r.Version)
+}
+
+// probeConn asks the device for the firmware build and version. It returns an error,
+// if the device does not answer as TinyG within the timeout. Then the reader may still
+// be blocked, and the caller must close the connection to release it.
+func probeConn(rw io.ReadWriter, timeout time.Duration) (build, version float64, err error) {
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(lines)
+		s := bufio.NewScanner(rw)
+		for s.Scan() {
+			select {
+			case lines <- s.Text():
+			case <-done:
+				return
+			}
+		}
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for _, v := range []struct {
+		name string
+		dst  *float64
+	}{{"fb", &build}, {"fv", &version}} {
+		// The newline before the query ends the garbage, which may be in the RX buffer.
+		if _, err := fmt.Fprintf(rw, "\n{\"%s\":n}\n", v.name); err != nil {
+			return 0, 0, err
+		}
+		if err := readValue(lines, timer.C, v.name, v.dst); err != nil {
+			return 0, 0, err
+		}
+	}
+	return build, version, nil
+}
+
+// readValue reads the lines until the response with the value, which is stored into dst.
+// The lines, which can't be parsed, are skipped: for example, at a wrong baud rate.
+func readValue(lines <-chan string, timeout <-chan time.Time, name string, dst *float64) error {
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return fmt.Errorf("no answer to the %s query", name)
+			}
+			r, err := tinyg.ParseResponse(line)
+			if err != nil || len(r.Body) == 0 {
+				continue
+			}
+			var body map[string]*float64
+			if json.Unmarshal(r.Body, &body) != nil || body[name] == nil {
+				continue
+			}
+			*dst = *body[name]
+			return nil
+		case <-timeout:
+			return fmt.Errorf("no answer to the %s query", name)
+		}
+	}
+}
+
+// probeDev tries to talk to TinyG at the device with the baud rates in turn.
+func probeDev(dev string) (*probeResult, error) {
+	var errs []string
+	for _, baud := range probeBauds {
+		s, err := serial.Open(dev, baud)
+		if err != nil {
+			// Other baud rates won't help.
+			return nil, err
+		}
+		build, version, err := probeConn(s, probeTimeout)
+		s.Close()
+		if err == nil {
+			return &probeResult{Dev: dev, Baud: baud, Build: build, Version: version}, nil
+		}
+		errs = append(errs, fmt.Sprintf("%d: %v", baud, err))
+	}
+	return nil, fmt.Errorf("no TinyG at %s (%s)", dev, strings.Join(errs, "; "))
+}
+
+// probe looks for TinyG at all the serial ports available.
+func probe() []*probeResult {
+	var found []*probeResult
+	for _, dev := range listPorts() {
+		r, err := probeDev(dev)
+		if err != nil {
+			log.Print("Probe: ", err)
+			continue
+		}
+		log.Print("Probe: found ", r)
+		found = append(found, r)
+	}
+	return found
+}
+
+// runProbe reports the TinyGs found at the serial ports.
+func runProbe(w io.Writer) error {
+	found := probe()
+	if len(found) == 0 {
+		return fmt.Errorf("no TinyG found at the serial ports: %s", strings.Join(listPorts(), ", "))
+	}
+	for _, r := range found {
+		fmt.Fprintln(w, r)
+	}
+	return nil
+}
+
+// listPorts returns the serial ports available. On Linux, they're found in sysfs.
+// Otherwise, the usual names of USB serial adapters are looked for.
+func listPorts() []string {
+	if _, err := os.Stat(sysTTY); err == nil {
+		if ports, err := sysfsPorts(sysTTY); err == nil {
+			sort.Strings(ports)
+			return ports
+		}
+	}
+	var ports []string
+	for _, p := range portPatterns {
+		// The patterns are valid, so Glob never fails.
+		list, _ := filepath.Glob(p)
+		ports = append(ports, list...)
+	}
+	sort.Strings(ports)
+	return ports
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/samofly/gentle/tinyg/sim"
+)
+
+func TestSysfsPorts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gentle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bus := filepath.Join(dir, "bus")
+	for _, d := range []string{"bus/usb-serial", "bus/platform", "bus/pnp", "tty/tty0"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, subsystem := range map[string]string{"ttyUSB0": "usb-serial", "ttyACM1": "usb-serial", "ttyS0": "platform", "ttyS1": "pnp"} {
+		device := filepath.Join(dir, "tty", name, "device")
+		if err := os.MkdirAll(device, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(filepath.Join(bus, subsystem), filepath.Join(device, "subsystem")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ports, err := sysfsPorts(filepath.Join(dir, "tty"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/dev/ttyACM1", "/dev/ttyS1", "/dev/ttyUSB0"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("sysfsPorts: %q, want: %q", ports, want)
+	}
+}
+
+// silentDev is a device, which never answers.
+type silentDev struct {
+	*io.PipeReader
+}
+
+func (silentDev) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestProbeConn(t *testing.T) {
+	dev := sim.New()
+	defer dev.Close()
+	build, version, err := probeConn(dev, 5*time.Second)
+	if err != nil || build != 440.20 || version != 0.97 {
+		t.Errorf("probeConn(sim): %g, %g, %v, want: 440.20, 0.97", build, version, err)
+	}
+
+	r, w := io.Pipe()
+	defer w.Close()
+	if _, _, err := probeConn(silentDev{r}, 50*time.Millisecond); err == nil {
+		t.Errorf("probeConn(silent device): nil error, want: no answer")
+	}
+}
@@ -0,0 +1,869 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/gcode"
+)
+
+// The web clients talk to the server with json commands over the websocket:
+//
+//	{"v":1,"id":7,"cmd":"home","args":{"axes":"xy"}}
+//
+// v is the version of the protocol. id is chosen by the client, it's returned in the reply,
+// so that the replies could be matched with the commands. Every command gets exactly one reply
+// with either the result, or the error:
+//
+//	{"v":1,"id":7,"reply":"home","result":{}}
+//	{"v":1,"id":7,"reply":"home","error":{"kind":"homing","msg":"X is not homed"}}
+//
+// Besides the replies, the messages from the machine (engine.Message) are sent as they come.
+// The commands are:
+//
+//	hello                                    the version of the protocol, the list of the commands,
+//	                                         the id of the client and who holds control
+//	ports                                    the serial ports available and the connected device
+//	connect  {"dev":"ttyUSB0","baud":115200} connect to the device, replacing the connected machine;
+//	                                         without dev or args, the TinyG found by the probe is connected;
+//	                                         baud is optional, the connection state comes in the messages
+//	disconnect                               disconnect the machine
+//	state                                    the last state of the machine
+//	job                                      the progress of the last job, no result without a job
+//	send     {"gcode":"G0 X1"}               send a g-code line, the reply comes once the machine accepts it
+//	home     {"axes":"xy"}                   home the axes: x, y, z, xy or xyz
+//	jog      {"axis":"x","step":-0.1,"feed":1000}
+//	                                         move the axis by the step: 0.01, 0.1, 1 or 10 mm; feed is optional
+//	jogstart {"axis":"x","dir":1,"feed":1000}
+//	                                         start the continuous jog on key-down; repeat it at least every
+//	                                         second (engine.JogTimeout) while the key is held, or the jog stops
+//	jogstop                                  stop the continuous jog on key-up
+//	override {"on":true}                     allow the motion without homing, or forbid it again
+//	offsets  {"offset":"g54","axes":"xy","op":"set","value":5}
+//	                                         "zero" the axes or "set" them to the value at the current position,
+//	                                         or "reset" the offset; the offset is g92 (default) or g54 to g59
+//	spindle  {"on":true,"ccw":false,"speed":12000}
+//	                                         start the spindle at the speed, or stop it
+//	coolant  {"mist":false,"flood":true}     turn the mist and the flood coolant on or off
+//	hold, resume, flush                      pause, resume or cancel the job; without a job,
+//	                                         feedhold, cycle start and queue flush
+//	clear                                    clear the alarm
+//	files                                    the programs in the staging directory
+//	upload   {"name":"a.nc","offset":0,"data":"G0 X1\n...","eof":false}
+//	                                         upload a program in chunks; offset is the size uploaded so far,
+//	                                         the program gets the name once eof is set, an existing file is not replaced
+//	delete   {"name":"a.nc"}                 delete the program
+//	rename   {"from":"a.nc","to":"b.nc"}     rename the program, an existing file is not replaced
+//	play     {"name":"a.nc"}                 check the program against the policy and run it as a job
+//	users                                    the user accounts with their roles
+//	adduser  {"name":"bob","role":"operator","password":"..."}
+//	                                         add a user account with the role: viewer, operator or admin
+//	deluser  {"name":"bob"}                  remove the user account and end its sessions
+//	control  {"op":"request"}                the control lease: "request" it, "release" it, "handover" it
+//	                                         to the client, which has requested it ({"op":"handover","to":"c2"}),
+//	                                         or "take" it from another client (admin only); the result is
+//	                                         who holds control, also without args
+//
+// The clients of the old protocol send {"raw":"..."}. These commands get no reply, unless rejected.
+//
+// With the user accounts (-users), the client logs in first: it posts the form with the name and the password
+// to /login and gets the session cookie, which the websocket needs. Each command needs a role: viewer for
+// hello, ports, state, job and files, admin for connect, disconnect, override and the users,
+// and operator for the rest, including the old protocol. The control commands of the old protocol,
+// such as $override, need the role of the matching command, and the json commands, which change
+// the configuration of the machine, need admin, like the commands with line breaks. Otherwise, the command is refused
+// with a permission error. Without the user accounts, everyone may do everything.
+//
+// Only one client drives the machine at a time: the one, which holds the control lease. The commands,
+// which move or change the machine, are refused with a control error for the other clients, which only watch.
+// These are send, home, offsets, spindle, coolant, resume, flush, clear, jog, jogstart, play and the old protocol.
+// Hold and jogstop are always allowed, so that anyone could stop the machine. If nobody holds control,
+// the first such command takes it. Control is released, once the client is gone. The changes of the lease
+// come in the messages as engine.Control. The terminal is not a client: it always drives the machine.
+
+// protocolVersion is the version of the command protocol. It's increased on incompatible changes.
+const protocolVersion = 1
+
+// RequestError means that a command of a client is malformed or unknown.
+const RequestError engine.ErrorKind = "request"
+
+// PermissionError means that the client is not logged in, or its user may not use the command.
+const PermissionError engine.ErrorKind = "permission"
+
+// request is a command from a client.
+type request struct {
+	V    int             `json:"v"`
+	ID   json.RawMessage `json:"id,omitempty"`
+	Cmd  string          `json:"cmd"`
+	Args json.RawMessage `json:"args,omitempty"`
+
+	// Raw is a command of the old protocol: a g-code line or a json command for TinyG.
+	Raw string `json:"raw,omitempty"`
+}
+
+// reply is the answer to a command.
+type reply struct {
+	V      int             `json:"v"`
+	ID     json.RawMessage `json:"id,omitempty"`
+	Reply  string          `json:"reply"`
+	Result interface{}     `json:"result,omitempty"`
+	Error  *engine.Error   `json:"error,omitempty"`
+}
+
+// handler executes a command.
+type handler struct {
+	run func(c *client, args json.RawMessage) (interface{}, error)
+
+	// queued is true, if the command waits for the machine. Such commands are executed
+	// one by one in the order they come. The others are executed immediately: hold and jogstop
+	// stop the machine at once, and the renewals of jogstart don't wait behind the queued commands.
+	queued bool
+
+	// role is the role needed to use the command.
+	role role
+
+	// drives is true, if the command moves or changes the machine, so that it needs the control lease.
+	drives bool
+}
+
+var handlers map[string]handler
+
+func init() {
+	handlers = map[string]handler{
+		"hello":      {run: hello, role: viewer},
+		"ports":      {run: ports, role: viewer},
+		"connect":    {run: connectDev, queued: true, role: admin},
+		"disconnect": {run: disconnect, queued: true, role: admin},
+		"state":      {run: func(c *client, _ json.RawMessage) (interface{}, error) { return c.s.m.State(), nil }, role: viewer},
+		"job":        {run: jobProgress, role: viewer},
+		"send":       {run: sendGcode, queued: true, role: operator, drives: true},
+		"home":       {run: home, queued: true, role: operator, drives: true},
+		"override":   {run: override, role: admin},
+		"offsets":    {run: offsets, queued: true, role: operator, drives: true},
+		"spindle":    {run: spindle, queued: true, role: operator, drives: true},
+		"coolant":    {run: coolant, queued: true, role: operator, drives: true},
+		"hold":       {run: controlCmd("!"), role: operator},
+		"resume":     {run: controlCmd("~"), role: operator, drives: true},
+		"flush":      {run: controlCmd("%"), role: operator, drives: true},
+		"clear":      {run: controlCmd("$clear"), role: operator, drives: true},
+		"jog":        {run: jog, queued: true, role: operator, drives: true},
+		"jogstart":   {run: jogStart, role: operator, drives: true},
+		"jogstop":    {run: jogStop, role: operator},
+		"files":      {run: files, role: viewer},
+		"upload":     {run: uploadChunk, role: operator},
+		"delete":     {run: deleteFile, role: operator},
+		"rename":     {run: renameFile, role: operator},
+		"play":       {run: playStaged, queued: true, role: operator, drives: true},
+		"users":      {run: listUsers, role: admin},
+		"adduser":    {run: addUser, role: admin},
+		"deluser":    {run: delUser, role: admin},
+		"control":    {run: controlLease, role: operator},
+	}
+}
+
+// empty is the result of the commands which return nothing.
+type empty struct{}
+
+// lastClient is the number of the last client connected, which makes its id.
+var lastClient uint64
+
+// client is a web client connected over the websocket.
+type client struct {
+	s *server
+	w io.Writer
+
+	// id identifies the client in the control lease.
+	id string
+
+	// token is the session token of the client. The session is checked on every command,
+	// so that the logout or the removal of the user takes effect at once.
+	token string
+
+	// queue runs the queued commands in order.
+	queue chan func()
+
+	// uploads are the files being uploaded by name. They're only accessed by the commands,
+	// which are not queued.
+	uploads map[string]*upload
+
+	// jogging is true, if the client has started a continuous jog.
+	// It's only accessed by the commands, which are not queued.
+	jogging bool
+}
+
+func newClient(s *server, w io.Writer, token string) *client {
+	c := &client{s: s, w: w, id: fmt.Sprintf("c%d", atomic.AddUint64(&lastClient, 1)), token: token, queue: make(chan func(), 100), uploads: make(map[string]*upload)}
+	go func() {
+		for f := range c.queue {
+			f()
+		}
+	}()
+	return c
+}
+
+// close stops the client, once the queued commands are executed. The unfinished uploads are cancelled,
+// the jog started by the client is stopped without waiting for the timeout, and control is released.
+func (c *client) close() {
+	if c.jogging {
+		c.s.m.JogStop()
+	}
+	c.queue <- func() {
+		if l := c.lease(); l != nil {
+			l.Leave(c.id)
+		}
+	}
+	close(c.queue)
+	for _, u := range c.uploads {
+		u.abort()
+	}
+}
+
+// user returns the user logged in, or nil, if the session is not valid.
+// Without the user accounts, it's an admin.
+func (c *client) user() *user {
+	if c.s.users == nil {
+		return &user{Role: admin}
+	}
+	return c.s.users.lookup(c.token)
+}
+
+// permit returns an error, if the user of the client may not do what the role may.
+func (c *client) permit(need role) error {
+	u := c.user()
+	if u == nil {
+		return &engine.Error{Kind: PermissionError, Msg: "not logged in"}
+	}
+	if !u.Role.allows(need) {
+		return &engine.Error{Kind: PermissionError, Msg: fmt.Sprintf("%s %s may not do that, it needs %s", u.Role, u.Name, need)}
+	}
+	return nil
+}
+
+// lease returns the control lease, or nil, if the machine has none.
+func (c *client) lease() *engine.Lease {
+	if sw, ok := c.s.m.(*engine.Switch); ok {
+		return sw.Lease()
+	}
+	return nil
+}
+
+// userName returns the name of the user logged in, if any.
+func (c *client) userName() string {
+	if u := c.user(); u != nil {
+		return u.Name
+	}
+	return ""
+}
+
+// rawCmds are the commands, which match the control commands of the old protocol.
+var rawCmds = map[string]string{
+	"$home":     "home",
+	"$override": "override",
+	"$jog":      "jog",
+	"$offset":   "offsets",
+	"$spindle":  "spindle",
+	"$coolant":  "coolant",
+	"$clear":    "clear",
+	"$clr":      "clear",
+}
+
+// rawRole returns the role needed for a command of the old protocol.
+func rawRole(raw string) role {
+	if strings.ContainsAny(raw, "\r\n") {
+		// The next line would be run by the machine as it is, even a $ setting.
+		return admin
+	}
+	raw = strings.TrimSpace(raw)
+	if f := strings.Fields(raw); len(f) > 0 {
+		if name, ok := rawCmds[f[0]]; ok {
+			return handlers[name].role
+		}
+	}
+	if !strings.HasPrefix(raw, "{") {
+		return operator
+	}
+	var cmd map[string]json.RawMessage
+	if json.Unmarshal([]byte(raw), &cmd) != nil {
+		// It's rejected as malformed.
+		return operator
+	}
+	for k, v := range cmd {
+		// The values, other than the g-code and the queries, change the configuration.
+		if k != "gc" && string(v) != "null" && string(v) != `""` {
+			return admin
+		}
+	}
+	return operator
+}
+
+// handleRaw executes a command of the old protocol. It gets no reply, unless it's rejected.
+func (c *client) handleRaw(raw string) {
+	if err := c.permit(rawRole(raw)); err != nil {
+		reject(c.w, raw, err)
+		return
+	}
+	// The feedhold stops the machine, whoever drives it.
+	if strings.TrimSpace(raw) != "!" {
+		if err := c.drive(); err != nil {
+			reject(c.w, raw, err)
+			return
+		}
+	}
+	c.s.serveRaw(c.w, raw)
+}
+
+// drive returns a control error, if another client holds control. If nobody does, the client takes it.
+func (c *client) drive() error {
+	l := c.lease()
+	if l == nil {
+		return nil
+	}
+	return l.Check(c.id, c.userName())
+}
+
+// send writes a message to the client.
+func (c *client) send(v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("Error: failed to marshal json for %+v, err: %v", v, err)
+		return
+	}
+	if _, err := c.w.Write(data); err != nil {
+		log.Print("Error: failed to deliver message, err: ", err)
+	}
+}
+
+// handle executes a command of the protocol.
+func (c *client) handle(req *request) {
+	fail := func(format string, args ...interface{}) {
+		c.send(&reply{V: protocolVersion, ID: req.ID, Reply: req.Cmd,
+			Error: &engine.Error{Kind: RequestError, Msg: fmt.Sprintf(format, args...)}})
+	}
+	if req.V != protocolVersion {
+		fail("unsupported protocol version %d, want: %d", req.V, protocolVersion)
+		return
+	}
+	h, ok := handlers[req.Cmd]
+	if !ok {
+		fail("unknown command %q", req.Cmd)
+		return
+	}
+	if err := c.permit(h.role); err != nil {
+		c.send(&reply{V: protocolVersion, ID: req.ID, Reply: req.Cmd, Error: err.(*engine.Error)})
+		return
+	}
+	run := func() {
+		var res interface{}
+		var err error
+		if h.drives {
+			err = c.drive()
+		}
+		if err == nil {
+			res, err = h.run(c, req.Args)
+		}
+		r := &reply{V: protocolVersion, ID: req.ID, Reply: req.Cmd, Result: res}
+		if err != nil {
+			r.Result = nil
+			if e, ok := err.(*engine.Error); ok {
+				r.Error = e
+			} else {
+				r.Error = &engine.Error{Kind: RequestError, Msg: err.Error()}
+			}
+		}
+		c.send(r)
+	}
+	if h.queued {
+		c.queue <- run
+		return
+	}
+	run()
+}
+
+// args decodes the arguments of a command.
+func args(data json.RawMessage, v interface{}) error {
+	if len(data) == 0 {
+		return fmt.Errorf("args are missing")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("malformed args: %v", err)
+	}
+	return nil
+}
+
+func hello(c *client, _ json.RawMessage) (interface{}, error) {
+	var cmds []string
+	for name, h := range handlers {
+		if c.permit(h.role) == nil {
+			cmds = append(cmds, name)
+		}
+	}
+	sort.Strings(cmds)
+	var u *user
+	if c.s.users != nil {
+		u = c.user()
+	}
+	var ctl *engine.Control
+	if l := c.lease(); l != nil {
+		tmp := l.Control()
+		ctl = &tmp
+	}
+	return struct {
+		Version  int             `json:"version"`
+		Commands []string        `json:"commands"`
+		User     *user           `json:"user,omitempty"`
+		Client   string          `json:"client"`
+		Control  *engine.Control `json:"control,omitempty"`
+	}{protocolVersion, cmds, u, c.id, ctl}, nil
+}
+
+// machineSwitch returns the switch, which connects the machine.
+func (c *client) machineSwitch() (*engine.Switch, error) {
+	sw, ok := c.s.m.(*engine.Switch)
+	if !ok {
+		return nil, fmt.Errorf("the machine can't be connected or disconnected")
+	}
+	return sw, nil
+}
+
+func ports(c *client, _ json.RawMessage) (interface{}, error) {
+	sw, err := c.machineSwitch()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		Ports []string `json:"ports"`
+		Dev   string   `json:"dev"`
+	}{listPorts(), sw.Device()}, nil
+}
+
+func connectDev(c *client, data json.RawMessage) (interface{}, error) {
+	sw, err := c.machineSwitch()
+	if err != nil {
+		return nil, err
+	}
+	a := struct {
+		Dev  string `json:"dev"`
+		Baud int    `json:"baud"`
+	}{Baud: *baudRate}
+	// Without args, the TinyG found by the probe is connected.
+	if len(data) > 0 {
+		if err := args(data, &a); err != nil {
+			return nil, err
+		}
+	}
+	if err := connect(sw, a.Dev, a.Baud); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func disconnect(c *client, _ json.RawMessage) (interface{}, error) {
+	sw, err := c.machineSwitch()
+	if err != nil {
+		return nil, err
+	}
+	sw.Disconnect()
+	return empty{}, nil
+}
+
+func jobProgress(c *client, _ json.RawMessage) (interface{}, error) {
+	job := c.s.m.Job()
+	if job == nil {
+		return nil, nil
+	}
+	p := job.Progress()
+	return &p, nil
+}
+
+// allowed parses the line and checks it against the policy.
+func (c *client) allowed(line string) (*gcode.Block, error) {
+	b, err := gcode.Parse(line)
+	if err == nil {
+		err = c.s.policy.Check(b)
+	}
+	if err != nil {
+		return nil, &engine.Error{Kind: engine.RejectedError, Msg: err.Error(), Line: line}
+	}
+	return b, nil
+}
+
+// gcode checks a g-code line against the policy, sends it to the machine
+// and waits until the machine accepts it.
+func (c *client) gcode(line string) (interface{}, error) {
+	b, err := c.allowed(line)
+	if err != nil {
+		return nil, err
+	}
+	cmd := b.String()
+	if c.s.jsonMode {
+		data, err := json.Marshal(struct {
+			Gc string `json:"gc"`
+		}{cmd})
+		if err != nil {
+			return nil, err
+		}
+		cmd = string(data)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), cmdTimeout)
+	defer cancel()
+	if _, err := c.s.m.Do(ctx, cmd); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func sendGcode(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		Gcode string `json:"gcode"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	return c.gcode(a.Gcode)
+}
+
+func home(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		Axes string `json:"axes"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := c.s.m.Home(a.Axes); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func override(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		On bool `json:"on"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	c.s.m.OverrideHoming(a.On)
+	return empty{}, nil
+}
+
+func jog(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		Axis string  `json:"axis"`
+		Step float64 `json:"step"`
+		Feed float64 `json:"feed"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := c.s.m.Jog(a.Axis, a.Step, a.Feed); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func jogStart(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		Axis string  `json:"axis"`
+		Dir  int     `json:"dir"`
+		Feed float64 `json:"feed"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := c.s.m.JogStart(a.Axis, a.Dir, a.Feed); err != nil {
+		return nil, err
+	}
+	c.jogging = true
+	return empty{}, nil
+}
+
+func jogStop(c *client, _ json.RawMessage) (interface{}, error) {
+	c.s.m.JogStop()
+	c.jogging = false
+	return empty{}, nil
+}
+
+func offsets(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		Offset string  `json:"offset"`
+		Axes   string  `json:"axes"`
+		Op     string  `json:"op"`
+		Value  float64 `json:"value"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if a.Offset == "" {
+		a.Offset = "g92"
+	}
+	var err error
+	switch a.Op {
+	case "zero":
+		err = c.s.m.SetOffset(a.Offset, a.Axes, 0)
+	case "set":
+		err = c.s.m.SetOffset(a.Offset, a.Axes, a.Value)
+	case "reset":
+		err = c.s.m.ResetOffset(a.Offset)
+	default:
+		err = fmt.Errorf("invalid op %q, want zero, set or reset", a.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func spindle(c *client, data json.RawMessage) (interface{}, error) {
+	var a struct {
+		On    bool    `json:"on"`
+		CCW   bool    `json:"ccw"`
+		Speed float64 `json:"speed"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if a.On {
+		// The speed is limited by the policy, like the S words of the g-code sent.
+		if _, err := c.allowed(fmt.Sprintf("S%g", a.Speed)); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.s.m.SetSpindle(engine.Spindle{On: a.On, CCW: a.CCW, Speed: a.Speed}); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func coolant(c *client, data json.RawMessage) (interface{}, error) {
+	var a engine.Coolant
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := c.s.m.SetCoolant(a); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+// controlCmd returns a handler for a control command of the terminal, such as "!".
+func controlCmd(cmd string) func(c *client, _ json.RawMessage) (interface{}, error) {
+	return func(c *client, _ json.RawMessage) (interface{}, error) {
+		var out bytes.Buffer
+		control(&out, c.s.m, c.s.m.Job(), cmd)
+		if out.Len() > 0 {
+			return nil, errors.New(strings.TrimSpace(out.String()))
+		}
+		return empty{}, nil
+	}
+}
+
+// staging returns the staging directory.
+func (c *client) staging() (*staging, error) {
+	if c.s.files == nil {
+		return nil, fmt.Errorf("no staging directory is configured")
+	}
+	return c.s.files, nil
+}
+
+func files(c *client, _ json.RawMessage) (interface{}, error) {
+	st, err := c.staging()
+	if err != nil {
+		return nil, err
+	}
+	return st.list()
+}
+
+func uploadChunk(c *client, data json.RawMessage) (interface{}, error) {
+	st, err := c.staging()
+	if err != nil {
+		return nil, err
+	}
+	var a struct {
+		Name   string `json:"name"`
+		Offset int64  `json:"offset"`
+		Data   string `json:"data"`
+		EOF    bool   `json:"eof"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	u := c.uploads[a.Name]
+	if a.Offset == 0 {
+		// The upload starts over.
+		if u != nil {
+			u.abort()
+			delete(c.uploads, a.Name)
+		}
+		if u, err = st.create(a.Name); err != nil {
+			return nil, err
+		}
+		c.uploads[a.Name] = u
+	}
+	if u == nil || u.size != a.Offset {
+		return nil, fmt.Errorf("upload of %s: unexpected offset %d, start over with 0", a.Name, a.Offset)
+	}
+	if _, err := io.WriteString(u, a.Data); err != nil {
+		u.abort()
+		delete(c.uploads, a.Name)
+		return nil, err
+	}
+	if !a.EOF {
+		return struct {
+			Size int64 `json:"size"`
+		}{u.size}, nil
+	}
+	delete(c.uploads, a.Name)
+	return u.commit()
+}
+
+func deleteFile(c *client, data json.RawMessage) (interface{}, error) {
+	st, err := c.staging()
+	if err != nil {
+		return nil, err
+	}
+	var a struct {
+		Name string `json:"name"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := st.remove(a.Name); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func renameFile(c *client, data json.RawMessage) (interface{}, error) {
+	st, err := c.staging()
+	if err != nil {
+		return nil, err
+	}
+	var a struct {
+		From string `json:"from"`
+		To   string `json:"to"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := st.rename(a.From, a.To); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func playStaged(c *client, data json.RawMessage) (interface{}, error) {
+	st, err := c.staging()
+	if err != nil {
+		return nil, err
+	}
+	var a struct {
+		Name string `json:"name"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	job, err := st.play(c.s.m, c.s.policy, a.Name)
+	if err != nil {
+		return nil, err
+	}
+	p := job.Progress()
+	return &p, nil
+}
+
+// accounts returns the user accounts.
+func (c *client) accounts() (*users, error) {
+	if c.s.users == nil {
+		return nil, fmt.Errorf("no user accounts are configured")
+	}
+	return c.s.users, nil
+}
+
+func listUsers(c *client, _ json.RawMessage) (interface{}, error) {
+	u, err := c.accounts()
+	if err != nil {
+		return nil, err
+	}
+	return u.list(), nil
+}
+
+func addUser(c *client, data json.RawMessage) (interface{}, error) {
+	u, err := c.accounts()
+	if err != nil {
+		return nil, err
+	}
+	var a struct {
+		Name     string `json:"name"`
+		Role     role   `json:"role"`
+		Password string `json:"password"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := u.add(a.Name, a.Password, a.Role); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func delUser(c *client, data json.RawMessage) (interface{}, error) {
+	u, err := c.accounts()
+	if err != nil {
+		return nil, err
+	}
+	var a struct {
+		Name string `json:"name"`
+	}
+	if err := args(data, &a); err != nil {
+		return nil, err
+	}
+	if err := u.remove(a.Name); err != nil {
+		return nil, err
+	}
+	return empty{}, nil
+}
+
+func controlLease(c *client, data json.RawMessage) (interface{}, error) {
+	l := c.lease()
+	if l == nil {
+		return nil, fmt.Errorf("the machine has no control lease")
+	}
+	var a struct {
+		Op string `json:"op"`
+		To string `json:"to"`
+	}
+	if len(data) > 0 {
+		if err := args(data, &a); err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	switch a.Op {
+	case "":
+	case "request":
+		l.Request(c.id, c.userName())
+	case "release":
+		err = l.Release(c.id)
+	case "handover":
+		err = l.Handover(c.id, a.To)
+	case "take":
+		if err = c.permit(admin); err == nil {
+			l.Take(c.id, c.userName())
+		}
+	default:
+		err = fmt.Errorf("invalid op %q, want request, release, handover or take", a.Op)
+	}
+	if err != nil {
+		return nil, err
+	}
+	ctl := l.Control()
+	return &ctl, nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/gcode"
+)
+
+// chanWriter passes the messages written to it to the channel.
+type chanWriter chan []byte
+
+func (w chanWriter) Write(p []byte) (int, error) {
+	w <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestProtocol(t *testing.T) {
+	m := engine.NewSwitch(true)
+	defer m.Disconnect()
+
+	out := make(chanWriter, 10)
+	c := newClient(&server{m: m, policy: gcode.DefaultPolicy(), jsonMode: true}, out, "")
+	defer c.close()
+
+	tests := []struct {
+		req  string
+		kind engine.ErrorKind
+	}{
+		{req: `{"v":1,"id":1,"cmd":"hello"}`},
+		{req: `{"v":1,"id":"a","cmd":"send","args":{"gcode":"G0 X1"}}`, kind: engine.DroppedError},
+		{req: `{"v":1,"id":"b","cmd":"ports"}`},
+		{req: `{"v":1,"id":"c","cmd":"connect","args":{"dev":"sim:","baud":0}}`, kind: RequestError},
+		{req: `{"v":1,"id":"d","cmd":"connect","args":{"dev":"sim:"}}`},
+		{req: `{"v":1,"id":2,"cmd":"send","args":{"gcode":"G92 X0 Y0 Z0"}}`},
+		{req: `{"v":1,"id":3,"cmd":"send","args":{"gcode":"G0 X1"}}`},
+		{req: `{"v":1,"id":"s","cmd":"spindle","args":{"on":true,"speed":1000}}`},
+		{req: `{"v":1,"id":"s2","cmd":"spindle","args":{"on":true,"speed":-1}}`, kind: RequestError},
+		{req: `{"v":1,"id":"c1","cmd":"coolant","args":{"flood":true}}`},
+		{req: `{"v":1,"id":"c2","cmd":"coolant","args":{}}`},
+		{req: `{"v":1,"id":4,"cmd":"offsets","args":{"axes":"xy","op":"zero"}}`},
+		{req: `{"v":1,"id":"o1","cmd":"offsets","args":{"offset":"g55","axes":"z","op":"set","value":5}}`},
+		{req: `{"v":1,"id":"o2","cmd":"offsets","args":{"offset":"g55","op":"reset"}}`},
+		{req: `{"v":1,"id":"o3","cmd":"offsets","args":{"offset":"g53","axes":"x","op":"zero"}}`, kind: RequestError},
+		{req: `{"v":1,"id":5,"cmd":"state"}`},
+		{req: `{"v":1,"id":6,"cmd":"job"}`},
+		{req: `{"v":1,"id":"j1","cmd":"jog","args":{"axis":"x","step":-0.1}}`},
+		{req: `{"v":1,"id":"j2","cmd":"jog","args":{"axis":"x","step":0.5}}`, kind: RequestError},
+		{req: `{"v":1,"id":"j3","cmd":"jogstart","args":{"axis":"y","dir":1,"feed":500}}`},
+		{req: `{"v":1,"id":"j4","cmd":"jogstart","args":{"axis":"y","dir":1,"feed":500}}`},
+		{req: `{"v":1,"id":"j5","cmd":"jogstop"}`},
+		{req: `{"v":1,"id":"j6","cmd":"jogstart","args":{"axis":"a","dir":1}}`, kind: RequestError},
+		{req: `{"v":1,"id":7,"cmd":"send","args":{"gcode":"G38.2 Z-1"}}`, kind: engine.RejectedError},
+		{req: `{"v":1,"id":8,"cmd":"send"}`, kind: RequestError},
+		{req: `{"v":1,"id":9,"cmd":"offsets","args":{"axes":"xa","op":"zero"}}`, kind: RequestError},
+		{req: `{"v":1,"id":10,"cmd":"fly"}`, kind: RequestError},
+		{req: `{"v":2,"id":11,"cmd":"hello"}`, kind: RequestError},
+		{req: `{"v":1,"id":12,"cmd":"home","args":{"axes":"w"}}`, kind: RequestError},
+		{req: `{"v":1,"id":13,"cmd":"disconnect"}`},
+		{req: `{"v":1,"id":14,"cmd":"send","args":{"gcode":"G0 X1"}}`, kind: engine.DroppedError},
+	}
+	for _, tt := range tests {
+		var req request
+		if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+			t.Fatal(err)
+		}
+		c.handle(&req)
+		var r struct {
+			V      int             `json:"v"`
+			ID     json.RawMessage `json:"id"`
+			Reply  string          `json:"reply"`
+			Result json.RawMessage `json:"result"`
+			Error  *engine.Error   `json:"error"`
+		}
+		select {
+		case data := <-out:
+			if err := json.Unmarshal(data, &r); err != nil {
+				t.Fatalf("%s: malformed reply %s: %v", tt.req, data, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: no reply", tt.req)
+		}
+		if r.V != protocolVersion || string(r.ID) != string(req.ID) || r.Reply != req.Cmd {
+			t.Errorf("%s: unexpected reply header: %+v", tt.req, r)
+		}
+		var kind engine.ErrorKind
+		if r.Error != nil {
+			kind = r.Error.Kind
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: error %v, want kind %q", tt.req, r.Error, tt.kind)
+		}
+		if tt.kind == "" && req.Cmd != "job" && len(r.Result) == 0 {
+			t.Errorf("%s: no result", tt.req)
+		}
+	}
+}
+
+func TestControl(t *testing.T) {
+	m := engine.NewSwitch(true)
+	defer m.Disconnect()
+	ch := m.Sub()
+	s := &server{m: m, policy: gcode.DefaultPolicy(), jsonMode: true}
+
+	clients := make([]*client, 2)
+	outs := make([]chanWriter, 2)
+	for i := range clients {
+		outs[i] = make(chanWriter, 10)
+		clients[i] = newClient(s, outs[i], "")
+	}
+	a, b := clients[0], clients[1]
+
+	tests := []struct {
+		c    int
+		req  string
+		kind engine.ErrorKind
+
+		// holder is the client, which holds control after the command, or -1.
+		holder int
+	}{
+		{c: 0, req: `{"v":1,"id":1,"cmd":"control"}`, holder: -1},
+		{c: 0, req: `{"v":1,"id":2,"cmd":"send","args":{"gcode":"G0 X1"}}`, kind: engine.DroppedError, holder: 0},
+		{c: 1, req: `{"v":1,"id":3,"cmd":"send","args":{"gcode":"G0 X1"}}`, kind: engine.ControlError, holder: 0},
+		{c: 1, req: `{"v":1,"id":4,"cmd":"jog","args":{"axis":"x","step":1}}`, kind: engine.ControlError, holder: 0},
+		{c: 1, req: `{"v":1,"id":5,"cmd":"hold"}`, holder: 0},
+		{c: 1, req: `{"v":1,"id":6,"cmd":"release"}`, kind: RequestError, holder: 0},
+		{c: 1, req: `{"v":1,"id":7,"cmd":"control","args":{"op":"release"}}`, kind: engine.ControlError, holder: 0},
+		{c: 1, req: `{"v":1,"id":8,"cmd":"control","args":{"op":"request"}}`, holder: 0},
+		{c: 0, req: `{"v":1,"id":9,"cmd":"control","args":{"op":"handover","to":"nobody"}}`, kind: engine.ControlError, holder: 0},
+		{c: 0, req: `{"v":1,"id":10,"cmd":"control","args":{"op":"handover","to":"` + b.id + `"}}`, holder: 1},
+		{c: 1, req: `{"v":1,"id":11,"cmd":"send","args":{"gcode":"G0 X1"}}`, kind: engine.DroppedError, holder: 1},
+		{c: 0, req: `{"v":1,"id":12,"cmd":"control","args":{"op":"take"}}`, holder: 0},
+		{c: 0, req: `{"v":1,"id":13,"cmd":"control","args":{"op":"fly"}}`, kind: RequestError, holder: 0},
+		{c: 0, req: `{"v":1,"id":14,"cmd":"control","args":{"op":"release"}}`, holder: -1},
+	}
+	for _, tt := range tests {
+		var req request
+		if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+			t.Fatal(err)
+		}
+		clients[tt.c].handle(&req)
+		var r struct {
+			Result json.RawMessage `json:"result"`
+			Error  *engine.Error   `json:"error"`
+		}
+		select {
+		case data := <-outs[tt.c]:
+			if err := json.Unmarshal(data, &r); err != nil {
+				t.Fatalf("%s: malformed reply %s: %v", tt.req, data, err)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("%s: no reply", tt.req)
+		}
+		var kind engine.ErrorKind
+		if r.Error != nil {
+			kind = r.Error.Kind
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: error %v, want kind %q", tt.req, r.Error, tt.kind)
+		}
+		var want string
+		if tt.holder >= 0 {
+			want = clients[tt.holder].id
+		}
+		if got := m.Lease().Control().Holder; got != want {
+			t.Errorf("%s: control is held by %q, want: %q", tt.req, got, want)
+		}
+	}
+
+	// The changes are published: a takes control, b requests it, a hands it over, a takes it back and releases it.
+	var holders []string
+	for len(holders) < 5 {
+		select {
+		case msg := <-ch:
+			if msg.Control != nil {
+				holders = append(holders, msg.Control.Holder+"/"+msg.Control.Requester)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Control messages: %v, want 5", holders)
+		}
+	}
+	want := []string{a.id + "/", a.id + "/" + b.id, b.id + "/", a.id + "/", "/"}
+	if strings.Join(holders, " ") != strings.Join(want, " ") {
+		t.Errorf("Control messages: %v, want: %v", holders, want)
+	}
+
+	// Control is released, once the holder is gone.
+	m.Lease().Request(b.id, "")
+	b.close()
+	a.close()
+	deadline := time.Now().Add(time.Second)
+	for m.Lease().Control() != (engine.Control{}) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ctl := m.Lease().Control(); ctl != (engine.Control{}) {
+		t.Errorf("Control after the clients are gone: %v, want: nobody", ctl)
+	}
+}
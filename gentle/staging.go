@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/gcode"
+)
+
+// maxFileSize limits the size of an uploaded program.
+const maxFileSize = 64 << 20
+
+// staging is the directory with the g-code programs, which the clients upload, list and play.
+// The files are addressed by their names only, so that the clients can't reach outside of the directory.
+// The hidden files, such as the unfinished uploads, are not visible to the clients.
+type staging struct {
+	dir string
+
+	mu sync.Mutex
+	// cache has the info of the files measured, it's valid while the size and the time of the file are the same.
+	cache map[string]*fileInfo
+}
+
+func newStaging(dir string) (*staging, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &staging{dir: dir, cache: make(map[string]*fileInfo)}, nil
+}
+
+// fileInfo describes a program in the staging directory.
+type fileInfo struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+
+	// Lines is the number of lines and Moves is the number of the moves in the program.
+	Lines int `json:"lines"`
+	Moves int `json:"moves"`
+
+	// Min and Max are the corners of the box, which contains the moves of the program started at the origin.
+	Min *gcode.Point `json:"min,omitempty"`
+	Max *gcode.Point `json:"max,omitempty"`
+
+	// Error tells, why the program can't be interpreted.
+	Error string `json:"error,omitempty"`
+}
+
+// path returns the path of the file with the name. The name must not be a path or a hidden file.
+func (s *staging) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid file name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// free returns the path of the file with the name, if there's no such file yet.
+// Existing files are never replaced: one could be playing.
+func (s *staging) free(name string) (string, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Lstat(p); err == nil {
+		return "", fmt.Errorf("file %s already exists", name)
+	}
+	return p, nil
+}
+
+// stat returns the info of the file, if it's a regular file in the directory.
+// Symlinks are not followed, they could point outside of the directory.
+func (s *staging) stat(name string) (string, os.FileInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return "", nil, err
+	}
+	fi, err := os.Lstat(p)
+	if os.IsNotExist(err) {
+		return "", nil, fmt.Errorf("file %s not found", name)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return "", nil, fmt.Errorf("%s is not a regular file", name)
+	}
+	return p, fi, nil
+}
+
+// info returns the info of the file. The program is interpreted, unless it's cached.
+func (s *staging) info(name string) (*fileInfo, error) {
+	p, fi, err := s.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	info := s.cache[name]
+	s.mu.Unlock()
+	if info != nil && info.Size == fi.Size() && info.Modified.Equal(fi.ModTime()) {
+		return info, nil
+	}
+	info = &fileInfo{Name: name, Size: fi.Size(), Modified: fi.ModTime()}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if ext, err := gcode.Measure(f); err != nil {
+		info.Error = err.Error()
+	} else {
+		info.Lines, info.Moves = ext.Lines, ext.Moves
+		if ext.Moves > 0 {
+			info.Min, info.Max = &ext.Min, &ext.Max
+		}
+	}
+	s.mu.Lock()
+	s.cache[name] = info
+	s.mu.Unlock()
+	return info, nil
+}
+
+// list returns the info of all the programs sorted by name.
+func (s *staging) list() ([]*fileInfo, error) {
+	fis, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []*fileInfo{}
+	for _, fi := range fis {
+		if strings.HasPrefix(fi.Name(), ".") || !fi.Mode().IsRegular() {
+			continue
+		}
+		info, err := s.info(fi.Name())
+		if err != nil {
+			// The file may be deleted in the meantime.
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// remove deletes the file.
+func (s *staging) remove(name string) error {
+	p, _, err := s.stat(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// rename renames the file. An existing file is not replaced.
+func (s *staging) rename(from, to string) error {
+	src, _, err := s.stat(from)
+	if err != nil {
+		return err
+	}
+	return s.move(src, to)
+}
+
+// move gives the name to the file at the path. Unlike a rename, a link fails, if the file with the name
+// is created after the check, so an existing file is never replaced.
+func (s *staging) move(src, name string) error {
+	p, err := s.free(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Link(src, p); os.IsExist(err) {
+		return fmt.Errorf("file %s already exists", name)
+	} else if err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// upload is a file being uploaded. It's written to a hidden file, which gets the name,
+// once the upload is complete. Like rename, an upload does not replace an existing file.
+type upload struct {
+	s    *staging
+	name string
+	f    *os.File
+	size int64
+}
+
+// create starts the upload of the file.
+func (s *staging) create(name string) (*upload, error) {
+	if _, err := s.free(name); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(s.dir, ".upload-")
+	if err != nil {
+		return nil, err
+	}
+	return &upload{s: s, name: name, f: f}, nil
+}
+
+func (u *upload) Write(p []byte) (int, error) {
+	if u.size+int64(len(p)) > maxFileSize {
+		return 0, fmt.Errorf("%s is too large, the limit is %d bytes", u.name, maxFileSize)
+	}
+	n, err := u.f.Write(p)
+	u.size += int64(n)
+	return n, err
+}
+
+// commit completes the upload and returns the info of the file.
+func (u *upload) commit() (*fileInfo, error) {
+	if err := u.f.Close(); err != nil {
+		os.Remove(u.f.Name())
+		return nil, err
+	}
+	// The file may be created, while it's uploaded.
+	if err := u.s.move(u.f.Name(), u.name); err != nil {
+		os.Remove(u.f.Name())
+		return nil, err
+	}
+	log.Printf("Uploaded %s, %d bytes", u.name, u.size)
+	return u.s.info(u.name)
+}
+
+// abort cancels the upload.
+func (u *upload) abort() {
+	u.f.Close()
+	os.Remove(u.f.Name())
+}
+
+// save stores the file read from r.
+func (s *staging) save(name string, r io.Reader) (*fileInfo, error) {
+	u, err := s.create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(u, r); err != nil {
+		u.abort()
+		return nil, err
+	}
+	return u.commit()
+}
+
+// play checks the program against the policy and streams it to the machine.
+func (s *staging) play(m engine.Machine, pol *gcode.Policy, name string) (*engine.Job, error) {
+	p, _, err := s.stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return playFile(m, pol, p)
+}
+
+// ServeHTTP lists the files on GET and stores the files uploaded as multipart/form-data on POST.
+// The response is the json list of the files in the directory.
+func (s *staging) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+	case "POST":
+		req.Body = http.MaxBytesReader(w, req.Body, maxFileSize+1<<20)
+		mr, err := req.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if part.FormName() != "file" {
+				continue
+			}
+			if _, err := s.save(part.FileName(), part); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	default:
+		http.Error(w, "only GET and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	list, err := s.list()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(list); err != nil {
+		log.Print("Error: failed to write the list of the files, err: ", err)
+	}
+}
+
+// stagingCmd handles the terminal commands for the staging directory: $files lists the programs,
+// and $play <name> runs one. It returns false, if cmd is not such a command.
+func stagingCmd(w io.Writer, m engine.Machine, pol *gcode.Policy, s *staging, cmd string) bool {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 || (fields[0] != "$files" && fields[0] != "$play") {
+		return false
+	}
+	if s == nil {
+		fmt.Fprintln(w, "No staging directory is configured, use -staging")
+		return true
+	}
+	if fields[0] == "$files" {
+		list, err := s.list()
+		if err != nil {
+			fmt.Fprintln(w, err)
+			return true
+		}
+		for _, f := range list {
+			switch {
+			case f.Error != "":
+				fmt.Fprintf(w, "%s: %d bytes, invalid: %s\n", f.Name, f.Size, f.Error)
+			case f.Min == nil:
+				fmt.Fprintf(w, "%s: %d bytes, %d lines, no moves\n", f.Name, f.Size, f.Lines)
+			default:
+				fmt.Fprintf(w, "%s: %d bytes, %d lines, from %v to %v\n", f.Name, f.Size, f.Lines, *f.Min, *f.Max)
+			}
+		}
+		return true
+	}
+	if len(fields) != 2 {
+		fmt.Fprintln(w, "Usage: $play <name>")
+		return true
+	}
+	job, err := s.play(m, pol, fields[1])
+	if err != nil {
+		fmt.Fprintf(w, "Could not play %s: %v\n", fields[1], err)
+		return true
+	}
+	go watchJob(fields[1], job)
+	return true
+}
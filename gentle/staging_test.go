@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/gcode"
+	"github.com/samofly/gentle/tinyg/sim"
+)
+
+func TestStaging(t *testing.T) {
+	root, err := ioutil.TempDir("", "gentle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s, err := newStaging(filepath.Join(root, "staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "secret.nc"), []byte("G0 X1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "secret.nc"), filepath.Join(s.dir, "link.nc")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := s.save("square.nc", strings.NewReader("G21 G90\nG0 X0 Y0\nG1 X10 F300\nG1 Y10\nG1 X0\nG1 Y0\n"))
+	if err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if info.Lines != 6 || info.Moves != 5 || *info.Min != (gcode.Point{0, 0, 0}) || *info.Max != (gcode.Point{10, 10, 0}) {
+		t.Errorf("Unexpected info of square.nc: %+v", info)
+	}
+	if _, err := s.save("bad.nc", strings.NewReader("G1 X1\n")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	for _, name := range []string{"", ".", "..", "../secret.nc", "/etc/passwd", `..\secret.nc`, ".hidden", "link.nc"} {
+		if _, err := s.info(name); err == nil {
+			t.Errorf("info(%q): nil error, want: refused", name)
+		}
+		if _, err := s.save(name, strings.NewReader("G0 X1\n")); err == nil {
+			t.Errorf("save(%q): nil error, want: refused", name)
+		}
+	}
+	if _, err := s.save("square.nc", strings.NewReader("G0 X1\n")); err == nil {
+		t.Errorf("save of an existing file: nil error, want: refused")
+	}
+	u, err := s.create("late.nc")
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := s.save("late.nc", strings.NewReader("G0 X1\n")); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	io.WriteString(u, "G0 X2\n")
+	if _, err := u.commit(); err == nil || err.Error() != "file late.nc already exists" {
+		t.Errorf("commit of a file created during the upload: %v, want: already exists", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(s.dir, "late.nc")); err != nil || string(data) != "G0 X1\n" {
+		t.Errorf("The file created during the upload is replaced: %q, %v", data, err)
+	}
+	if err := s.remove("late.nc"); err != nil {
+		t.Errorf("remove: %v", err)
+	}
+	if err := s.rename("bad.nc", "../bad.nc"); err == nil {
+		t.Errorf("rename to ../bad.nc: nil error, want: refused")
+	}
+	if err := s.rename("bad.nc", "square.nc"); err == nil {
+		t.Errorf("rename to an existing file: nil error, want: refused")
+	}
+	if err := s.rename("bad.nc", "worse.nc"); err != nil {
+		t.Errorf("rename: %v", err)
+	}
+
+	list, err := s.list()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var names []string
+	for _, f := range list {
+		names = append(names, f.Name)
+	}
+	if got, want := strings.Join(names, " "), "square.nc worse.nc"; got != want {
+		t.Errorf("list: %s, want: %s", got, want)
+	}
+	if list[1].Error != "line 1: feed rate is not set" {
+		t.Errorf("worse.nc error: %q, want: feed rate is not set", list[2].Error)
+	}
+	if err := s.remove("worse.nc"); err != nil {
+		t.Errorf("remove: %v", err)
+	}
+	if err := s.remove("worse.nc"); err == nil {
+		t.Errorf("remove of a missing file: nil error, want: not found")
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(root, "secret.nc")); err != nil || string(data) != "G0 X1\n" {
+		t.Errorf("The file outside of the staging directory is changed: %q, %v", data, err)
+	}
+}
+
+func TestStagingHTTP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gentle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := newStaging(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	upload := func(name, data string) (*http.Response, error) {
+		var body bytes.Buffer
+		w := multipart.NewWriter(&body)
+		f, err := w.CreateFormFile("file", name)
+		if err != nil {
+			return nil, err
+		}
+		f.Write([]byte(data))
+		w.Close()
+		return http.Post(srv.URL, w.FormDataContentType(), &body)
+	}
+	resp, err := upload("a.nc", "G0 X5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var list []*fileInfo
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || len(list) != 1 || list[0].Name != "a.nc" || list[0].Lines != 1 {
+		t.Errorf("Upload: %s, %+v, %v, want: a.nc with 1 line", resp.Status, list, err)
+	}
+	for _, name := range []string{"a.nc", ".a.nc"} {
+		resp, err = upload(name, "G0 X5\n")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("Upload of %s: %s, want: 400", name, resp.Status)
+		}
+	}
+}
+
+func TestStagingProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gentle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, err := newStaging(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := sim.New()
+	defer dev.Close()
+	dev.SetSpeed(100)
+	m := engine.New(dev, true)
+
+	out := make(chanWriter, 10)
+	c := newClient(&server{m: m, policy: gcode.DefaultPolicy(), jsonMode: true, files: files}, out, "")
+	defer c.close()
+
+	tests := []struct {
+		req  string
+		kind engine.ErrorKind
+	}{
+		{req: `{"v":1,"id":1,"cmd":"upload","args":{"name":"a.nc","offset":0,"data":"G0 X1\n"}}`},
+		{req: `{"v":1,"id":2,"cmd":"upload","args":{"name":"a.nc","offset":3,"data":"G0 X2\n"}}`, kind: RequestError},
+		{req: `{"v":1,"id":3,"cmd":"upload","args":{"name":"a.nc","offset":6,"data":"G0 X2\n","eof":true}}`},
+		{req: `{"v":1,"id":4,"cmd":"upload","args":{"name":"../a.nc","offset":0,"data":"G0 X2\n"}}`, kind: RequestError},
+		{req: `{"v":1,"id":"4a","cmd":"upload","args":{"name":"a.nc","offset":0,"data":"G0 X2\n"}}`, kind: RequestError},
+		{req: `{"v":1,"id":5,"cmd":"rename","args":{"from":"a.nc","to":"b.nc"}}`},
+		{req: `{"v":1,"id":6,"cmd":"files"}`},
+		{req: `{"v":1,"id":7,"cmd":"play","args":{"name":"b.nc"}}`},
+		{req: `{"v":1,"id":8,"cmd":"play","args":{"name":"a.nc"}}`, kind: RequestError},
+		{req: `{"v":1,"id":9,"cmd":"delete","args":{"name":"b.nc"}}`},
+	}
+	for _, tt := range tests {
+		var req request
+		if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+			t.Fatal(err)
+		}
+		c.handle(&req)
+		var r struct {
+			Result json.RawMessage `json:"result"`
+			Error  *engine.Error   `json:"error"`
+		}
+		if err := json.Unmarshal(<-out, &r); err != nil {
+			t.Fatal(err)
+		}
+		var kind engine.ErrorKind
+		if r.Error != nil {
+			kind = r.Error.Kind
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: error %v, want kind %q", tt.req, r.Error, tt.kind)
+		}
+		if req.Cmd == "files" && !strings.Contains(string(r.Result), `"name":"b.nc","size":12`) {
+			t.Errorf("files: %s, want: b.nc of 12 bytes", r.Result)
+		}
+	}
+	if err := m.Job().Wait(); err != nil {
+		t.Errorf("Job b.nc: %v", err)
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// role defines the commands, which a user may use.
+type role string
+
+const (
+	// viewer only watches the state of the machine and the jobs.
+	viewer role = "viewer"
+
+	// operator controls the machine: jogs, homes, sends g-code and runs jobs.
+	operator role = "operator"
+
+	// admin also connects the machine, overrides the interlocks and manages the users.
+	admin role = "admin"
+)
+
+// roleLevels order the roles: a role may do everything the lower ones may.
+var roleLevels = map[role]int{viewer: 1, operator: 2, admin: 3}
+
+// allows returns true, if the role may do what the needed role may.
+func (r role) allows(need role) bool {
+	return roleLevels[r] > 0 && roleLevels[r] >= roleLevels[need]
+}
+
+const (
+	// sessionCookie is the name of the cookie with the session token.
+	sessionCookie = "gentle_session"
+
+	// sessionTTL is the time a login is valid for.
+	sessionTTL = 12 * time.Hour
+
+	// minPassword is the minimum length of a password.
+	minPassword = 8
+)
+
+// bcryptCost is the cost of the password hashes. The tests lower it to run faster.
+var bcryptCost = bcrypt.DefaultCost
+
+// user is a user account.
+type user struct {
+	Name string `json:"name"`
+	Role role   `json:"role"`
+
+	// Hash is the bcrypt hash of the password. It's never sent to the clients.
+	Hash string `json:"hash,omitempty"`
+}
+
+// session is a login of a user.
+type session struct {
+	name    string
+	expires time.Time
+}
+
+// users are the user accounts stored in a json file, and their sessions, which are only kept in memory,
+// so that the users log in again, once the server is restarted.
+type users struct {
+	path string
+
+	mu       sync.Mutex
+	byName   map[string]*user
+	sessions map[string]*session
+
+	// dummy is the hash checked, when the user is not found, so that the time of a failed login
+	// does not tell whether the user exists.
+	dummy []byte
+}
+
+// loadUsers reads the user accounts from the file. A missing file means no users yet:
+// it's created, once a user is added.
+func loadUsers(path string) (*users, error) {
+	dummy, err := bcrypt.GenerateFromPassword([]byte("no such user"), bcryptCost)
+	if err != nil {
+		return nil, err
+	}
+	u := &users{path: path, byName: make(map[string]*user), sessions: make(map[string]*session), dummy: dummy}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return u, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var list []*user
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("malformed users file %s: %v", path, err)
+	}
+	for _, usr := range list {
+		if roleLevels[usr.Role] == 0 {
+			return nil, fmt.Errorf("users file %s: user %s has unknown role %q", path, usr.Name, usr.Role)
+		}
+		u.byName[usr.Name] = usr
+	}
+	return u, nil
+}
+
+// save writes the accounts to the file. The file is replaced at once, so that it's never half-written.
+// The caller must hold the lock.
+func (u *users) save() error {
+	list := make([]*user, 0, len(u.byName))
+	for _, usr := range u.byName {
+		list = append(list, usr)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(u.path), ".users-")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), u.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// list returns the accounts without the password hashes, sorted by name.
+func (u *users) list() []*user {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	list := []*user{}
+	for _, usr := range u.byName {
+		list = append(list, &user{Name: usr.Name, Role: usr.Role})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// add creates an account. An existing one is not replaced: it must be removed first.
+func (u *users) add(name, password string, r role) error {
+	if name == "" || strings.IndexFunc(name, func(c rune) bool { return c <= ' ' || c == '"' }) >= 0 {
+		return fmt.Errorf("invalid user name %q", name)
+	}
+	if roleLevels[r] == 0 {
+		return fmt.Errorf("invalid role %q, want viewer, operator or admin", r)
+	}
+	if len(password) < minPassword {
+		return fmt.Errorf("the password is too short, want at least %d characters", minPassword)
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.byName[name]; ok {
+		return fmt.Errorf("user %s already exists", name)
+	}
+	u.byName[name] = &user{Name: name, Role: r, Hash: string(hash)}
+	if err := u.save(); err != nil {
+		delete(u.byName, name)
+		return err
+	}
+	log.Printf("User %s is added as %s", name, r)
+	return nil
+}
+
+// remove deletes the account and ends its sessions.
+func (u *users) remove(name string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	usr, ok := u.byName[name]
+	if !ok {
+		return fmt.Errorf("user %s not found", name)
+	}
+	delete(u.byName, name)
+	if err := u.save(); err != nil {
+		u.byName[name] = usr
+		return err
+	}
+	for token, s := range u.sessions {
+		if s.name == name {
+			delete(u.sessions, token)
+		}
+	}
+	log.Printf("User %s is removed", name)
+	return nil
+}
+
+// login checks the password and starts a session. It returns the token of the session.
+func (u *users) login(name, password string) (string, *user, error) {
+	u.mu.Lock()
+	usr := u.byName[name]
+	u.mu.Unlock()
+	hash := u.dummy
+	if usr != nil {
+		hash = []byte(usr.Hash)
+	}
+	if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); err != nil || usr == nil {
+		log.Printf("Failed login of %q", name)
+		return "", nil, fmt.Errorf("invalid user name or password")
+	}
+	var b [32]byte
+	if _, err := io.ReadFull(rand.Reader, b[:]); err != nil {
+		return "", nil, err
+	}
+	token := hex.EncodeToString(b[:])
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for t, s := range u.sessions {
+		if time.Now().After(s.expires) {
+			delete(u.sessions, t)
+		}
+	}
+	u.sessions[token] = &session{name: name, expires: time.Now().Add(sessionTTL)}
+	log.Printf("User %s logged in", name)
+	return token, &user{Name: usr.Name, Role: usr.Role}, nil
+}
+
+// logout ends the session.
+func (u *users) logout(token string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.sessions, token)
+}
+
+// lookup returns the user of the session, or nil, if the session is not valid.
+// The account is looked up every time, so that a removed user can't go on.
+func (u *users) lookup(token string) *user {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	s := u.sessions[token]
+	if s == nil || time.Now().After(s.expires) {
+		return nil
+	}
+	usr := u.byName[s.name]
+	if usr == nil {
+		return nil
+	}
+	return &user{Name: usr.Name, Role: usr.Role}
+}
+
+// sessionToken returns the session token of the request, if any.
+func sessionToken(req *http.Request) string {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return ""
+	}
+	return c.Value
+}
+
+// sameOrigin returns false, if the request comes from a page of another site.
+// The browsers send the cookies with such requests, so they must not be trusted.
+// The clients, which are not browsers, don't send the origin.
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+// handleLogin checks the name and the password posted as a form, and sets the session cookie.
+// The reply is the json of the user.
+func (u *users) handleLogin(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(req) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	token, usr, err := u.login(req.FormValue("name"), req.FormValue("password"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", MaxAge: int(sessionTTL / time.Second), HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(usr); err != nil {
+		log.Print("Error: failed to write the user, err: ", err)
+	}
+}
+
+// handleLogout ends the session and clears the cookie.
+func (u *users) handleLogout(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	if !sameOrigin(req) {
+		http.Error(w, "cross-origin request", http.StatusForbidden)
+		return
+	}
+	u.logout(sessionToken(req))
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteStrictMode})
+}
+
+// require lets through only the requests of the users logged in with the role. The requests, which are not
+// GET, need the role write, since they change something.
+func (u *users) require(read, write role, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		need := read
+		if req.Method != "GET" {
+			need = write
+		}
+		if !sameOrigin(req) {
+			http.Error(w, "cross-origin request", http.StatusForbidden)
+			return
+		}
+		usr := u.lookup(sessionToken(req))
+		if usr == nil {
+			http.Error(w, "log in first", http.StatusUnauthorized)
+			return
+		}
+		if !usr.Role.allows(need) {
+			http.Error(w, fmt.Sprintf("%s can't do that, it needs %s", usr.Role, need), http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// usersCmd handles the terminal commands, which manage the users: $users lists them,
+// $useradd <name> <role> <password> adds one and $userdel <name> removes one.
+// It returns false, if cmd is not such a command.
+func usersCmd(w io.Writer, u *users, cmd string) bool {
+	fields := strings.Fields(cmd)
+	if len(fields) == 0 || (fields[0] != "$users" && fields[0] != "$useradd" && fields[0] != "$userdel") {
+		return false
+	}
+	if u == nil {
+		fmt.Fprintln(w, "No user accounts are configured, use -users")
+		return true
+	}
+	var err error
+	switch {
+	case fields[0] == "$users" && len(fields) == 1:
+		for _, usr := range u.list() {
+			fmt.Fprintf(w, "%s: %s\n", usr.Name, usr.Role)
+		}
+	case fields[0] == "$useradd" && len(fields) == 4:
+		err = u.add(fields[1], fields[3], role(fields[2]))
+	case fields[0] == "$userdel" && len(fields) == 2:
+		err = u.remove(fields[1])
+	default:
+		err = fmt.Errorf("Usage: $users, $useradd <name> <viewer|operator|admin> <password> or $userdel <name>")
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/samofly/gentle/engine"
+	"github.com/samofly/gentle/gcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testUsers returns the users stored in a temporary directory: admin ann, operator bob and viewer eve.
+// The password of each is the name repeated twice and "pass".
+func testUsers(t *testing.T) (*users, string) {
+	bcryptCost = bcrypt.MinCost
+	dir, err := ioutil.TempDir("", "gentle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := loadUsers(filepath.Join(dir, "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, usr := range []*user{{Name: "ann", Role: admin}, {Name: "bob", Role: operator}, {Name: "eve", Role: viewer}} {
+		if err := u.add(usr.Name, usr.Name+usr.Name+"pass", usr.Role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return u, dir
+}
+
+func TestUsers(t *testing.T) {
+	u, dir := testUsers(t)
+	defer os.RemoveAll(dir)
+
+	for _, tt := range []struct{ name, password, role string }{
+		{"ann", "anotherpass", "admin"},
+		{"", "longenough", "admin"},
+		{"two words", "longenough", "admin"},
+		{"joe", "short", "admin"},
+		{"joe", "longenough", "root"},
+	} {
+		if err := u.add(tt.name, tt.password, role(tt.role)); err == nil {
+			t.Errorf("add(%q, %q, %q): nil error, want: refused", tt.name, tt.password, tt.role)
+		}
+	}
+
+	// The accounts are stored with the hashes of the passwords.
+	data, err := ioutil.ReadFile(u.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "annannpass") || !strings.Contains(string(data), `"hash": "$2a$`) {
+		t.Errorf("Unexpected users file: %s", data)
+	}
+	loaded, err := loadUsers(u.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, _ := json.Marshal(loaded.list())
+	if want := `[{"name":"ann","role":"admin"},{"name":"bob","role":"operator"},{"name":"eve","role":"viewer"}]`; string(list) != want {
+		t.Errorf("list: %s, want: %s", list, want)
+	}
+
+	if _, _, err := u.login("bob", "annannpass"); err == nil {
+		t.Errorf("login with a wrong password: nil error, want: refused")
+	}
+	if _, _, err := u.login("joe", "joejoepass"); err == nil {
+		t.Errorf("login of an unknown user: nil error, want: refused")
+	}
+	token, usr, err := u.login("bob", "bobbobpass")
+	if err != nil || usr.Name != "bob" || usr.Role != operator || usr.Hash != "" {
+		t.Fatalf("login: %+v, %v, want: bob, operator", usr, err)
+	}
+	if usr := u.lookup(token); usr == nil || usr.Name != "bob" {
+		t.Errorf("lookup: %+v, want: bob", usr)
+	}
+	if err := u.remove("bob"); err != nil {
+		t.Errorf("remove: %v", err)
+	}
+	if usr := u.lookup(token); usr != nil {
+		t.Errorf("lookup after the user is removed: %+v, want: nil", usr)
+	}
+}
+
+func TestUsersHTTP(t *testing.T) {
+	u, dir := testUsers(t)
+	defer os.RemoveAll(dir)
+	files, err := newStaging(filepath.Join(dir, "staging"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{m: engine.NewSwitch(true), policy: gcode.DefaultPolicy(), jsonMode: true, files: files, users: u}
+	srv := httptest.NewServer(s.mux())
+	defer srv.Close()
+
+	login := func(name, password string) (*http.Cookie, int) {
+		resp, err := http.PostForm(srv.URL+"/login", url.Values{"name": {name}, "password": {password}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		for _, c := range resp.Cookies() {
+			if c.Name == sessionCookie {
+				return c, resp.StatusCode
+			}
+		}
+		return nil, resp.StatusCode
+	}
+	if c, code := login("eve", "bobbobpass"); c != nil || code != http.StatusUnauthorized {
+		t.Errorf("Login with a wrong password: %v, %d, want: no cookie, 401", c, code)
+	}
+	eve, code := login("eve", "eveevepass")
+	if eve == nil || code != http.StatusOK {
+		t.Fatalf("Login: %v, %d, want: the session cookie, 200", eve, code)
+	}
+	if !eve.HttpOnly || eve.SameSite != http.SameSiteStrictMode {
+		t.Errorf("Session cookie: %v, want: HttpOnly and SameSite=Strict", eve)
+	}
+
+	tests := []struct {
+		method, path, origin string
+		cookie               *http.Cookie
+		code                 int
+	}{
+		{method: "GET", path: "/ws", code: http.StatusUnauthorized},
+		{method: "GET", path: "/ws", cookie: &http.Cookie{Name: sessionCookie, Value: "forged"}, code: http.StatusUnauthorized},
+		{method: "GET", path: "/ws", cookie: eve, origin: "http://evil.example.com", code: http.StatusForbidden},
+		{method: "GET", path: "/files", code: http.StatusUnauthorized},
+		{method: "GET", path: "/files", cookie: eve, code: http.StatusOK},
+		{method: "POST", path: "/files", cookie: eve, code: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req, err := http.NewRequest(tt.method, srv.URL+tt.path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tt.cookie != nil {
+			req.AddCookie(tt.cookie)
+		}
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.code {
+			t.Errorf("%s %s (cookie %v, origin %q): %s, want: %d", tt.method, tt.path, tt.cookie, tt.origin, resp.Status, tt.code)
+		}
+	}
+}
+
+func TestUsersProtocol(t *testing.T) {
+	u, dir := testUsers(t)
+	defer os.RemoveAll(dir)
+	m := engine.NewSwitch(true)
+	defer m.Disconnect()
+	s := &server{m: m, policy: gcode.DefaultPolicy(), jsonMode: true, users: u}
+	session := func(name string) string {
+		token, _, err := u.login(name, name+name+"pass")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	tokens := map[string]string{"ann": session("ann"), "bob": session("bob"), "eve": session("eve"), "nobody": "forged"}
+
+	tests := []struct {
+		user, req string
+		kind      engine.ErrorKind
+	}{
+		{user: "nobody", req: `{"v":1,"id":1,"cmd":"hello"}`, kind: PermissionError},
+		{user: "eve", req: `{"v":1,"id":2,"cmd":"hello"}`},
+		{user: "eve", req: `{"v":1,"id":3,"cmd":"state"}`},
+		{user: "eve", req: `{"v":1,"id":4,"cmd":"send","args":{"gcode":"G0 X1"}}`, kind: PermissionError},
+		{user: "eve", req: `{"v":1,"id":5,"cmd":"hold"}`, kind: PermissionError},
+		{user: "bob", req: `{"v":1,"id":6,"cmd":"send","args":{"gcode":"G0 X1"}}`, kind: engine.DroppedError},
+		{user: "bob", req: `{"v":1,"id":7,"cmd":"override","args":{"on":true}}`, kind: PermissionError},
+		{user: "bob", req: `{"v":1,"id":8,"cmd":"users"}`, kind: PermissionError},
+		{user: "ann", req: `{"v":1,"id":9,"cmd":"adduser","args":{"name":"joe","role":"viewer","password":"joejoepass"}}`},
+		{user: "ann", req: `{"v":1,"id":10,"cmd":"deluser","args":{"name":"eve"}}`},
+		{user: "ann", req: `{"v":1,"id":11,"cmd":"users"}`},
+		{user: "eve", req: `{"v":1,"id":12,"cmd":"state"}`, kind: PermissionError},
+	}
+	for _, tt := range tests {
+		out := make(chanWriter, 10)
+		c := newClient(s, out, tokens[tt.user])
+		var req request
+		if err := json.Unmarshal([]byte(tt.req), &req); err != nil {
+			t.Fatal(err)
+		}
+		c.handle(&req)
+		var r struct {
+			Result json.RawMessage `json:"result"`
+			Error  *engine.Error   `json:"error"`
+		}
+		if err := json.Unmarshal(<-out, &r); err != nil {
+			t.Fatal(err)
+		}
+		c.close()
+		var kind engine.ErrorKind
+		if r.Error != nil {
+			kind = r.Error.Kind
+		}
+		if kind != tt.kind {
+			t.Errorf("%s: %s: error %v, want kind %q", tt.user, tt.req, r.Error, tt.kind)
+		}
+		switch req.Cmd {
+		case "hello":
+			if kind == "" && (strings.Contains(string(r.Result), `"send"`) || !strings.Contains(string(r.Result), `"user":{"name":"eve","role":"viewer"}`)) {
+				t.Errorf("hello of a viewer: %s, want: no send, user eve", r.Result)
+			}
+		case "users":
+			if want := `[{"name":"ann","role":"admin"},{"name":"bob","role":"operator"},{"name":"joe","role":"viewer"}]`; kind == "" && string(r.Result) != want {
+				t.Errorf("users: %s, want: %s", r.Result, want)
+			}
+		}
+	}
+
+	// The commands of the old protocol need the roles of the matching commands.
+	raws := []struct {
+		user, raw string
+		denied    bool
+	}{
+		{user: "bob", raw: "$override on", denied: true},
+		{user: "bob", raw: `{"xvm":16000}`, denied: true},
+		{user: "bob", raw: `{"sr":{"posx":true}}`, denied: true},
+		{user: "bob", raw: "G0 X1 ;\n$xvm=1", denied: true},
+		{user: "bob", raw: "G0 X1 (\n$xvm=1\n)", denied: true},
+		{user: "bob", raw: `{"sr":""}`},
+		{user: "bob", raw: `{"gc":"G0 X1"}`},
+		{user: "bob", raw: "$home x"},
+		{user: "ann", raw: "$override on"},
+		{user: "ann", raw: `{"xvm":16000}`},
+	}
+	for _, tt := range raws {
+		out := make(chanWriter, 10)
+		c := newClient(s, out, tokens[tt.user])
+		c.handleRaw(tt.raw)
+		c.close()
+		var msg engine.Message
+		select {
+		case data := <-out:
+			if err := json.Unmarshal(data, &msg); err != nil {
+				t.Fatal(err)
+			}
+		default:
+		}
+		denied := msg.Error != nil && strings.Contains(msg.Error.Msg, "may not do that")
+		if denied != tt.denied {
+			t.Errorf("%s: %s: %+v, want denied: %v", tt.user, tt.raw, msg.Error, tt.denied)
+		}
+	}
+	for name, h := range handlers {
+		if roleLevels[h.role] == 0 {
+			t.Errorf("Command %s needs no role", name)
+		}
+	}
+	for raw, name := range rawCmds {
+		if _, ok := handlers[name]; !ok {
+			t.Errorf("Command %s of the old protocol matches the unknown command %s", raw, name)
+		}
+	}
+}
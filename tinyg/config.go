@@ -0,0 +1,310 @@
+package tinyg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strings"
+)
+
+// ConfigVersion is the version of the format of the configuration snapshots.
+// It's increased, when the format changes incompatibly.
+const ConfigVersion = 1
+
+// Groups of settings in the TinyG configuration.
+var (
+	// MotorGroups are the names of the per-motor groups.
+	MotorGroups = []string{"1", "2", "3", "4"}
+
+	// AxisGroups are the names of the per-axis groups.
+	AxisGroups = []string{"x", "y", "z", "a", "b", "c"}
+)
+
+// Group is a group of settings, such as the settings of an axis. The settings are named
+// without the group prefix: for example, "vm" in the "x" group is the xvm setting.
+// The values are numbers, or strings for a few system settings like id.
+type Group map[string]interface{}
+
+// Config is a snapshot of the TinyG configuration: the system group and the groups
+// of the motors and the axes. It's saved as json, which is meant to be edited by hand:
+//
+//	{
+//	  "version": 1,
+//	  "build": 440.2,
+//	  "sys": {"ja": 2000000, "ct": 0.01, ...},
+//	  "motors": {"1": {"ma": 0, "sa": 1.8, ...}, ...},
+//	  "axes": {"x": {"am": 1, "vm": 16000, ...}, ...}
+//	}
+type Config struct {
+	// Version is the version of the snapshot format, ConfigVersion.
+	Version int `json:"version"`
+
+	// Build is the firmware build, which the configuration was read from.
+	Build float64 `json:"build,omitempty"`
+
+	Sys    Group            `json:"sys"`
+	Motors map[string]Group `json:"motors"`
+	Axes   map[string]Group `json:"axes"`
+}
+
+// Query sends a json command to TinyG and returns the response to it.
+// If TinyG rejects the command, the response with the footer is returned together with an error.
+type Query func(cmd string) (*Response, error)
+
+// groupNames returns the names of all the groups in the order they are read.
+func groupNames() []string {
+	names := []string{"sys"}
+	names = append(names, MotorGroups...)
+	return append(names, AxisGroups...)
+}
+
+// Group returns the settings of a group by its name, such as "sys", "1" or "x".
+func (c *Config) Group(name string) Group {
+	if name == "sys" {
+		return c.Sys
+	}
+	if g, ok := c.Motors[name]; ok {
+		return g
+	}
+	return c.Axes[name]
+}
+
+// Groups returns the names of the groups present in the configuration in the order they are read.
+func (c *Config) Groups() []string {
+	var names []string
+	for _, name := range groupNames() {
+		if c.Group(name) != nil {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+func (c *Config) setGroup(name string, g Group) {
+	switch {
+	case name == "sys":
+		c.Sys = g
+	case contains(MotorGroups, name):
+		if c.Motors == nil {
+			c.Motors = make(map[string]Group)
+		}
+		c.Motors[name] = g
+	default:
+		if c.Axes == nil {
+			c.Axes = make(map[string]Group)
+		}
+		c.Axes[name] = g
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseGroup returns the group of settings from the response to the group query, like {"x":n}.
+func ParseGroup(r *Response, name string) (Group, error) {
+	var body map[string]Group
+	if err := json.Unmarshal(r.Body, &body); err != nil {
+		return nil, fmt.Errorf("malformed response to the %s group query: %v", name, err)
+	}
+	g, ok := body[name]
+	if !ok {
+		return nil, fmt.Errorf("no %s group in the response: %s", name, r.Body)
+	}
+	return g, nil
+}
+
+// ReadConfig reads all the groups of the configuration with the queries.
+// The axes which are not known to TinyG are skipped.
+func ReadConfig(query Query) (*Config, error) {
+	c := &Config{Version: ConfigVersion}
+	for _, name := range groupNames() {
+		r, err := query(fmt.Sprintf(`{"%s":n}`, name))
+		if r != nil && r.Footer != nil && r.Footer.Status == StatUnrecognizedName && contains(AxisGroups, name) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the %s group: %v", name, err)
+		}
+		g, err := ParseGroup(r, name)
+		if err != nil {
+			return nil, err
+		}
+		c.setGroup(name, g)
+	}
+	if fb, ok := c.Sys["fb"].(float64); ok {
+		c.Build = fb
+	}
+	return c, nil
+}
+
+// Save writes the configuration to a json file.
+func (c *Config) Save(name string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, append(data, '\n'), 0644)
+}
+
+// LoadConfig reads the configuration from a json file.
+func LoadConfig(name string) (*Config, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var c Config
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	if c.Version != ConfigVersion {
+		return nil, fmt.Errorf("%s: unsupported version %d of the config, want: %d", name, c.Version, ConfigVersion)
+	}
+	return &c, nil
+}
+
+// ReadOnly are the settings, which can't be changed: the firmware and the hardware identity.
+var ReadOnly = map[string]bool{"fb": true, "fv": true, "hp": true, "hv": true, "id": true}
+
+// Setting returns the name of a setting in a group as TinyG knows it, for example, "xvm".
+// The system settings have no prefix.
+func Setting(group, name string) string {
+	if group == "sys" {
+		return name
+	}
+	return group + name
+}
+
+// settings returns all the settings by their TinyG names, and the names in the order they are read.
+func (c *Config) settings() (map[string]interface{}, []string) {
+	values := make(map[string]interface{})
+	var order []string
+	for _, group := range c.Groups() {
+		g := c.Group(group)
+		var names []string
+		for name := range g {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			k := Setting(group, name)
+			values[k] = g[name]
+			order = append(order, k)
+		}
+	}
+	return values, order
+}
+
+// sameValue returns true, if the values are equal up to the rounding of TinyG,
+// which stores floats with the single precision and reports them with 3 decimals.
+func sameValue(a, b interface{}) bool {
+	x, ok1 := a.(float64)
+	y, ok2 := b.(float64)
+	if !ok1 || !ok2 {
+		return a == b
+	}
+	return math.Abs(x-y) <= 5e-4+1e-6*math.Max(math.Abs(x), math.Abs(y))
+}
+
+// Change is a setting, which differs between two configurations.
+type Change struct {
+	// Setting is the TinyG name of the setting, such as "xvm".
+	Setting string
+
+	// Old is the live value. It's nil, if the machine has no such setting.
+	Old interface{}
+
+	// New is the value to set.
+	New interface{}
+}
+
+func (ch Change) String() string {
+	if ch.Old == nil {
+		return fmt.Sprintf("%s: (missing) -> %v", ch.Setting, ch.New)
+	}
+	return fmt.Sprintf("%s: %v -> %v", ch.Setting, ch.Old, ch.New)
+}
+
+// Diff returns the settings of c, which differ from the live configuration.
+// The read-only settings are skipped.
+func (c *Config) Diff(live *Config) []Change {
+	want, order := c.settings()
+	have, _ := live.settings()
+	var changes []Change
+	for _, k := range order {
+		if ReadOnly[k] {
+			continue
+		}
+		if old, ok := have[k]; !ok || !sameValue(old, want[k]) {
+			changes = append(changes, Change{Setting: k, Old: old, New: want[k]})
+		}
+	}
+	return changes
+}
+
+// ConfigError tells which settings could not be applied.
+type ConfigError struct {
+	// Rejected are the settings rejected by TinyG with the reasons.
+	Rejected map[string]error
+
+	// Unchanged are the settings, which were accepted, but read back with another value.
+	// Old is the value read back.
+	Unchanged []Change
+}
+
+func (e *ConfigError) Error() string {
+	var parts []string
+	var names []string
+	for k := range e.Rejected {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	for _, k := range names {
+		parts = append(parts, fmt.Sprintf("%s rejected: %v", k, e.Rejected[k]))
+	}
+	for _, ch := range e.Unchanged {
+		parts = append(parts, fmt.Sprintf("%s did not stick: %v, want: %v", ch.Setting, ch.Old, ch.New))
+	}
+	return "failed to apply the config: " + strings.Join(parts, "; ")
+}
+
+// Apply sends the changes to TinyG one at a time, waiting for each to be acknowledged.
+// Then it reads the configuration back and verifies that the changes stuck.
+// If some changes are not applied, a *ConfigError is returned.
+func Apply(query Query, changes []Change) error {
+	e := &ConfigError{Rejected: make(map[string]error)}
+	for _, ch := range changes {
+		cmd, err := json.Marshal(map[string]interface{}{ch.Setting: ch.New})
+		if err != nil {
+			e.Rejected[ch.Setting] = err
+			continue
+		}
+		if _, err := query(string(cmd)); err != nil {
+			e.Rejected[ch.Setting] = err
+		}
+	}
+	live, err := ReadConfig(query)
+	if err != nil {
+		return fmt.Errorf("failed to read the config back: %v", err)
+	}
+	have, _ := live.settings()
+	for _, ch := range changes {
+		if _, ok := e.Rejected[ch.Setting]; ok {
+			continue
+		}
+		if v := have[ch.Setting]; !sameValue(v, ch.New) {
+			e.Unchanged = append(e.Unchanged, Change{Setting: ch.Setting, Old: v, New: ch.New})
+		}
+	}
+	if len(e.Rejected) > 0 || len(e.Unchanged) > 0 {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package tinyg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeQuery answers the group queries with the groups, and rejects the unknown ones.
+func fakeQuery(groups map[string]string) Query {
+	return func(cmd string) (*Response, error) {
+		for name, g := range groups {
+			if cmd == fmt.Sprintf(`{"%s":n}`, name) {
+				return ParseResponse(fmt.Sprintf(`{"r":{"%s":%s},"f":[1,0,254,0]}`, name, g))
+			}
+		}
+		r, err := ParseResponse(`{"r":{},"f":[1,100,254,0]}`)
+		if err != nil {
+			return nil, err
+		}
+		return r, fmt.Errorf("status %v", r.Footer.Status)
+	}
+}
+
+func TestReadConfig(t *testing.T) {
+	groups := map[string]string{
+		"sys": `{"fb":440.20,"id":"3X3566-YMX","ja":2000000}`,
+		"1":   `{"ma":0,"sa":1.8}`, "2": `{"ma":1}`, "3": `{"ma":2}`, "4": `{"ma":3}`,
+		"x": `{"am":1,"vm":16000}`, "y": `{"am":1}`, "z": `{"am":1}`, "a": `{"am":3}`,
+	}
+	c, err := ReadConfig(fakeQuery(groups))
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if c.Version != ConfigVersion || c.Build != 440.20 || c.Sys["id"] != "3X3566-YMX" || c.Axes["x"]["vm"] != 16000.0 || c.Motors["1"]["sa"] != 1.8 {
+		t.Errorf("Unexpected config: %+v", c)
+	}
+	want := []string{"sys", "1", "2", "3", "4", "x", "y", "z", "a"}
+	if got := c.Groups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Groups() = %v, want: %v (b and c are not known to the machine)", got, want)
+	}
+
+	delete(groups, "2")
+	if _, err := ReadConfig(fakeQuery(groups)); err == nil {
+		t.Errorf("ReadConfig without motor 2: nil error, want: failed to read the 2 group")
+	}
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "tinyg.json")
+	if err := c.Save(name); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	loaded, err := LoadConfig(name)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, c) {
+		t.Errorf("LoadConfig: %+v, want: %+v", loaded, c)
+	}
+
+	if err := ioutil.WriteFile(name, []byte(`{"version":2,"sys":{}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(name); err == nil {
+		t.Errorf("LoadConfig of version 2: nil error, want: unsupported version")
+	}
+}
+
+// fakeDevice keeps the settings by groups. It silently ignores the settings in ignore.
+type fakeDevice struct {
+	groups map[string]map[string]interface{}
+	ignore map[string]bool
+	sent   []string
+}
+
+func (d *fakeDevice) query(cmd string) (*Response, error) {
+	for name, g := range d.groups {
+		if cmd == fmt.Sprintf(`{"%s":n}`, name) {
+			data, err := json.Marshal(map[string]interface{}{name: g})
+			if err != nil {
+				return nil, err
+			}
+			return ParseResponse(fmt.Sprintf(`{"r":%s,"f":[1,0,254,0]}`, data))
+		}
+	}
+	if !strings.HasSuffix(cmd, ":n}") {
+		d.sent = append(d.sent, cmd)
+	}
+	var set map[string]interface{}
+	if err := json.Unmarshal([]byte(cmd), &set); err == nil && len(set) == 1 {
+		for k, v := range set {
+			for name, g := range d.groups {
+				key := strings.TrimPrefix(k, name)
+				if _, ok := g[key]; ok && Setting(name, key) == k {
+					if !d.ignore[k] {
+						g[key] = v
+					}
+					return ParseResponse(`{"r":{},"f":[1,0,254,0]}`)
+				}
+			}
+		}
+	}
+	r, err := ParseResponse(`{"r":{},"f":[1,100,254,0]}`)
+	if err != nil {
+		return nil, err
+	}
+	return r, fmt.Errorf("status %v", r.Footer.Status)
+}
+
+func TestApply(t *testing.T) {
+	d := &fakeDevice{
+		groups: map[string]map[string]interface{}{
+			"sys": {"fb": 440.20, "ja": 2000000.0}, "1": {"sa": 1.8}, "2": {"sa": 1.8}, "3": {"sa": 1.8}, "4": {"sa": 1.8},
+			"x": {"vm": 16000.0, "jm": 5e9, "tm": 300.0},
+		},
+		ignore: map[string]bool{"xjm": true},
+	}
+	saved := &Config{
+		Version: ConfigVersion,
+		Sys:     Group{"fb": 380.08, "ja": 2000000.0},
+		Motors:  map[string]Group{"1": {"sa": 0.9}, "2": {"sa": 1.8}, "3": {"sa": 1.8}, "4": {"sa": 1.8}},
+		Axes:    map[string]Group{"x": {"vm": 12000.0, "jm": 1e9, "tm": 300.0004, "zz": 1.0}},
+	}
+	live, err := ReadConfig(d.query)
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	changes := saved.Diff(live)
+	var got []string
+	for _, ch := range changes {
+		got = append(got, ch.String())
+	}
+	want := []string{"1sa: 1.8 -> 0.9", "xjm: 5e+09 -> 1e+09", "xvm: 16000 -> 12000", "xzz: (missing) -> 1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff: %q, want: %q", got, want)
+	}
+
+	err = Apply(d.query, changes)
+	if !reflect.DeepEqual(d.sent, []string{`{"1sa":0.9}`, `{"xjm":1000000000}`, `{"xvm":12000}`, `{"xzz":1}`}) {
+		t.Errorf("Apply sent %q, want one command per change", d.sent)
+	}
+	e, ok := err.(*ConfigError)
+	if !ok {
+		t.Fatalf("Apply: %v, want: *ConfigError", err)
+	}
+	if len(e.Rejected) != 1 || e.Rejected["xzz"] == nil || len(e.Unchanged) != 1 || e.Unchanged[0].Setting != "xjm" {
+		t.Errorf("Apply: %v, want: xzz rejected and xjm did not stick", err)
+	}
+	if d.groups["x"]["vm"] != 12000.0 || d.groups["1"]["sa"] != 0.9 {
+		t.Errorf("Apply did not set xvm and 1sa: %v", d.groups)
+	}
+}
@@ -0,0 +1,193 @@
+package tinyg
+
+import "fmt"
+
+// Enumerations used in TinyG status reports.
+// See https://github.com/synthetos/TinyG/wiki/TinyG-Status-Reports for more details.
+
+// MachineState is the combined state of the machine (stat).
+type MachineState int
+
+// The combined states of the machine.
+const (
+	StateInit MachineState = iota
+	StateReady
+	StateAlarm
+	StateStop
+	StateEnd
+	StateRun
+	StateHold
+	StateProbe
+	StateCycle
+	StateHoming
+	StateJog
+)
+
+var machineStateNames = []string{"Initializing", "Ready", "Alarm", "Stop", "End", "Running", "Holding", "Probing", "Cycle", "Homing", "Jogging"}
+
+// ControllerState is the state of the canonical machine (macs).
+type ControllerState int
+
+// The states of the canonical machine.
+const (
+	ControllerInit ControllerState = iota
+	ControllerReady
+	ControllerAlarm
+	ControllerStop
+	ControllerEnd
+	ControllerCycle
+	ControllerShutdown
+)
+
+var controllerStateNames = []string{"Initializing", "Ready", "Alarm", "Stop", "End", "Cycle", "Shutdown"}
+
+// CycleState is the kind of the cycle being run (cycs).
+type CycleState int
+
+// The kinds of the cycles.
+const (
+	CycleOff CycleState = iota
+	CycleMachining
+	CycleProbe
+	CycleHoming
+	CycleJog
+)
+
+var cycleStateNames = []string{"Off", "Machining", "Probe", "Homing", "Jog"}
+
+// MotionState is the state of the motion (mots).
+type MotionState int
+
+// The states of the motion.
+const (
+	MotionStop MotionState = iota
+	MotionRun
+	MotionHold
+)
+
+var motionStateNames = []string{"Stop", "Run", "Hold"}
+
+// HoldState is the state of a feedhold (hold).
+type HoldState int
+
+// The states of a feedhold, from none to the end of the hold.
+const (
+	HoldOff HoldState = iota
+	HoldSync
+	HoldPlan
+	HoldDecel
+	HoldActive
+	HoldEndHold
+)
+
+var holdStateNames = []string{"Off", "Sync", "Plan", "Decel", "Hold", "EndHold"}
+
+// HomingState tells whether the machine is homed (home).
+type HomingState int
+
+// The homing states of the machine.
+const (
+	NotHomed HomingState = iota
+	Homed
+	HomingWaiting
+)
+
+var homingStateNames = []string{"NotHomed", "Homed", "Waiting"}
+
+// MotionMode is the active g-code motion mode (momo).
+type MotionMode int
+
+// The motion modes with their g-codes.
+const (
+	StraightTraverse MotionMode = iota // G0
+	StraightFeed                       // G1
+	ArcCW                              // G2
+	ArcCCW                             // G3
+	MotionCancel                       // G80
+)
+
+var motionModeNames = []string{"G0", "G1", "G2", "G3", "G80"}
+
+// CoordSystem is the active coordinate system (coor).
+type CoordSystem int
+
+// The coordinate systems: G53 is the machine coordinates, G54 to G59 are the work ones.
+const (
+	G53 CoordSystem = iota // Machine coordinates
+	G54
+	G55
+	G56
+	G57
+	G58
+	G59
+)
+
+var coordSystemNames = []string{"G53", "G54", "G55", "G56", "G57", "G58", "G59"}
+
+// DistanceMode is the active distance mode (dist).
+type DistanceMode int
+
+// The distance modes with their g-codes.
+const (
+	Absolute    DistanceMode = iota // G90
+	Incremental                     // G91
+)
+
+var distanceModeNames = []string{"G90", "G91"}
+
+// Units are the active units (unit).
+type Units int
+
+// The units with their g-codes.
+const (
+	Inches      Units = iota // G20
+	Millimeters              // G21
+)
+
+var unitsNames = []string{"G20", "G21"}
+
+// Plane is the active plane for arcs (plan).
+type Plane int
+
+// The planes for arcs with their g-codes.
+const (
+	PlaneXY Plane = iota // G17
+	PlaneXZ              // G18
+	PlaneYZ              // G19
+)
+
+var planeNames = []string{"G17", "G18", "G19"}
+
+func enumName(names []string, v int) string {
+	if v < 0 || v >= len(names) {
+		return fmt.Sprintf("Unknown(%d)", v)
+	}
+	return names[v]
+}
+
+func (v MachineState) String() string    { return enumName(machineStateNames, int(v)) }
+func (v ControllerState) String() string { return enumName(controllerStateNames, int(v)) }
+func (v CycleState) String() string      { return enumName(cycleStateNames, int(v)) }
+func (v MotionState) String() string     { return enumName(motionStateNames, int(v)) }
+func (v HoldState) String() string       { return enumName(holdStateNames, int(v)) }
+func (v HomingState) String() string     { return enumName(homingStateNames, int(v)) }
+func (v MotionMode) String() string      { return enumName(motionModeNames, int(v)) }
+func (v CoordSystem) String() string     { return enumName(coordSystemNames, int(v)) }
+func (v DistanceMode) String() string    { return enumName(distanceModeNames, int(v)) }
+func (v Units) String() string           { return enumName(unitsNames, int(v)) }
+func (v Plane) String() string           { return enumName(planeNames, int(v)) }
+
+// The enumerations are marshaled to json as names, so that the clients don't need to know the numbers.
+// TinyG sends numbers, and they are unmarshaled as usual.
+
+func (v MachineState) MarshalText() ([]byte, error)    { return []byte(v.String()), nil }
+func (v ControllerState) MarshalText() ([]byte, error) { return []byte(v.String()), nil }
+func (v CycleState) MarshalText() ([]byte, error)      { return []byte(v.String()), nil }
+func (v MotionState) MarshalText() ([]byte, error)     { return []byte(v.String()), nil }
+func (v HoldState) MarshalText() ([]byte, error)       { return []byte(v.String()), nil }
+func (v HomingState) MarshalText() ([]byte, error)     { return []byte(v.String()), nil }
+func (v MotionMode) MarshalText() ([]byte, error)      { return []byte(v.String()), nil }
+func (v CoordSystem) MarshalText() ([]byte, error)     { return []byte(v.String()), nil }
+func (v DistanceMode) MarshalText() ([]byte, error)    { return []byte(v.String()), nil }
+func (v Units) MarshalText() ([]byte, error)           { return []byte(v.String()), nil }
+func (v Plane) MarshalText() ([]byte, error)           { return []byte(v.String()), nil }
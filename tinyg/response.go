@@ -3,7 +3,10 @@ package tinyg
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"reflect"
+	"strings"
 )
 
 // Response contains all possible values which may be reported by TinyG.
@@ -32,9 +35,171 @@ type Response struct {
 	// Ofsz is the Z axis offset
 	Ofsz *float64
 
+	// Mpoa is the absolute A coordinate
+	Mpoa *float64
+
+	// Ofsa is the A axis offset
+	Ofsa *float64
+
+	// Posx is the X coordinate in the work coordinate system
+	Posx *float64
+
+	// Posy is the Y coordinate in the work coordinate system
+	Posy *float64
+
+	// Posz is the Z coordinate in the work coordinate system
+	Posz *float64
+
+	// Posa is the A coordinate in the work coordinate system
+	Posa *float64
+
+	// Unit is the active units (G20/G21)
+	Unit *Units
+
+	// Stat is the combined machine state
+	Stat *MachineState
+
+	// Coor is the active coordinate system
+	Coor *CoordSystem
+
+	// Momo is the active motion mode
+	Momo *MotionMode
+
+	// Dist is the active distance mode (G90/G91)
+	Dist *DistanceMode
+
+	// Plan is the active plane (G17/G18/G19)
+	Plan *Plane
+
+	// Home tells whether the machine is homed
+	Home *HomingState
+
+	// Homx is the homing state of the X axis
+	Homx *HomingState
+
+	// Homy is the homing state of the Y axis
+	Homy *HomingState
+
+	// Homz is the homing state of the Z axis
+	Homz *HomingState
+
+	// Hold is the feedhold state
+	Hold *HoldState
+
+	// Macs is the canonical machine state
+	Macs *ControllerState
+
+	// Cycs is the cycle state
+	Cycs *CycleState
+
+	// Mots is the motion state
+	Mots *MotionState
+
+	// Vel is the current velocity
+	Vel *float64
+
+	// Feed is the programmed feed rate
+	Feed *float64
+
+	// Spe is 1, if the spindle is on, and 0 otherwise
+	Spe *int
+
+	// Spd is the direction of the spindle: 0 is clockwise (M3), 1 is counterclockwise (M4)
+	Spd *int
+
+	// Sps is the programmed spindle speed
+	Sps *float64
+
+	// Com is 1, if the mist coolant is on (M7)
+	Com *int
+
+	// Cof is 1, if the flood coolant is on (M8)
+	Cof *int
+
+	// Line is the line number of the g-code block being executed
+	Line *int
+
+	// QR is the number of available buffers in the planner queue (queue report).
+	QR *int `json:"-"`
+
+	// QI is the number of buffers added to the planner queue since the last queue report.
+	QI *int `json:"-"`
+
+	// QO is the number of buffers removed from the planner queue since the last queue report.
+	QO *int `json:"-"`
+
+	// Er is an exception report.
+	Er *Exception `json:"-"`
+
+	// Body is the raw body of the response to a command (the "r" value), if any.
+	// It's useful to read the values, which have no fields in Response, such as config groups.
+	Body json.RawMessage `json:"-"`
+
 	// Footer is a part of response to a command.
 	// See https://github.com/synthetos/TinyG/wiki/JSON-Operation for more details.
-	Footer []int `json:"-"`
+	Footer *Footer `json:"-"`
+}
+
+// Exception is an exception report. TinyG sends it on limit switch hits, shutdowns and internal errors.
+type Exception struct {
+	// Fb is the firmware build.
+	Fb float64
+
+	// St is the status code, which describes the exception.
+	St StatusCode
+
+	// Msg is a human-readable description of the exception.
+	Msg string
+
+	// Val is an optional value related to the exception.
+	Val *float64
+}
+
+func (e *Exception) String() string {
+	if e.Msg == "" {
+		return e.St.String()
+	}
+	return fmt.Sprintf("%v, msg: %s", e.St, e.Msg)
+}
+
+// Footer acknowledges a command. It's sent by TinyG as "f":[revision,status,rx,checksum].
+type Footer struct {
+	// Revision is the revision of the footer format.
+	Revision int
+
+	// Status is the status of the command.
+	Status StatusCode
+
+	// RxAvail is the number of bytes available in the serial RX buffer.
+	RxAvail int
+
+	// Checksum is the checksum of the response line.
+	Checksum int
+}
+
+// ErrChecksum is returned by Response.Verify, if the response was corrupted.
+var ErrChecksum = errors.New("response checksum mismatch")
+
+// Checksum computes the checksum of a response line like TinyG does it:
+// Java hashCode of the line up to the last comma, modulo 9999.
+func Checksum(line string) int {
+	if i := strings.LastIndex(line, ","); i >= 0 {
+		line = line[:i]
+	}
+	var h uint32
+	for i := 0; i < len(line); i++ {
+		h = 31*h + uint32(line[i])
+	}
+	return int(h % 9999)
+}
+
+// Verify checks that the response was not corrupted on its way from TinyG.
+// Only responses with a footer carry a checksum. Others are always considered valid.
+func (r *Response) Verify() error {
+	if r.Footer == nil || r.Footer.Checksum == Checksum(r.Json) {
+		return nil
+	}
+	return ErrChecksum
 }
 
 func (r *Response) String() string {
@@ -42,22 +207,40 @@ func (r *Response) String() string {
 	fmt.Fprintf(&buf, "Json: %s", r.Json)
 
 	was := false
-	mb := func(name string, val *float64) {
-		if val == nil {
-			return
+	v := reflect.ValueOf(r).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if f.Kind() != reflect.Ptr || f.IsNil() {
+			continue
 		}
 		if !was {
 			was = true
 			fmt.Fprintln(&buf)
 		}
-		fmt.Fprintf(&buf, "%s: %.3f  ", name, *val)
+		name := v.Type().Field(i).Name
+		if name == "Footer" || name == "Er" {
+			continue
+		}
+		if val, ok := f.Interface().(*float64); ok {
+			fmt.Fprintf(&buf, "%s: %.3f  ", name, *val)
+			continue
+		}
+		fmt.Fprintf(&buf, "%s: %v  ", name, f.Elem().Interface())
+	}
+
+	if r.Er != nil {
+		if !was {
+			was = true
+			fmt.Fprintln(&buf)
+		}
+		fmt.Fprintf(&buf, "Exception: %v  ", r.Er)
+	}
+	if r.Footer != nil {
+		if !was {
+			fmt.Fprintln(&buf)
+		}
+		fmt.Fprintf(&buf, "Status: %v", r.Footer.Status)
 	}
-	mb("Mpox", r.Mpox)
-	mb("Ofsx", r.Ofsx)
-	mb("Mpoy", r.Mpoy)
-	mb("Ofsy", r.Ofsy)
-	mb("Mpoz", r.Mpoz)
-	mb("Ofsz", r.Ofsz)
 
 	return buf.String()
 }
@@ -72,22 +255,39 @@ func ParseResponse(resp string) (*Response, error) {
 	switch {
 	case b.SR != nil:
 		res = b.SR
-	case b.R != nil && b.R.SR != nil:
-		res = b.R.SR
 	default:
 		res = new(Response)
+		var r respBody
+		if b.R != nil && json.Unmarshal(b.R, &r) == nil && r.SR != nil {
+			// Setting the status report fields echoes them as booleans, it's not a status.
+			if err := json.Unmarshal(r.SR, res); err != nil {
+				res = new(Response)
+			}
+		}
 	}
-	res.Footer = b.F
+	res.Body = b.R
+	res.QR, res.QI, res.QO = b.QR, b.QI, b.QO
+	res.Er = b.Er
 	res.Json = resp
+	if b.F != nil {
+		if len(b.F) != 4 {
+			return nil, fmt.Errorf("malformed footer: %v, want 4 elements", b.F)
+		}
+		res.Footer = &Footer{Revision: b.F[0], Status: StatusCode(b.F[1]), RxAvail: b.F[2], Checksum: b.F[3]}
+	}
 	return res, nil
 }
 
 type body struct {
 	SR *Response
-	R  *resp
+	R  json.RawMessage
 	F  []int
+	QR *int
+	QI *int
+	QO *int
+	Er *Exception
 }
 
-type resp struct {
-	SR *Response
+type respBody struct {
+	SR json.RawMessage
 }
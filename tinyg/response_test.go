@@ -1,6 +1,8 @@
 package tinyg
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
 	"testing"
@@ -8,7 +10,14 @@ import (
 
 func f64(v float64) *float64 { return &v }
 
+func intp(v int) *int { return &v }
+
 func TestParseResponse(t *testing.T) {
+	mm, abs, planeXY, homed, notHomed := Millimeters, Absolute, PlaneXY, Homed, NotHomed
+	stop, run, g55 := StateStop, StateRun, G55
+	traverse, feed := StraightTraverse, StraightFeed
+	holdOff, ctrlStop, ctrlCycle := HoldOff, ControllerStop, ControllerCycle
+	cycleOff, cycleMachining, motionStop, motionRun := CycleOff, CycleMachining, MotionStop, MotionRun
 	tests := []struct {
 		name string
 		json string
@@ -22,17 +31,71 @@ func TestParseResponse(t *testing.T) {
 				Mpox: f64(0), Ofsx: f64(0),
 				Mpoy: f64(0), Ofsy: f64(0),
 				Mpoz: f64(0), Ofsz: f64(-60.310),
-				Footer: []int{1, 0, 10, 9925}},
+				Mpoa: f64(0), Ofsa: f64(0),
+				Unit: &mm, Stat: &stop, Coor: &g55, Momo: &traverse, Dist: &abs,
+				Home: &homed, Hold: &holdOff, Macs: &ctrlStop, Cycs: &cycleOff, Mots: &motionStop, Plan: &planeXY,
+				Body:   json.RawMessage(`{"sr":{"mpox":0.000,"mpoy":0.000,"mpoz":0.000,"mpoa":0.000,"ofsx":0.000,"ofsy":0.000,"ofsz":-60.310,"ofsa":0.000,"unit":1,"stat":3,"coor":2,"momo":0,"dist":0,"home":1,"hold":0,"macs":3,"cycs":0,"mots":0,"plan":0}}`),
+				Footer: &Footer{Revision: 1, Status: StatOK, RxAvail: 10, Checksum: 9925}},
 		},
 		{
 			name: "moving X report",
 			json: `{"sr":{"mpox":0.000,"stat":5,"macs":5,"cycs":1,"mots":1}}`,
-			resp: &Response{Mpox: f64(0)},
+			resp: &Response{Mpox: f64(0), Stat: &run, Macs: &ctrlCycle, Cycs: &cycleMachining, Mots: &motionRun},
+		},
+		{
+			name: "axis homing states",
+			json: `{"sr":{"homx":1,"homy":1,"homz":0}}`,
+			resp: &Response{Homx: &homed, Homy: &homed, Homz: &notHomed},
+		},
+		{
+			name: "feed, velocity and line",
+			json: `{"sr":{"posx":1.500,"vel":250.12,"feed":300.000,"line":42,"momo":1}}`,
+			resp: &Response{Posx: f64(1.5), Vel: f64(250.12), Feed: f64(300), Line: intp(42), Momo: &feed},
+		},
+		{
+			name: "spindle and coolant",
+			json: `{"sr":{"spe":1,"spd":1,"sps":12000,"com":0,"cof":1}}`,
+			resp: &Response{Spe: intp(1), Spd: intp(1), Sps: f64(12000), Com: intp(0), Cof: intp(1)},
+		},
+		{
+			name: "status report fields set",
+			json: `{"r":{"sr":{"mpox":true,"stat":true}},"f":[1,0,254,6430]}`,
+			resp: &Response{Body: json.RawMessage(`{"sr":{"mpox":true,"stat":true}}`), Footer: &Footer{Revision: 1, Status: StatOK, RxAvail: 254, Checksum: 6430}},
+		},
+		{
+			name: "config group",
+			json: `{"r":{"g55":{"x":5.000,"y":0.000,"z":-2.500,"a":0.000}},"f":[1,0,254,2723]}`,
+			resp: &Response{Body: json.RawMessage(`{"g55":{"x":5.000,"y":0.000,"z":-2.500,"a":0.000}}`), Footer: &Footer{Revision: 1, Status: StatOK, RxAvail: 254, Checksum: 2723}},
+		},
+		{
+			name: "malformed footer",
+			json: `{"r":{},"f":[1,0,10]}`,
+			err:  errors.New("malformed footer: [1 0 10], want 4 elements"),
+		},
+		{
+			name: "error status",
+			json: `{"r":{"gc":"G1X10"},"f":[1,142,6,6432]}`,
+			resp: &Response{Body: json.RawMessage(`{"gc":"G1X10"}`), Footer: &Footer{Revision: 1, Status: StatGcodeFeedrateNotSpecified, RxAvail: 6, Checksum: 6432}},
+		},
+		{
+			name: "exception report",
+			json: `{"er":{"fb":440.20,"st":204,"msg":"Limit switch hit - Shutdown occurred"}}`,
+			resp: &Response{Er: &Exception{Fb: 440.20, St: StatLimitSwitchHit, Msg: "Limit switch hit - Shutdown occurred"}},
+		},
+		{
+			name: "exception report with a value",
+			json: `{"er":{"fb":440.20,"st":27,"msg":"Shutdown","val":1}}`,
+			resp: &Response{Er: &Exception{Fb: 440.20, St: StatAlarmed, Msg: "Shutdown", Val: f64(1)}},
 		},
 		{
 			name: "just qr",
 			json: `{"qr":27}`,
-			resp: &Response{},
+			resp: &Response{QR: intp(27)},
+		},
+		{
+			name: "triple queue report",
+			json: `{"qr":26,"qi":2,"qo":1}`,
+			resp: &Response{QR: intp(26), QI: intp(2), QO: intp(1)},
 		},
 	}
 	for _, tt := range tests {
@@ -51,3 +114,58 @@ func TestParseResponse(t *testing.T) {
 		}
 	}
 }
+
+func TestResponseString(t *testing.T) {
+	r, err := ParseResponse(`{"sr":{"mpox":1.5,"stat":5,"home":1}}`)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	want := "Json: {\"sr\":{\"mpox\":1.5,\"stat\":5,\"home\":1}}\nMpox: 1.500  Stat: Running  Home: Homed  "
+	if got := r.String(); got != want {
+		t.Errorf("String():\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  error
+	}{
+		{
+			name: "valid checksum",
+			json: `{"r":{"sr":{"mpox":0.000,"mpoy":0.000,"mpoz":0.000,"mpoa":0.000,"ofsx":0.000,"ofsy":0.000,"ofsz":-60.310,"ofsa":0.000,"unit":1,"stat":3,"coor":2,"momo":0,"dist":0,"home":1,"hold":0,"macs":3,"cycs":0,"mots":0,"plan":0}},"f":[1,0,10,9925]}`,
+		},
+		{
+			name: "corrupted line",
+			json: `{"r":{"sr":{"mpox":1.000,"mpoy":0.000,"mpoz":0.000,"mpoa":0.000,"ofsx":0.000,"ofsy":0.000,"ofsz":-60.310,"ofsa":0.000,"unit":1,"stat":3,"coor":2,"momo":0,"dist":0,"home":1,"hold":0,"macs":3,"cycs":0,"mots":0,"plan":0}},"f":[1,0,10,9925]}`,
+			err:  ErrChecksum,
+		},
+		{
+			name: "no footer",
+			json: `{"sr":{"mpox":1.000}}`,
+		},
+	}
+	for _, tt := range tests {
+		r, err := ParseResponse(tt.json)
+		if err != nil {
+			t.Errorf("%q: ParseResponse(%s) failed: %v", tt.name, tt.json, err)
+			continue
+		}
+		if err := r.Verify(); err != tt.err {
+			t.Errorf("%q: Verify() = %v, want: %v", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestStatusCode(t *testing.T) {
+	if !StatOK.OK() || StatGcodeAxisIsMissing.OK() {
+		t.Errorf("StatOK.OK() = %v, StatGcodeAxisIsMissing.OK() = %v, want: true, false", StatOK.OK(), StatGcodeAxisIsMissing.OK())
+	}
+	if got, want := StatLimitSwitchHit.String(), "204 (LIMIT_SWITCH_HIT): Limit switch hit - Shutdown occurred"; got != want {
+		t.Errorf("StatLimitSwitchHit.String() = %q, want: %q", got, want)
+	}
+	if got, want := StatusCode(255).Name(), "UNKNOWN_255"; got != want {
+		t.Errorf("StatusCode(255).Name() = %q, want: %q", got, want)
+	}
+}
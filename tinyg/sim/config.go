@@ -0,0 +1,141 @@
+package sim
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// axes are the names of the simulated axes, in order.
+const axes = "xyza"
+
+// defaultSR are the status report fields reported by default.
+var defaultSR = []string{"coor", "dist", "feed", "line", "momo", "posa", "posx", "posy", "posz", "stat", "unit", "vel"}
+
+// sysConfig are the system settings with their default values.
+var sysConfig = map[string]interface{}{
+	"fb": 440.20, "fv": 0.970, "hp": 1, "hv": 8, "id": "3X3566-YMX",
+	"ja": 2000000, "ct": 0.01, "sl": 0, "st": 0, "mt": 2, "ej": 1, "jv": 4,
+	"js": 1, "tv": 1, "qv": 0, "sv": 1, "si": 250,
+	"gpl": 0, "gun": 1, "gco": 1, "gpa": 2, "gdi": 0,
+}
+
+// readOnly are the settings which can't be changed.
+var readOnly = map[string]bool{"fb": true, "fv": true, "hp": true, "hv": true, "id": true}
+
+// axisConfig are the per-axis settings with their default values for x, y, z and a.
+var axisConfig = map[string][]interface{}{
+	"am": {1, 1, 1, 3},
+	"vm": {16000, 16000, 1200, 172800},
+	"fr": {16000, 16000, 1200, 172800},
+	"tn": {0, 0, -95, -1},
+	"tm": {300, 300, 0, -1},
+	"jm": {5e9, 5e9, 1e9, 5e9},
+	"jh": {10e9, 10e9, 1e9, 10e9},
+	"jd": {0.05, 0.05, 0.05, 0.05},
+	"sn": {1, 1, 0, 0},
+	"sx": {0, 0, 1, 0},
+	"sv": {3000, 3000, 800, 600},
+	"lv": {100, 100, 100, 100},
+	"lb": {20, 20, 10, 5},
+	"zb": {3, 3, 2, 2},
+}
+
+// motorConfig are the per-motor settings with their default values for motors 1 to 4.
+var motorConfig = map[string][]interface{}{
+	"ma": {0, 1, 2, 3},
+	"sa": {1.8, 1.8, 1.8, 1.8},
+	"tr": {40, 40, 1.25, 360},
+	"mi": {8, 8, 8, 8},
+	"po": {0, 0, 0, 0},
+	"pm": {1, 1, 1, 1},
+}
+
+const motors = "1234"
+
+func defaultConfig() map[string]interface{} {
+	cfg := make(map[string]interface{})
+	for k, v := range sysConfig {
+		cfg[k] = v
+	}
+	for k, vs := range axisConfig {
+		for i, v := range vs {
+			cfg[axes[i:i+1]+k] = v
+		}
+	}
+	for k, vs := range motorConfig {
+		for i, v := range vs {
+			cfg[motors[i:i+1]+k] = v
+		}
+	}
+	return cfg
+}
+
+// group returns the settings of a group: "sys", an axis, a motor,
+// or the offsets of a coordinate system (g54 to g59) or G92.
+func (d *Device) group(name string) (map[string]interface{}, bool) {
+	g := make(map[string]interface{})
+	switch {
+	case name == "sys":
+		for k := range sysConfig {
+			g[k] = d.cfg[k]
+		}
+	case len(name) == 1 && strings.Contains(axes, name):
+		for k := range axisConfig {
+			g[k] = d.cfg[name+k]
+		}
+	case len(name) == 1 && strings.Contains(motors, name):
+		for k := range motorConfig {
+			g[k] = d.cfg[name+k]
+		}
+	case name == "g92" || len(name) == 3 && name >= "g54" && name <= "g59":
+		ofs := d.g.g92
+		if name != "g92" {
+			ofs = d.g.offsets[tinyg.G54+tinyg.CoordSystem(name[2]-'4')]
+		}
+		for i := range axes {
+			g[axes[i:i+1]] = ofs[i]
+		}
+	default:
+		return nil, false
+	}
+	return g, true
+}
+
+// config reads or sets a setting or reads a group of settings.
+func (d *Device) config(k string, v json.RawMessage) (interface{}, tinyg.StatusCode) {
+	if g, ok := d.group(k); ok {
+		if !isQuery(v) {
+			return nil, tinyg.StatUnsupportedType
+		}
+		return g, tinyg.StatOK
+	}
+	cur, ok := d.cfg[k]
+	if !ok {
+		return nil, tinyg.StatUnrecognizedName
+	}
+	if isQuery(v) {
+		return cur, tinyg.StatOK
+	}
+	if readOnly[k] {
+		return nil, tinyg.StatParameterIsReadOnly
+	}
+	var f float64
+	if err := json.Unmarshal(v, &f); err != nil {
+		return nil, tinyg.StatBadNumberFormat
+	}
+	d.cfg[k] = f
+	return f, tinyg.StatOK
+}
+
+// num returns a numeric setting.
+func (d *Device) num(k string) float64 {
+	switch v := d.cfg[k].(type) {
+	case float64:
+		return v
+	case int:
+		return float64(v)
+	}
+	return 0
+}
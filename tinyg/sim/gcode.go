@@ -0,0 +1,429 @@
+package sim
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// mmPerInch converts inches to mm.
+const mmPerInch = 25.4
+
+// move is a move queued in the planner. Positions are machine positions in mm.
+type move struct {
+	from, to [4]float64
+
+	// rate is the velocity, mm/min.
+	rate float64
+
+	// dur is the duration of the move, and t is the time spent running it, in seconds.
+	dur, t float64
+
+	// line is the line number of the g-code block.
+	line int
+
+	// home are the axes homed, when the move is done.
+	home []int
+}
+
+// at returns the current position of the move.
+func (mv *move) at() [4]float64 {
+	var p [4]float64
+	for i := range p {
+		p[i] = mv.from[i] + (mv.to[i]-mv.from[i])*mv.t/mv.dur
+	}
+	return p
+}
+
+// gstate is the state of the simulated machine.
+type gstate struct {
+	// pos is the current machine position, and planned is the position
+	// at the end of the last queued move.
+	pos, planned [4]float64
+
+	// offsets are the offsets of the coordinate systems, indexed by tinyg.CoordSystem.
+	offsets [tinyg.G59 + 1][4]float64
+
+	// g92 is the G92 origin offset.
+	g92 [4]float64
+
+	coord tinyg.CoordSystem
+	units tinyg.Units
+	dist  tinyg.DistanceMode
+	momo  tinyg.MotionMode
+	plane tinyg.Plane
+
+	// feed is the feed rate in mm/min.
+	feed float64
+	line int
+
+	homed       [4]bool
+	homingDone  bool
+	spindle     bool
+	spindleCCW  bool
+	spindleRate float64
+	mist, flood bool
+
+	queue []*move
+	hold  bool
+	alarm bool
+}
+
+func newGstate() gstate {
+	return gstate{coord: tinyg.G54, units: tinyg.Millimeters, momo: tinyg.StraightTraverse}
+}
+
+// scale returns the number of mm in the current unit.
+func (g *gstate) scale() float64 {
+	if g.units == tinyg.Inches {
+		return mmPerInch
+	}
+	return 1
+}
+
+// offset returns the total work offset of an axis in mm.
+func (g *gstate) offset(i int) float64 {
+	return g.offsets[g.coord][i] + g.g92[i]
+}
+
+// done is called, when a move is complete.
+func (g *gstate) done(mv *move) {
+	for _, i := range mv.home {
+		g.homed[i] = true
+		g.homingDone = true
+	}
+}
+
+// stat returns the combined machine state.
+func (g *gstate) stat() tinyg.MachineState {
+	switch {
+	case g.alarm:
+		return tinyg.StateAlarm
+	case len(g.queue) == 0:
+		return tinyg.StateReady
+	case g.hold:
+		return tinyg.StateHold
+	case g.queue[0].home != nil:
+		return tinyg.StateHoming
+	}
+	return tinyg.StateRun
+}
+
+func b2f(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// status returns all the values which may be reported in a status report.
+func (d *Device) status() map[string]float64 {
+	g := &d.g
+	scale := g.scale()
+	sr := map[string]float64{
+		"unit": float64(g.units),
+		"stat": float64(g.stat()),
+		"coor": float64(g.coord),
+		"momo": float64(g.momo),
+		"dist": float64(g.dist),
+		"plan": float64(g.plane),
+		"home": b2f(g.homingDone),
+		"feed": g.feed / scale,
+		"line": float64(g.line),
+		"spe":  b2f(g.spindle),
+		"spd":  b2f(g.spindleCCW),
+		"sps":  g.spindleRate,
+		"com":  b2f(g.mist),
+		"cof":  b2f(g.flood),
+		"hold": float64(tinyg.HoldOff),
+		"macs": float64(tinyg.ControllerReady),
+		"cycs": float64(tinyg.CycleOff),
+		"mots": float64(tinyg.MotionStop),
+		"vel":  0,
+	}
+	for i := range axes {
+		a := axes[i : i+1]
+		sr["mpo"+a] = g.pos[i]
+		sr["pos"+a] = (g.pos[i] - g.offset(i)) / scale
+		sr["ofs"+a] = g.offset(i)
+		sr["hom"+a] = b2f(g.homed[i])
+	}
+	if g.alarm {
+		sr["macs"] = float64(tinyg.ControllerAlarm)
+	} else if len(g.queue) > 0 {
+		mv := g.queue[0]
+		sr["macs"] = float64(tinyg.ControllerCycle)
+		sr["cycs"] = float64(tinyg.CycleMachining)
+		if mv.home != nil {
+			sr["cycs"] = float64(tinyg.CycleHoming)
+		}
+		sr["line"] = float64(mv.line)
+		if g.hold {
+			sr["hold"] = float64(tinyg.HoldActive)
+			sr["mots"] = float64(tinyg.MotionHold)
+		} else {
+			sr["mots"] = float64(tinyg.MotionRun)
+			sr["vel"] = mv.rate / scale
+		}
+	}
+	return sr
+}
+
+// word is a g-code word: a letter followed by a number.
+type word struct {
+	letter byte
+	num    float64
+}
+
+// parseWords splits a g-code block into words. Comments are skipped.
+func parseWords(block string) ([]word, tinyg.StatusCode) {
+	var words []word
+	s := strings.ToUpper(block)
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+			continue
+		case c == '(':
+			end := strings.IndexByte(s[i:], ')')
+			if end < 0 {
+				return nil, tinyg.StatGcodeGenericInputError
+			}
+			i += end + 1
+			continue
+		case c == ';':
+			return words, tinyg.StatOK
+		case c < 'A' || c > 'Z':
+			return nil, tinyg.StatGcodeGenericInputError
+		}
+		j := i + 1
+		for j < len(s) && (s[j] == ' ' || s[j] == '+' || s[j] == '-' || s[j] == '.' || s[j] >= '0' && s[j] <= '9') {
+			j++
+		}
+		num, err := strconv.ParseFloat(strings.Replace(s[i+1:j], " ", "", -1), 64)
+		if err != nil {
+			return nil, tinyg.StatBadNumberFormat
+		}
+		words = append(words, word{c, num})
+		i = j
+	}
+	return words, tinyg.StatOK
+}
+
+// code converts a G or M number like 28.2 into an integer like 282.
+func code(num float64) int {
+	return int(num*10 + 0.5)
+}
+
+// execGcode executes a g-code block. Moves are queued in the planner.
+func (d *Device) execGcode(block string) tinyg.StatusCode {
+	words, st := parseWords(block)
+	if st != tinyg.StatOK {
+		return st
+	}
+	if d.g.alarm {
+		return tinyg.StatMachineAlarmed
+	}
+	g := &d.g
+
+	var (
+		gs, ms     []int
+		vals       [4]float64
+		has        [4]bool
+		axisWords  bool
+		p, l       float64
+		hasP, hasL bool
+	)
+	for _, w := range words {
+		switch w.letter {
+		case 'G':
+			gs = append(gs, code(w.num))
+		case 'M':
+			ms = append(ms, code(w.num))
+		case 'N':
+			g.line = int(w.num)
+		case 'F':
+			g.feed = w.num * g.scale()
+		case 'S':
+			g.spindleRate = w.num
+		case 'P':
+			p, hasP = w.num, true
+		case 'L':
+			l, hasL = w.num, true
+		case 'T', 'I', 'J', 'K', 'R':
+		case 'X', 'Y', 'Z', 'A':
+			i := strings.IndexByte(axes, w.letter-'A'+'a')
+			vals[i], has[i], axisWords = w.num*g.scale(), true, true
+		default:
+			return tinyg.StatGcodeGenericInputError
+		}
+	}
+
+	// nonModal is the non-modal command of the block, if any.
+	nonModal := -1
+	for _, c := range gs {
+		switch c {
+		case 0, 10, 20, 30:
+			g.momo = tinyg.MotionMode(c / 10)
+		case 800:
+			g.momo = tinyg.MotionCancel
+		case 170, 180, 190:
+			g.plane = tinyg.Plane(c/10 - 17)
+		case 200:
+			g.units = tinyg.Inches
+		case 210:
+			g.units = tinyg.Millimeters
+		case 900:
+			g.dist = tinyg.Absolute
+		case 910:
+			g.dist = tinyg.Incremental
+		case 540, 550, 560, 570, 580, 590:
+			g.coord = tinyg.CoordSystem(c/10 - 53)
+		case 400, 490, 610, 611, 640, 930, 940:
+			// Accepted, but not simulated.
+		case 40, 100, 282, 283, 530, 920, 921:
+			nonModal = c
+		default:
+			return tinyg.StatGcodeCommandUnsupported
+		}
+	}
+	for _, c := range ms {
+		switch c {
+		case 0, 10, 60, 480, 490:
+		case 20, 300:
+			g.spindle, g.mist, g.flood = false, false, false
+		case 30, 40:
+			g.spindle, g.spindleCCW = true, c == 40
+		case 50:
+			g.spindle = false
+		case 70:
+			g.mist = true
+		case 80:
+			g.flood = true
+		case 90:
+			g.mist, g.flood = false, false
+		default:
+			return tinyg.StatMcodeCommandUnsupported
+		}
+	}
+
+	switch nonModal {
+	case 40:
+		if hasP {
+			d.queue(&move{from: g.planned, to: g.planned, dur: p, line: g.line})
+		}
+		return tinyg.StatOK
+	case 100:
+		n := int(p)
+		if !hasP || !hasL || n < int(tinyg.G54) || n > int(tinyg.G59) {
+			return tinyg.StatGcodeGenericInputError
+		}
+		for i := range axes {
+			if !has[i] {
+				continue
+			}
+			switch int(l) {
+			case 2:
+				g.offsets[n][i] = vals[i]
+			case 20:
+				g.offsets[n][i] = g.planned[i] - g.g92[i] - vals[i]
+			default:
+				return tinyg.StatGcodeGenericInputError
+			}
+		}
+		return tinyg.StatOK
+	case 282:
+		if !axisWords {
+			return tinyg.StatGcodeGenericInputError
+		}
+		mv := &move{from: g.planned, to: g.planned, rate: math.Inf(1), line: g.line}
+		for i := range axes {
+			if has[i] {
+				mv.to[i] = 0
+				mv.home = append(mv.home, i)
+				mv.rate = math.Min(mv.rate, d.num(axes[i:i+1]+"sv"))
+				g.homed[i] = false
+			}
+		}
+		d.queue(mv)
+		return tinyg.StatOK
+	case 283:
+		for i := range axes {
+			if has[i] {
+				g.planned[i] = vals[i]
+				if len(g.queue) == 0 {
+					g.pos[i] = vals[i]
+				}
+			}
+		}
+		return tinyg.StatOK
+	case 920:
+		for i := range axes {
+			if has[i] {
+				g.g92[i] = g.planned[i] - g.offsets[g.coord][i] - vals[i]
+			}
+		}
+		return tinyg.StatOK
+	case 921:
+		g.g92 = [4]float64{}
+		return tinyg.StatOK
+	}
+
+	if !axisWords {
+		return tinyg.StatOK
+	}
+	if g.momo == tinyg.MotionCancel {
+		return tinyg.StatGcodeGenericInputError
+	}
+	mv := &move{from: g.planned, to: g.planned, rate: g.feed, line: g.line}
+	for i := range axes {
+		if !has[i] {
+			continue
+		}
+		switch {
+		case nonModal == 530:
+			mv.to[i] = vals[i]
+		case g.dist == tinyg.Incremental:
+			mv.to[i] += vals[i]
+		default:
+			mv.to[i] = vals[i] + g.offset(i)
+		}
+	}
+	limit := "fr"
+	if g.momo == tinyg.StraightTraverse {
+		limit = "vm"
+		mv.rate = math.Inf(1)
+	} else if g.feed <= 0 {
+		return tinyg.StatGcodeFeedrateNotSpecified
+	}
+	for i := range axes {
+		if mv.to[i] != mv.from[i] {
+			mv.rate = math.Min(mv.rate, d.num(axes[i:i+1]+limit))
+		}
+	}
+	d.queue(mv)
+	return tinyg.StatOK
+}
+
+// queue puts a move into the planner. Moves of zero length are skipped.
+func (d *Device) queue(mv *move) {
+	if mv.dur == 0 {
+		var dist float64
+		for i := range mv.to {
+			dist += (mv.to[i] - mv.from[i]) * (mv.to[i] - mv.from[i])
+		}
+		if dist == 0 {
+			d.g.done(mv)
+			return
+		}
+		mv.dur = math.Sqrt(dist) / mv.rate * 60
+	}
+	d.g.queue = append(d.g.queue, mv)
+	d.g.planned = mv.to
+	d.qi++
+	// Report the start of the cycle, even if the move is over before the next report.
+	d.report(len(d.g.queue) == 1)
+}
@@ -0,0 +1,482 @@
+// Package sim simulates a TinyG controller speaking the JSON protocol.
+//
+// The simulated device acknowledges the commands with footers, runs the moves
+// in simulated time and reports the positions in status reports, honours
+// feedhold, cycle start and queue flush, and models a finite planner with
+// queue reports. Errors and exception reports can be injected, so the
+// engine can be tested without the hardware.
+//
+// The simulation is coarse: there is no acceleration, arcs are run as
+// straight lines to their end points, and the responses are always json,
+// as if TinyG was configured with {"ej":1}.
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+const (
+	// plannerSize is the number of buffers in the planner queue.
+	plannerSize = 28
+
+	// rxSize is the size of the serial RX buffer.
+	rxSize = 254
+
+	// tick is the (real time) step of the simulation.
+	tick = 10 * time.Millisecond
+)
+
+// Real-time characters, handled as soon as they are written.
+const (
+	feedhold   = '!'
+	cycleStart = '~'
+	queueFlush = '%'
+)
+
+// Device is a simulated TinyG. It implements io.ReadWriter:
+// commands are written to it, and responses and reports are read from it.
+type Device struct {
+	rd *io.PipeReader
+	wr *io.PipeWriter
+
+	mu sync.Mutex
+
+	// cond is broadcast, when anything changes.
+	cond   *sync.Cond
+	closed bool
+
+	// rx is the serial RX buffer: the bytes written, but not processed yet.
+	rx        []byte
+	overflows int
+
+	// out is the queue of lines to be read.
+	out []string
+
+	// speed multiplies the simulated time.
+	speed float64
+
+	// now is the simulated time, in seconds.
+	now float64
+
+	// failures are the statuses to reply to the next commands with.
+	failures []tinyg.StatusCode
+
+	cfg      map[string]interface{}
+	srFields []string
+
+	// lastSR is the status reported last time.
+	lastSR map[string]float64
+	srAt   float64
+
+	// lastQR is the number of free planner buffers reported last time.
+	// qi and qo count the buffers added and removed since then.
+	lastQR, qi, qo int
+
+	g gstate
+}
+
+// New starts a new simulated device. Close it, when it's not needed anymore.
+func New() *Device {
+	d := &Device{
+		speed:    1,
+		cfg:      defaultConfig(),
+		srFields: append([]string(nil), defaultSR...),
+		lastSR:   make(map[string]float64),
+		lastQR:   plannerSize,
+		g:        newGstate(),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	d.rd, d.wr = io.Pipe()
+	go d.process()
+	go d.motion()
+	go d.output()
+	return d
+}
+
+// Read reads the responses and reports sent by the device.
+func (d *Device) Read(p []byte) (int, error) {
+	return d.rd.Read(p)
+}
+
+// Write sends bytes to the device. It never blocks: like the real serial port,
+// the bytes which don't fit into the RX buffer are lost.
+func (d *Device) Write(p []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return 0, io.ErrClosedPipe
+	}
+	for _, c := range p {
+		switch c {
+		case feedhold:
+			if len(d.g.queue) > 0 {
+				d.g.hold = true
+			}
+		case cycleStart:
+			d.g.hold = false
+		case queueFlush:
+			if d.g.hold {
+				d.flush()
+			}
+		default:
+			if len(d.rx) >= rxSize {
+				d.overflows++
+				continue
+			}
+			d.rx = append(d.rx, c)
+		}
+	}
+	d.cond.Broadcast()
+	return len(p), nil
+}
+
+// Close stops the device. Pending reads return io.EOF.
+func (d *Device) Close() error {
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+	d.wr.Close()
+	return nil
+}
+
+// SetSpeed makes the simulated time run faster (or slower) than the real one.
+func (d *Device) SetSpeed(speed float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.speed = speed
+}
+
+// SetFirmware changes the firmware build (fb) and version (fv) reported by the device.
+func (d *Device) SetFirmware(build, version float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.cfg["fb"], d.cfg["fv"] = build, version
+}
+
+// InjectError makes the device reject the next command with the status.
+// Several errors are used for the subsequent commands in order.
+func (d *Device) InjectError(status tinyg.StatusCode) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.failures = append(d.failures, status)
+}
+
+// InjectException sends an exception report and puts the device into the alarm state,
+// as if a limit switch was hit. The motion stops, and the planner is flushed.
+// The alarm is cleared with {"clear":null}.
+func (d *Device) InjectException(status tinyg.StatusCode, msg string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := json.Marshal(map[string]interface{}{
+		"er": map[string]interface{}{"fb": d.cfg["fb"], "st": status, "msg": msg},
+	})
+	if err != nil {
+		panic(err)
+	}
+	d.emit(string(data))
+	d.flush()
+	d.g.alarm = true
+	d.report(true)
+}
+
+// Overflows returns the number of bytes lost, because the RX buffer was full.
+func (d *Device) Overflows() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.overflows
+}
+
+// Position returns the machine position in mm.
+func (d *Device) Position() (x, y, z float64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.g.pos[0], d.g.pos[1], d.g.pos[2]
+}
+
+// emit queues a line to be read.
+func (d *Device) emit(line string) {
+	d.out = append(d.out, line)
+	d.cond.Broadcast()
+}
+
+// output writes the queued lines to the reader.
+func (d *Device) output() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		for len(d.out) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if d.closed {
+			return
+		}
+		line := d.out[0]
+		d.out = d.out[1:]
+		d.mu.Unlock()
+		_, err := io.WriteString(d.wr, line+"\n")
+		d.mu.Lock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// process executes the commands from the RX buffer.
+func (d *Device) process() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		line, ok := d.nextLine()
+		if !ok {
+			return
+		}
+		d.exec(line)
+	}
+}
+
+// nextLine waits for a complete line in the RX buffer. Like TinyG, it does not
+// read anything, while the planner is full.
+func (d *Device) nextLine() (string, bool) {
+	for {
+		if d.closed {
+			return "", false
+		}
+		if len(d.g.queue) < plannerSize {
+			if i := strings.IndexAny(string(d.rx), "\r\n"); i >= 0 {
+				line := string(d.rx[:i])
+				d.rx = d.rx[i+1:]
+				return line, true
+			}
+		}
+		d.cond.Wait()
+	}
+}
+
+// exec executes a command and responds to it.
+func (d *Device) exec(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if len(d.failures) > 0 {
+		st := d.failures[0]
+		d.failures = d.failures[1:]
+		d.respond(map[string]interface{}{}, st)
+		return
+	}
+	if strings.HasPrefix(line, "{") {
+		r, st := d.execJSON(line)
+		d.respond(r, st)
+		return
+	}
+	st := d.execGcode(line)
+	d.respond(map[string]interface{}{"gc": line}, st)
+}
+
+// relaxed matches the shorthand values TinyG accepts in place of json literals.
+var relaxed = regexp.MustCompile(`:\s*([tfn])\s*([,}])`)
+
+var literals = map[string]string{"t": "true", "f": "false", "n": "null"}
+
+// execJSON executes a json command.
+func (d *Device) execJSON(line string) (map[string]interface{}, tinyg.StatusCode) {
+	line = relaxed.ReplaceAllStringFunc(line, func(s string) string {
+		m := relaxed.FindStringSubmatch(s)
+		return ":" + literals[m[1]] + m[2]
+	})
+	var cmd map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(line), &cmd); err != nil {
+		return map[string]interface{}{}, tinyg.StatJSONSyntaxError
+	}
+	var keys []string
+	for k := range cmd {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := make(map[string]interface{})
+	for _, k := range keys {
+		v := cmd[k]
+		var st tinyg.StatusCode
+		switch k {
+		case "gc":
+			var gc string
+			if err := json.Unmarshal(v, &gc); err != nil {
+				return r, tinyg.StatUnsupportedType
+			}
+			r[k] = gc
+			st = d.execGcode(gc)
+		case "sr":
+			r[k], st = d.statusReport(v)
+		case "clear", "clr":
+			d.g.alarm = false
+			r[k] = nil
+			d.report(true)
+		default:
+			r[k], st = d.config(k, v)
+		}
+		if st != tinyg.StatOK {
+			return r, st
+		}
+	}
+	return r, tinyg.StatOK
+}
+
+// isQuery returns true, if the json value asks for the current value.
+func isQuery(v json.RawMessage) bool {
+	s := strings.TrimSpace(string(v))
+	return s == "" || s == "null" || s == `""`
+}
+
+// statusReport returns the full status report or sets the fields to report.
+func (d *Device) statusReport(v json.RawMessage) (interface{}, tinyg.StatusCode) {
+	if isQuery(v) {
+		sr := d.filter(d.status())
+		for k, v := range sr {
+			d.lastSR[k] = v
+		}
+		return sr, tinyg.StatOK
+	}
+	var fields map[string]bool
+	if err := json.Unmarshal(v, &fields); err != nil {
+		return nil, tinyg.StatUnsupportedType
+	}
+	// Like TinyG, the fields are only replaced, if all of them are known.
+	all := d.status()
+	var srFields []string
+	for k, on := range fields {
+		if _, ok := all[k]; !ok {
+			return nil, tinyg.StatUnrecognizedName
+		}
+		if on {
+			srFields = append(srFields, k)
+		}
+	}
+	sort.Strings(srFields)
+	d.srFields = srFields
+	d.lastSR = make(map[string]float64)
+	return fields, tinyg.StatOK
+}
+
+// respond sends a response with a footer.
+func (d *Device) respond(r map[string]interface{}, st tinyg.StatusCode) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	line := fmt.Sprintf(`{"r":%s,"f":[1,%d,%d,`, data, st, rxSize-len(d.rx))
+	d.emit(fmt.Sprintf("%s%d]}", line, tinyg.Checksum(line)))
+}
+
+// filter leaves only the status report fields configured.
+func (d *Device) filter(all map[string]float64) map[string]float64 {
+	sr := make(map[string]float64)
+	for _, k := range d.srFields {
+		sr[k] = all[k]
+	}
+	return sr
+}
+
+// report sends the status and queue reports, if anything has changed.
+// Unless forced, status reports are sent not more often than the status interval.
+func (d *Device) report(force bool) {
+	if d.num("qv") > 0 {
+		free := plannerSize - len(d.g.queue)
+		if free != d.lastQR {
+			qr := map[string]int{"qr": free}
+			if d.num("qv") > 1 {
+				qr["qi"], qr["qo"] = d.qi, d.qo
+			}
+			data, err := json.Marshal(qr)
+			if err != nil {
+				panic(err)
+			}
+			d.emit(string(data))
+			d.lastQR, d.qi, d.qo = free, 0, 0
+		}
+	}
+
+	sv := d.num("sv")
+	if sv == 0 || !force && d.now-d.srAt < d.num("si")/1000 {
+		return
+	}
+	sr := d.filter(d.status())
+	for k, v := range sr {
+		if sv == 1 && d.lastSR[k] == v {
+			if _, ok := d.lastSR[k]; ok {
+				delete(sr, k)
+				continue
+			}
+		}
+		d.lastSR[k] = v
+	}
+	if len(sr) == 0 {
+		return
+	}
+	d.srAt = d.now
+	data, err := json.Marshal(map[string]interface{}{"sr": sr})
+	if err != nil {
+		panic(err)
+	}
+	d.emit(string(data))
+}
+
+// motion runs the moves in simulated time.
+func (d *Device) motion() {
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for range t.C {
+		d.mu.Lock()
+		if d.closed {
+			d.mu.Unlock()
+			return
+		}
+		stat := d.g.stat()
+		d.step(tick.Seconds() * d.speed)
+		d.report(d.g.stat() != stat)
+		d.mu.Unlock()
+	}
+}
+
+// step advances the simulation by dt seconds.
+func (d *Device) step(dt float64) {
+	d.now += dt
+	if d.g.hold || d.g.alarm {
+		return
+	}
+	for dt > 0 && len(d.g.queue) > 0 {
+		mv := d.g.queue[0]
+		left := mv.dur - mv.t
+		if dt < left {
+			mv.t += dt
+			d.g.pos = mv.at()
+			return
+		}
+		dt -= left
+		d.g.pos = mv.to
+		d.g.done(mv)
+		d.g.queue = d.g.queue[1:]
+		d.qo++
+		d.cond.Broadcast()
+	}
+}
+
+// flush discards the queued moves and ends the feedhold.
+func (d *Device) flush() {
+	d.qo += len(d.g.queue)
+	d.g.queue = nil
+	d.g.planned = d.g.pos
+	d.g.hold = false
+	d.report(true)
+	d.cond.Broadcast()
+}
@@ -0,0 +1,264 @@
+package sim
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/samofly/gentle/tinyg"
+)
+
+// conn reads the responses of a device in background.
+type conn struct {
+	t     *testing.T
+	d     *Device
+	lines chan *tinyg.Response
+
+	// reports are the reports skipped while waiting for a response.
+	reports []*tinyg.Response
+}
+
+func open(t *testing.T) *conn {
+	d := New()
+	d.SetSpeed(100)
+	c := &conn{t: t, d: d, lines: make(chan *tinyg.Response, 1000)}
+	go func() {
+		s := bufio.NewScanner(d)
+		for s.Scan() {
+			r, err := tinyg.ParseResponse(s.Text())
+			if err != nil {
+				t.Errorf("ParseResponse(%s): %v", s.Text(), err)
+				continue
+			}
+			c.lines <- r
+		}
+		close(c.lines)
+	}()
+	return c
+}
+
+// next returns the next response or report.
+func (c *conn) next() *tinyg.Response {
+	select {
+	case r, ok := <-c.lines:
+		if !ok {
+			c.t.Fatal("Device closed")
+		}
+		return r
+	case <-time.After(5 * time.Second):
+		c.t.Fatal("Timeout waiting for the device")
+	}
+	return nil
+}
+
+// do sends the command and returns the response with a footer. Reports are kept for waitFor.
+func (c *conn) do(cmd string) *tinyg.Response {
+	if _, err := io.WriteString(c.d, cmd+"\n"); err != nil {
+		c.t.Fatalf("Write(%s): %v", cmd, err)
+	}
+	for {
+		r := c.next()
+		if r.Footer == nil {
+			c.reports = append(c.reports, r)
+			continue
+		}
+		if err := r.Verify(); err != nil {
+			c.t.Errorf("%s: %v", cmd, err)
+		}
+		return r
+	}
+}
+
+// waitFor skips the reports, until the condition is true.
+func (c *conn) waitFor(what string, cond func(r *tinyg.Response) bool) *tinyg.Response {
+	for len(c.reports) > 0 {
+		r := c.reports[0]
+		c.reports = c.reports[1:]
+		if cond(r) {
+			return r
+		}
+	}
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case r := <-c.lines:
+			if r != nil && cond(r) {
+				return r
+			}
+		case <-deadline:
+			c.t.Fatalf("Timeout waiting for %s", what)
+		}
+	}
+}
+
+func stat(st tinyg.MachineState) func(r *tinyg.Response) bool {
+	return func(r *tinyg.Response) bool { return r.Stat != nil && *r.Stat == st }
+}
+
+func TestCommands(t *testing.T) {
+	c := open(t)
+	defer c.d.Close()
+
+	tests := []struct {
+		cmd    string
+		status tinyg.StatusCode
+	}{
+		{`{"sv":1}`, tinyg.StatOK},
+		{`{"sr":{"mpox":t,"stat":t,"line":t}}`, tinyg.StatOK},
+		{`{"sr":{"mpox":t,"xyz":t}}`, tinyg.StatUnrecognizedName},
+		{`{"gc":"G21 G90 G54"}`, tinyg.StatOK},
+		{`G1 X1`, tinyg.StatGcodeFeedrateNotSpecified},
+		{`{"gc":"G38.2 Z-1"}`, tinyg.StatGcodeCommandUnsupported},
+		{`{"gc":"M100"}`, tinyg.StatMcodeCommandUnsupported},
+		{`{"gc":"G1 X1.2.3"}`, tinyg.StatBadNumberFormat},
+		{`{"gc":"G0 X1 (comment"}`, tinyg.StatGcodeGenericInputError},
+		{`{"xyz":null}`, tinyg.StatUnrecognizedName},
+		{`{"fb":1}`, tinyg.StatParameterIsReadOnly},
+		{`{"xvm":`, tinyg.StatJSONSyntaxError},
+		{`{"xvm":12000}`, tinyg.StatOK},
+	}
+	for _, tt := range tests {
+		r := c.do(tt.cmd)
+		if r.Footer.Status != tt.status {
+			t.Errorf("%s: status %v, want: %v", tt.cmd, r.Footer.Status, tt.status)
+		}
+	}
+
+	r := c.do(`{"x":null}`)
+	if !strings.Contains(r.Json, `"vm":12000`) {
+		t.Errorf(`{"x":null}: %s, want: "vm":12000`, r.Json)
+	}
+	c.do(`{"gc":"G10 L2 P2 X5"}`)
+	r = c.do(`{"g55":n}`)
+	if !strings.Contains(r.Json, `"x":5`) {
+		t.Errorf(`{"g55":n}: %s, want: "x":5`, r.Json)
+	}
+	r = c.do(`{"sr":""}`)
+	if r.Mpox == nil || *r.Mpox != 0 || r.Stat == nil || r.Line == nil || r.Posx != nil {
+		t.Errorf(`{"sr":""}: %v, want: mpox, stat and line`, r)
+	}
+
+	c.d.InjectError(tinyg.StatGenericError)
+	if r := c.do(`{"gc":"G0 X1"}`); r.Footer.Status != tinyg.StatGenericError {
+		t.Errorf("Injected error: status %v, want: %v", r.Footer.Status, tinyg.StatGenericError)
+	}
+	if x, _, _ := c.d.Position(); x != 0 {
+		t.Errorf("Rejected move: x = %v, want: 0", x)
+	}
+}
+
+func TestMotion(t *testing.T) {
+	c := open(t)
+	defer c.d.Close()
+	c.do(`{"qv":1}`)
+	c.do(`{"sr":{"mpox":t,"posx":t,"stat":t,"line":t}}`)
+
+	if r := c.do(`{"gc":"N7 G1 X10 F60"}`); r.Footer.Status != tinyg.StatOK {
+		t.Fatalf("G1 X10: status %v", r.Footer.Status)
+	}
+	c.waitFor("running", stat(tinyg.StateRun))
+	c.waitFor("interpolated position", func(r *tinyg.Response) bool {
+		return r.Mpox != nil && *r.Mpox > 0 && *r.Mpox < 10
+	})
+	c.waitFor("empty planner", func(r *tinyg.Response) bool { return r.QR != nil && *r.QR == plannerSize })
+	r := c.waitFor("stop", stat(tinyg.StateReady))
+	if r.Mpox == nil || *r.Mpox != 10 {
+		t.Errorf("Stopped at %v, want: mpox 10", r)
+	}
+
+	// Work offsets.
+	c.do(`{"gc":"G92 X0"}`)
+	c.do(`{"gc":"G0 X5"}`)
+	r = c.waitFor("stop", stat(tinyg.StateReady))
+	if r.Mpox == nil || *r.Mpox != 15 || r.Posx == nil || *r.Posx != 5 {
+		t.Errorf("G92 X0 G0 X5: %v, want: mpox 15, posx 5", r)
+	}
+}
+
+func TestFeedhold(t *testing.T) {
+	c := open(t)
+	defer c.d.Close()
+	c.d.SetSpeed(1)
+	c.do(`{"sr":{"mpox":t,"stat":t}}`)
+
+	c.do(`{"gc":"G1 X100 F600"}`)
+	c.do(`{"gc":"G1 X0"}`)
+	c.waitFor("running", stat(tinyg.StateRun))
+	io.WriteString(c.d, "!")
+	c.waitFor("hold", stat(tinyg.StateHold))
+	x, _, _ := c.d.Position()
+	time.Sleep(50 * time.Millisecond)
+	if x2, _, _ := c.d.Position(); x2 != x {
+		t.Errorf("Moving during feedhold: x %v -> %v", x, x2)
+	}
+	io.WriteString(c.d, "~")
+	c.waitFor("running", stat(tinyg.StateRun))
+
+	io.WriteString(c.d, "!%")
+	c.waitFor("flushed", stat(tinyg.StateReady))
+	x, _, _ = c.d.Position()
+	if x <= 0 || x >= 100 {
+		t.Errorf("Flushed at x %v, want: between 0 and 100", x)
+	}
+}
+
+func TestPlannerFull(t *testing.T) {
+	c := open(t)
+	defer c.d.Close()
+	c.d.SetSpeed(1)
+	for i := 0; i < plannerSize; i++ {
+		c.do(fmt.Sprintf(`{"gc":"G1 F100 X%d"}`, (i+1)%2))
+	}
+	// The planner is full, the next command is not read.
+	io.WriteString(c.d, `{"gc":"G0 Y1"}`+"\n")
+	timeout := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case r := <-c.lines:
+			if r.Footer != nil {
+				t.Errorf("Response with a full planner: %v", r)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	io.WriteString(c.d, "!%")
+	c.waitFor("response after the flush", func(r *tinyg.Response) bool { return r.Footer != nil })
+}
+
+func TestException(t *testing.T) {
+	c := open(t)
+	defer c.d.Close()
+	c.do(`{"sr":{"stat":t}}`)
+	c.do(`{"gc":"G1 X100 F600"}`)
+
+	c.d.InjectException(tinyg.StatLimitSwitchHit, "Limit switch hit - Shutdown occurred")
+	r := c.waitFor("exception report", func(r *tinyg.Response) bool { return r.Er != nil })
+	if r.Er.St != tinyg.StatLimitSwitchHit {
+		t.Errorf("Exception status %v, want: %v", r.Er.St, tinyg.StatLimitSwitchHit)
+	}
+	c.waitFor("alarm", stat(tinyg.StateAlarm))
+	if r := c.do(`{"gc":"G0 X1"}`); r.Footer.Status != tinyg.StatMachineAlarmed {
+		t.Errorf("Move in alarm: status %v, want: %v", r.Footer.Status, tinyg.StatMachineAlarmed)
+	}
+	c.do(`{"clear":n}`)
+	if r := c.do(`{"sr":""}`); r.Stat == nil || *r.Stat != tinyg.StateReady {
+		t.Errorf("Status after clear: %v, want: Ready", r)
+	}
+	if r := c.do(`{"gc":"G0 X1"}`); r.Footer.Status != tinyg.StatOK {
+		t.Errorf("Move after clear: status %v, want: OK", r.Footer.Status)
+	}
+}
+
+func TestOverflow(t *testing.T) {
+	d := New()
+	defer d.Close()
+	d.Write(make([]byte, rxSize+10))
+	if got := d.Overflows(); got != 10 {
+		t.Errorf("Overflows() = %d, want: 10", got)
+	}
+}
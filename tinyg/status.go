@@ -0,0 +1,333 @@
+package tinyg
+
+import "fmt"
+
+// StatusCode is a status code reported by TinyG in the response footer and in exception reports.
+// See https://github.com/synthetos/TinyG/wiki/TinyG-Status-Codes for more details.
+type StatusCode int
+
+// The status codes of TinyG, grouped by the ranges of the firmware.
+const (
+	// Status codes 0-19 are the low-level codes of the system and the communication.
+	StatOK                 StatusCode = 0
+	StatError              StatusCode = 1
+	StatEAgain             StatusCode = 2
+	StatNoop               StatusCode = 3
+	StatComplete           StatusCode = 4
+	StatTerminate          StatusCode = 5
+	StatReset              StatusCode = 6
+	StatEOL                StatusCode = 7
+	StatEOF                StatusCode = 8
+	StatFileNotOpen        StatusCode = 9
+	StatFileSizeExceeded   StatusCode = 10
+	StatNoSuchDevice       StatusCode = 11
+	StatBufferEmpty        StatusCode = 12
+	StatBufferFull         StatusCode = 13
+	StatBufferFullFatal    StatusCode = 14
+	StatInitializing       StatusCode = 15
+	StatEnteringBootLoader StatusCode = 16
+	StatFunctionIsStubbed  StatusCode = 17
+
+	// Status codes 20-89 are the internal errors and the errors of the configuration.
+	StatInternalError              StatusCode = 20
+	StatInternalRangeError         StatusCode = 21
+	StatFloatingPointError         StatusCode = 22
+	StatDivideByZero               StatusCode = 23
+	StatInvalidAddress             StatusCode = 24
+	StatReadOnlyAddress            StatusCode = 25
+	StatInitFail                   StatusCode = 26
+	StatAlarmed                    StatusCode = 27
+	StatFailedToGetPlannerBuffer   StatusCode = 28
+	StatGenericExceptionReport     StatusCode = 29
+	StatPrepLineMoveTimeIsInfinite StatusCode = 30
+	StatPrepLineMoveTimeIsNaN      StatusCode = 31
+	StatFloatIsInfinite            StatusCode = 32
+	StatFloatIsNaN                 StatusCode = 33
+	StatPersistenceError           StatusCode = 34
+	StatBadStatusReportSetting     StatusCode = 35
+
+	// Status codes 90-129 are the failed assertions and the errors of the json and text input.
+	StatConfigAssertionFailure           StatusCode = 90
+	StatXIOAssertionFailure              StatusCode = 91
+	StatEncoderAssertionFailure          StatusCode = 92
+	StatStepperAssertionFailure          StatusCode = 93
+	StatPlannerAssertionFailure          StatusCode = 94
+	StatCanonicalMachineAssertionFailure StatusCode = 95
+	StatControllerAssertionFailure       StatusCode = 96
+	StatStackOverflow                    StatusCode = 97
+	StatMemoryFault                      StatusCode = 98
+	StatGenericAssertionFailure          StatusCode = 99
+	StatUnrecognizedName                 StatusCode = 100
+	StatInvalidOrMalformedCommand        StatusCode = 101
+	StatBadNumberFormat                  StatusCode = 102
+	StatUnsupportedType                  StatusCode = 103
+	StatParameterIsReadOnly              StatusCode = 104
+	StatParameterCannotBeRead            StatusCode = 105
+	StatCommandNotAccepted               StatusCode = 106
+	StatInputExceedsMaxLength            StatusCode = 107
+	StatInputLessThanMinValue            StatusCode = 108
+	StatInputExceedsMaxValue             StatusCode = 109
+	StatInputValueRangeError             StatusCode = 110
+	StatJSONSyntaxError                  StatusCode = 111
+	StatJSONTooManyPairs                 StatusCode = 112
+	StatJSONTooLong                      StatusCode = 113
+
+	// Status codes 130-199 are the errors of the g-code input.
+	StatGcodeGenericInputError            StatusCode = 130
+	StatGcodeCommandUnsupported           StatusCode = 131
+	StatMcodeCommandUnsupported           StatusCode = 132
+	StatGcodeModalGroupViolation          StatusCode = 133
+	StatGcodeAxisIsMissing                StatusCode = 134
+	StatGcodeAxisCannotBePresent          StatusCode = 135
+	StatGcodeAxisIsInvalid                StatusCode = 136
+	StatGcodeAxisIsNotConfigured          StatusCode = 137
+	StatGcodeAxisNumberIsMissing          StatusCode = 138
+	StatGcodeAxisNumberIsInvalid          StatusCode = 139
+	StatGcodeActivePlaneIsMissing         StatusCode = 140
+	StatGcodeActivePlaneIsInvalid         StatusCode = 141
+	StatGcodeFeedrateNotSpecified         StatusCode = 142
+	StatGcodeInverseTimeModeCannotBeUsed  StatusCode = 143
+	StatGcodeRotaryAxisCannotBeUsed       StatusCode = 144
+	StatGcodeG53WithoutG0OrG1             StatusCode = 145
+	StatRequestedVelocityExceedsLimits    StatusCode = 146
+	StatCutterCompensationCannotBeEnabled StatusCode = 147
+	StatProgrammedPointSameAsCurrentPoint StatusCode = 148
+	StatSpindleSpeedBelowMinimum          StatusCode = 149
+	StatSpindleSpeedMaxExceeded           StatusCode = 150
+	StatSWordIsMissing                    StatusCode = 151
+	StatSWordIsInvalid                    StatusCode = 152
+	StatSpindleMustBeOff                  StatusCode = 153
+	StatSpindleMustBeTurning              StatusCode = 154
+	StatArcSpecificationError             StatusCode = 155
+	StatArcAxisMissingForSelectedPlane    StatusCode = 156
+	StatArcOffsetsMissingForSelectedPlane StatusCode = 157
+	StatArcRadiusOutOfTolerance           StatusCode = 158
+	StatArcEndpointIsStartingPoint        StatusCode = 159
+	StatPWordIsMissing                    StatusCode = 160
+	StatPWordIsInvalid                    StatusCode = 161
+	StatPWordIsZero                       StatusCode = 162
+	StatPWordIsNegative                   StatusCode = 163
+	StatPWordIsNotAnInteger               StatusCode = 164
+	StatPWordIsNotValidToolNumber         StatusCode = 165
+	StatDWordIsMissing                    StatusCode = 166
+	StatDWordIsInvalid                    StatusCode = 167
+	StatEWordIsMissing                    StatusCode = 168
+	StatEWordIsInvalid                    StatusCode = 169
+	StatHWordIsMissing                    StatusCode = 170
+	StatHWordIsInvalid                    StatusCode = 171
+	StatLWordIsMissing                    StatusCode = 172
+	StatLWordIsInvalid                    StatusCode = 173
+	StatQWordIsMissing                    StatusCode = 174
+	StatQWordIsInvalid                    StatusCode = 175
+	StatRWordIsMissing                    StatusCode = 176
+	StatRWordIsInvalid                    StatusCode = 177
+	StatTWordIsMissing                    StatusCode = 178
+	StatTWordIsInvalid                    StatusCode = 179
+
+	// Status codes 200-219 are the errors of the planner and the machine.
+	StatGenericError            StatusCode = 200
+	StatMinimumLengthMove       StatusCode = 201
+	StatMinimumTimeMove         StatusCode = 202
+	StatMachineAlarmed          StatusCode = 203
+	StatLimitSwitchHit          StatusCode = 204
+	StatPlannerFailedToConverge StatusCode = 205
+
+	// Status codes 220-239 are the soft limits, which the moves would exceed.
+	StatSoftLimitExceeded     StatusCode = 220
+	StatSoftLimitExceededXMin StatusCode = 221
+	StatSoftLimitExceededXMax StatusCode = 222
+	StatSoftLimitExceededYMin StatusCode = 223
+	StatSoftLimitExceededYMax StatusCode = 224
+	StatSoftLimitExceededZMin StatusCode = 225
+	StatSoftLimitExceededZMax StatusCode = 226
+	StatSoftLimitExceededAMin StatusCode = 227
+	StatSoftLimitExceededAMax StatusCode = 228
+	StatSoftLimitExceededBMin StatusCode = 229
+	StatSoftLimitExceededBMax StatusCode = 230
+	StatSoftLimitExceededCMin StatusCode = 231
+	StatSoftLimitExceededCMax StatusCode = 232
+
+	// Status codes 240-249 are the errors of the homing cycle.
+	StatHomingCycleFailed                 StatusCode = 240
+	StatHomingErrorBadOrNoAxis            StatusCode = 241
+	StatHomingErrorZeroSearchVelocity     StatusCode = 242
+	StatHomingErrorZeroLatchVelocity      StatusCode = 243
+	StatHomingErrorTravelMinMaxIdentical  StatusCode = 244
+	StatHomingErrorNegativeLatchBackoff   StatusCode = 245
+	StatHomingErrorSwitchMisconfiguration StatusCode = 246
+
+	// Status codes 250-255 are the errors of the probing and the jogging cycles.
+	StatProbeCycleFailed             StatusCode = 250
+	StatProbeEndpointIsStartingPoint StatusCode = 251
+	StatJoggingCycleFailed           StatusCode = 252
+)
+
+type statusInfo struct {
+	name string
+	msg  string
+}
+
+var statusCodes = map[StatusCode]statusInfo{
+	StatOK:                                {"OK", "OK"},
+	StatError:                             {"ERROR", "Error"},
+	StatEAgain:                            {"EAGAIN", "Eagain"},
+	StatNoop:                              {"NOOP", "No operation performed"},
+	StatComplete:                          {"COMPLETE", "Completed operation"},
+	StatTerminate:                         {"TERMINATE", "Operation terminated (gracefully)"},
+	StatReset:                             {"RESET", "Operation was hard reset (sig kill)"},
+	StatEOL:                               {"EOL", "End of line"},
+	StatEOF:                               {"EOF", "End of file"},
+	StatFileNotOpen:                       {"FILE_NOT_OPEN", "File not open"},
+	StatFileSizeExceeded:                  {"FILE_SIZE_EXCEEDED", "Max file size exceeded"},
+	StatNoSuchDevice:                      {"NO_SUCH_DEVICE", "No such device"},
+	StatBufferEmpty:                       {"BUFFER_EMPTY", "Buffer empty"},
+	StatBufferFull:                        {"BUFFER_FULL", "Buffer full"},
+	StatBufferFullFatal:                   {"BUFFER_FULL_FATAL", "Buffer full - fatal"},
+	StatInitializing:                      {"INITIALIZING", "Initializing"},
+	StatEnteringBootLoader:                {"ENTERING_BOOT_LOADER", "Entering boot loader"},
+	StatFunctionIsStubbed:                 {"FUNCTION_IS_STUBBED", "Function is stubbed"},
+	StatInternalError:                     {"INTERNAL_ERROR", "Internal error"},
+	StatInternalRangeError:                {"INTERNAL_RANGE_ERROR", "Internal range error"},
+	StatFloatingPointError:                {"FLOATING_POINT_ERROR", "Floating point error"},
+	StatDivideByZero:                      {"DIVIDE_BY_ZERO", "Divide by zero"},
+	StatInvalidAddress:                    {"INVALID_ADDRESS", "Invalid Address"},
+	StatReadOnlyAddress:                   {"READ_ONLY_ADDRESS", "Read-only address"},
+	StatInitFail:                          {"INIT_FAIL", "Initialization failure"},
+	StatAlarmed:                           {"ALARMED", "System alarm - shutting down"},
+	StatFailedToGetPlannerBuffer:          {"FAILED_TO_GET_PLANNER_BUFFER", "Failed to get planner buffer"},
+	StatGenericExceptionReport:            {"GENERIC_EXCEPTION_REPORT", "Generic exception report"},
+	StatPrepLineMoveTimeIsInfinite:        {"PREP_LINE_MOVE_TIME_IS_INFINITE", "Move time is infinite"},
+	StatPrepLineMoveTimeIsNaN:             {"PREP_LINE_MOVE_TIME_IS_NAN", "Move time is NAN"},
+	StatFloatIsInfinite:                   {"FLOAT_IS_INFINITE", "Float is infinite"},
+	StatFloatIsNaN:                        {"FLOAT_IS_NAN", "Float is NAN"},
+	StatPersistenceError:                  {"PERSISTENCE_ERROR", "Persistence error"},
+	StatBadStatusReportSetting:            {"BAD_STATUS_REPORT_SETTING", "Bad status report setting"},
+	StatConfigAssertionFailure:            {"CONFIG_ASSERTION_FAILURE", "Config assertion failure"},
+	StatXIOAssertionFailure:               {"XIO_ASSERTION_FAILURE", "XIO assertion failure"},
+	StatEncoderAssertionFailure:           {"ENCODER_ASSERTION_FAILURE", "Encoder assertion failure"},
+	StatStepperAssertionFailure:           {"STEPPER_ASSERTION_FAILURE", "Stepper assertion failure"},
+	StatPlannerAssertionFailure:           {"PLANNER_ASSERTION_FAILURE", "Planner assertion failure"},
+	StatCanonicalMachineAssertionFailure:  {"CANONICAL_MACHINE_ASSERTION_FAILURE", "Canonical machine assertion failure"},
+	StatControllerAssertionFailure:        {"CONTROLLER_ASSERTION_FAILURE", "Controller assertion failure"},
+	StatStackOverflow:                     {"STACK_OVERFLOW", "Stack overflow detected"},
+	StatMemoryFault:                       {"MEMORY_FAULT", "Memory fault detected"},
+	StatGenericAssertionFailure:           {"GENERIC_ASSERTION_FAILURE", "Generic assertion failure"},
+	StatUnrecognizedName:                  {"UNRECOGNIZED_NAME", "Unrecognized command or config name"},
+	StatInvalidOrMalformedCommand:         {"INVALID_OR_MALFORMED_COMMAND", "Invalid or malformed command"},
+	StatBadNumberFormat:                   {"BAD_NUMBER_FORMAT", "Bad number format"},
+	StatUnsupportedType:                   {"UNSUPPORTED_TYPE", "Unsupported number or JSON type"},
+	StatParameterIsReadOnly:               {"PARAMETER_IS_READ_ONLY", "Parameter is read-only"},
+	StatParameterCannotBeRead:             {"PARAMETER_CANNOT_BE_READ", "Parameter cannot be read"},
+	StatCommandNotAccepted:                {"COMMAND_NOT_ACCEPTED", "Command not accepted"},
+	StatInputExceedsMaxLength:             {"INPUT_EXCEEDS_MAX_LENGTH", "Input exceeds max length"},
+	StatInputLessThanMinValue:             {"INPUT_LESS_THAN_MIN_VALUE", "Input less than minimum value"},
+	StatInputExceedsMaxValue:              {"INPUT_EXCEEDS_MAX_VALUE", "Input exceeds maximum value"},
+	StatInputValueRangeError:              {"INPUT_VALUE_RANGE_ERROR", "Input value range error"},
+	StatJSONSyntaxError:                   {"JSON_SYNTAX_ERROR", "JSON syntax error"},
+	StatJSONTooManyPairs:                  {"JSON_TOO_MANY_PAIRS", "JSON input has too many pairs"},
+	StatJSONTooLong:                       {"JSON_TOO_LONG", "JSON string too long"},
+	StatGcodeGenericInputError:            {"GCODE_GENERIC_INPUT_ERROR", "Generic Gcode input error"},
+	StatGcodeCommandUnsupported:           {"GCODE_COMMAND_UNSUPPORTED", "Gcode command unsupported"},
+	StatMcodeCommandUnsupported:           {"MCODE_COMMAND_UNSUPPORTED", "Mcode command unsupported"},
+	StatGcodeModalGroupViolation:          {"GCODE_MODAL_GROUP_VIOLATION", "Gcode modal group violation"},
+	StatGcodeAxisIsMissing:                {"GCODE_AXIS_IS_MISSING", "Axis word missing"},
+	StatGcodeAxisCannotBePresent:          {"GCODE_AXIS_CANNOT_BE_PRESENT", "Axis cannot be present"},
+	StatGcodeAxisIsInvalid:                {"GCODE_AXIS_IS_INVALID", "Axis is invalid for this command"},
+	StatGcodeAxisIsNotConfigured:          {"GCODE_AXIS_IS_NOT_CONFIGURED", "Axis is disabled"},
+	StatGcodeAxisNumberIsMissing:          {"GCODE_AXIS_NUMBER_IS_MISSING", "Axis target position is missing"},
+	StatGcodeAxisNumberIsInvalid:          {"GCODE_AXIS_NUMBER_IS_INVALID", "Axis target position is invalid"},
+	StatGcodeActivePlaneIsMissing:         {"GCODE_ACTIVE_PLANE_IS_MISSING", "Selected plane is missing"},
+	StatGcodeActivePlaneIsInvalid:         {"GCODE_ACTIVE_PLANE_IS_INVALID", "Selected plane is invalid"},
+	StatGcodeFeedrateNotSpecified:         {"GCODE_FEEDRATE_NOT_SPECIFIED", "Feedrate not specified"},
+	StatGcodeInverseTimeModeCannotBeUsed:  {"GCODE_INVERSE_TIME_MODE_CANNOT_BE_USED", "Inverse time mode cannot be used with this command"},
+	StatGcodeRotaryAxisCannotBeUsed:       {"GCODE_ROTARY_AXIS_CANNOT_BE_USED", "Rotary axes cannot be used with this command"},
+	StatGcodeG53WithoutG0OrG1:             {"GCODE_G53_WITHOUT_G0_OR_G1", "G0 or G1 must be active for G53"},
+	StatRequestedVelocityExceedsLimits:    {"REQUESTED_VELOCITY_EXCEEDS_LIMITS", "Requested velocity exceeds limits"},
+	StatCutterCompensationCannotBeEnabled: {"CUTTER_COMPENSATION_CANNOT_BE_ENABLED", "Cutter compensation cannot be enabled"},
+	StatProgrammedPointSameAsCurrentPoint: {"PROGRAMMED_POINT_SAME_AS_CURRENT_POINT", "Programmed point same as current point"},
+	StatSpindleSpeedBelowMinimum:          {"SPINDLE_SPEED_BELOW_MINIMUM", "Spindle speed below minimum"},
+	StatSpindleSpeedMaxExceeded:           {"SPINDLE_SPEED_MAX_EXCEEDED", "Spindle speed exceeded maximum"},
+	StatSWordIsMissing:                    {"S_WORD_IS_MISSING", "Spindle S word is missing"},
+	StatSWordIsInvalid:                    {"S_WORD_IS_INVALID", "Spindle S word is invalid"},
+	StatSpindleMustBeOff:                  {"SPINDLE_MUST_BE_OFF", "Spindle must be off for this command"},
+	StatSpindleMustBeTurning:              {"SPINDLE_MUST_BE_TURNING", "Spindle must be turning for this command"},
+	StatArcSpecificationError:             {"ARC_SPECIFICATION_ERROR", "Arc specification error"},
+	StatArcAxisMissingForSelectedPlane:    {"ARC_AXIS_MISSING_FOR_SELECTED_PLANE", "Arc axis missing for selected plane"},
+	StatArcOffsetsMissingForSelectedPlane: {"ARC_OFFSETS_MISSING_FOR_SELECTED_PLANE", "Arc offset missing for selected plane"},
+	StatArcRadiusOutOfTolerance:           {"ARC_RADIUS_OUT_OF_TOLERANCE", "Arc radius arc out of tolerance"},
+	StatArcEndpointIsStartingPoint:        {"ARC_ENDPOINT_IS_STARTING_POINT", "Arc endpoint is starting point"},
+	StatPWordIsMissing:                    {"P_WORD_IS_MISSING", "P word is missing"},
+	StatPWordIsInvalid:                    {"P_WORD_IS_INVALID", "P word is invalid"},
+	StatPWordIsZero:                       {"P_WORD_IS_ZERO", "P word is zero"},
+	StatPWordIsNegative:                   {"P_WORD_IS_NEGATIVE", "P word is negative"},
+	StatPWordIsNotAnInteger:               {"P_WORD_IS_NOT_AN_INTEGER", "P word is not an integer"},
+	StatPWordIsNotValidToolNumber:         {"P_WORD_IS_NOT_VALID_TOOL_NUMBER", "P word is not a valid tool number"},
+	StatDWordIsMissing:                    {"D_WORD_IS_MISSING", "D word is missing"},
+	StatDWordIsInvalid:                    {"D_WORD_IS_INVALID", "D word is invalid"},
+	StatEWordIsMissing:                    {"E_WORD_IS_MISSING", "E word is missing"},
+	StatEWordIsInvalid:                    {"E_WORD_IS_INVALID", "E word is invalid"},
+	StatHWordIsMissing:                    {"H_WORD_IS_MISSING", "H word is missing"},
+	StatHWordIsInvalid:                    {"H_WORD_IS_INVALID", "H word is invalid"},
+	StatLWordIsMissing:                    {"L_WORD_IS_MISSING", "L word is missing"},
+	StatLWordIsInvalid:                    {"L_WORD_IS_INVALID", "L word is invalid"},
+	StatQWordIsMissing:                    {"Q_WORD_IS_MISSING", "Q word is missing"},
+	StatQWordIsInvalid:                    {"Q_WORD_IS_INVALID", "Q word is invalid"},
+	StatRWordIsMissing:                    {"R_WORD_IS_MISSING", "R word is missing"},
+	StatRWordIsInvalid:                    {"R_WORD_IS_INVALID", "R word is invalid"},
+	StatTWordIsMissing:                    {"T_WORD_IS_MISSING", "T word is missing"},
+	StatTWordIsInvalid:                    {"T_WORD_IS_INVALID", "T word is invalid"},
+	StatGenericError:                      {"GENERIC_ERROR", "Generic error"},
+	StatMinimumLengthMove:                 {"MINIMUM_LENGTH_MOVE", "Move less than minimum length"},
+	StatMinimumTimeMove:                   {"MINIMUM_TIME_MOVE", "Move less than minimum time"},
+	StatMachineAlarmed:                    {"MACHINE_ALARMED", "Machine is alarmed - Command not processed"},
+	StatLimitSwitchHit:                    {"LIMIT_SWITCH_HIT", "Limit switch hit - Shutdown occurred"},
+	StatPlannerFailedToConverge:           {"PLANNER_FAILED_TO_CONVERGE", "Trapezoid planner failed to converge"},
+	StatSoftLimitExceeded:                 {"SOFT_LIMIT_EXCEEDED", "Soft limit exceeded"},
+	StatSoftLimitExceededXMin:             {"SOFT_LIMIT_EXCEEDED_XMIN", "Soft limit exceeded - X min"},
+	StatSoftLimitExceededXMax:             {"SOFT_LIMIT_EXCEEDED_XMAX", "Soft limit exceeded - X max"},
+	StatSoftLimitExceededYMin:             {"SOFT_LIMIT_EXCEEDED_YMIN", "Soft limit exceeded - Y min"},
+	StatSoftLimitExceededYMax:             {"SOFT_LIMIT_EXCEEDED_YMAX", "Soft limit exceeded - Y max"},
+	StatSoftLimitExceededZMin:             {"SOFT_LIMIT_EXCEEDED_ZMIN", "Soft limit exceeded - Z min"},
+	StatSoftLimitExceededZMax:             {"SOFT_LIMIT_EXCEEDED_ZMAX", "Soft limit exceeded - Z max"},
+	StatSoftLimitExceededAMin:             {"SOFT_LIMIT_EXCEEDED_AMIN", "Soft limit exceeded - A min"},
+	StatSoftLimitExceededAMax:             {"SOFT_LIMIT_EXCEEDED_AMAX", "Soft limit exceeded - A max"},
+	StatSoftLimitExceededBMin:             {"SOFT_LIMIT_EXCEEDED_BMIN", "Soft limit exceeded - B min"},
+	StatSoftLimitExceededBMax:             {"SOFT_LIMIT_EXCEEDED_BMAX", "Soft limit exceeded - B max"},
+	StatSoftLimitExceededCMin:             {"SOFT_LIMIT_EXCEEDED_CMIN", "Soft limit exceeded - C min"},
+	StatSoftLimitExceededCMax:             {"SOFT_LIMIT_EXCEEDED_CMAX", "Soft limit exceeded - C max"},
+	StatHomingCycleFailed:                 {"HOMING_CYCLE_FAILED", "Homing cycle failed"},
+	StatHomingErrorBadOrNoAxis:            {"HOMING_ERROR_BAD_OR_NO_AXIS", "Homing Error - Bad or no axis specified"},
+	StatHomingErrorZeroSearchVelocity:     {"HOMING_ERROR_ZERO_SEARCH_VELOCITY", "Homing Error - Search velocity is zero"},
+	StatHomingErrorZeroLatchVelocity:      {"HOMING_ERROR_ZERO_LATCH_VELOCITY", "Homing Error - Latch velocity is zero"},
+	StatHomingErrorTravelMinMaxIdentical:  {"HOMING_ERROR_TRAVEL_MIN_MAX_IDENTICAL", "Homing Error - Travel min & max are the same"},
+	StatHomingErrorNegativeLatchBackoff:   {"HOMING_ERROR_NEGATIVE_LATCH_BACKOFF", "Homing Error - Negative latch backoff"},
+	StatHomingErrorSwitchMisconfiguration: {"HOMING_ERROR_SWITCH_MISCONFIGURATION", "Homing Error - Homing switches misconfigured"},
+	StatProbeCycleFailed:                  {"PROBE_CYCLE_FAILED", "Probe cycle failed"},
+	StatProbeEndpointIsStartingPoint:      {"PROBE_ENDPOINT_IS_STARTING_POINT", "Probe endpoint is starting point"},
+	StatJoggingCycleFailed:                {"JOGGING_CYCLE_FAILED", "Jogging cycle failed"},
+}
+
+// Name returns the name of the status code, such as GCODE_AXIS_IS_MISSING.
+func (c StatusCode) Name() string {
+	if info, ok := statusCodes[c]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("UNKNOWN_%d", int(c))
+}
+
+// Message returns a human-readable description of the status code.
+func (c StatusCode) Message() string {
+	if info, ok := statusCodes[c]; ok {
+		return info.msg
+	}
+	return fmt.Sprintf("Unknown status code %d", int(c))
+}
+
+func (c StatusCode) String() string {
+	return fmt.Sprintf("%d (%s): %s", int(c), c.Name(), c.Message())
+}
+
+// OK returns true, if the status code means that the command was accepted.
+func (c StatusCode) OK() bool {
+	return c == StatOK || c == StatNoop || c == StatComplete
+}